@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const configDirPollInterval = 2 * time.Second
+
+// configDirFiles lists yaml files in dir sorted by name, skipping the ones disabled by renaming to *.disabled
+func configDirFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config dir: %w", err)
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, ".disabled") {
+			continue
+		}
+		if ext := filepath.Ext(name); ext != ".yaml" && ext != ".yml" {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// configDirState changes whenever a file in dir is added, removed, renamed or modified
+func configDirState(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+
+	var b strings.Builder
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&b, "%s:%d:%d\n", entry.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String()
+}
+
+// watchConfigDir polls dir and calls reload when its files change
+func watchConfigDir(ctx context.Context, dir string, reload func()) {
+	ticker := time.NewTicker(configDirPollInterval)
+	defer ticker.Stop()
+
+	state := configDirState(dir)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if current := configDirState(dir); current != state {
+				state = current
+				reload()
+			}
+		}
+	}
+}
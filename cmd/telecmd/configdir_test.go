@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"github.com/abdusco/telecmd/internal/telecmd"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadConfigDir(t *testing.T) {
+	tests := []struct {
+		name      string
+		files     map[string]string
+		wantRules []string
+		wantReply string
+	}{
+		{
+			name: "disabled file is skipped",
+			files: map[string]string{
+				"bot.yaml":             "unmatchedReply: abc\n",
+				"deploy.yaml":          "rules:\n  - name: deploy\n    pattern: /deploy\n    command: [echo, deploy]\n",
+				"backup.yaml.disabled": "rules:\n  - name: backup\n    pattern: /backup\n    command: [echo, backup]\n",
+			},
+			wantRules: []string{"deploy"},
+			wantReply: "abc",
+		},
+		{
+			name: "non yaml files and directories are skipped",
+			files: map[string]string{
+				"bot.yml":    "unmatchedReply: abc\n",
+				"notes.txt":  "rules: [",
+				"deploy.yml": "rules:\n  - name: deploy\n    pattern: /deploy\n    command: [echo, deploy]\n",
+			},
+			wantRules: []string{"deploy"},
+			wantReply: "abc",
+		},
+		{
+			name: "rules are appended in file name order, settings are replaced",
+			files: map[string]string{
+				"10-bot.yaml":   "unmatchedReply: abc\nrules:\n  - name: first\n    pattern: /first\n    command: [echo]\n",
+				"20-more.yaml":  "unmatchedReply: def\nrules:\n  - name: second\n    pattern: /second\n    command: [echo]\n",
+				"05-early.yaml": "rules:\n  - name: zeroth\n    pattern: /zeroth\n    command: [echo]\n",
+			},
+			wantRules: []string{"zeroth", "first", "second"},
+			wantReply: "def",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeConfigFiles(t, tt.files)
+			if err := os.Mkdir(filepath.Join(dir, "sub.yaml"), 0o700); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := loadConfig("", dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.UnmatchedReply != tt.wantReply {
+				t.Errorf("unmatchedReply = %q, want %q", config.UnmatchedReply, tt.wantReply)
+			}
+			var got []string
+			for _, rule := range config.Rules {
+				got = append(got, rule.Name)
+			}
+			if len(got) != len(tt.wantRules) {
+				t.Fatalf("rules = %v, want %v", got, tt.wantRules)
+			}
+			for i := range got {
+				if got[i] != tt.wantRules[i] {
+					t.Fatalf("rules = %v, want %v", got, tt.wantRules)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigDirStateChangesOnDisable(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{"deploy.yaml": "rules: []\n"})
+	before := configDirState(dir)
+
+	if err := os.Rename(filepath.Join(dir, "deploy.yaml"), filepath.Join(dir, "deploy.yaml.disabled")); err != nil {
+		t.Fatal(err)
+	}
+	if configDirState(dir) == before {
+		t.Error("state didn't change after disabling a file")
+	}
+}
+
+func TestConfigDirEvaluationOrder(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"10-catchall.yaml": "rules:\n  - name: catchall\n    pattern: /.*\n    command: [echo, catchall]\n",
+		"20-deploy.yaml":   "rules:\n  - name: deploy\n    pattern: /deploy.*\n    command: [echo, deploy]\n",
+		"30-urgent.yaml":   "rules:\n  - name: urgent\n    pattern: /deploy now\n    priority: 10\n    command: [echo, urgent]\n",
+	})
+	config, err := loadConfig("", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := telecmd.New(config)
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		// earlier files win among rules of the same priority
+		{text: "/deploy", want: "catchall"},
+		{text: "/status", want: "catchall"},
+		// higher priority wins regardless of the file
+		{text: "/deploy now", want: "urgent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			message := &tgbotapi.Message{
+				Text: tt.text,
+				Chat: &tgbotapi.Chat{ID: 1, Type: "private"},
+				From: &tgbotapi.User{ID: 1},
+			}
+			rule, _, ok := tc.Handle(context.Background(), tgbotapi.Update{Message: message}, message)
+			if !ok {
+				t.Fatal("no rule ran")
+			}
+			if rule.Name != tt.want {
+				t.Errorf("ran %s, want %s", rule.Name, tt.want)
+			}
+		})
+	}
+}
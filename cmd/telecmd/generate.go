@@ -0,0 +1,33 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+)
+
+//go:embed example.yaml
+var exampleConfig []byte
+
+// generateConfig writes the example config to path, refusing to replace an existing file unless forced
+func generateConfig(path string, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(path, flags, 0o644)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s already exists, pass --force to overwrite it", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create config file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(exampleConfig); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		force    bool
+		wantErr  bool
+	}{
+		{name: "new file"},
+		{name: "existing file", existing: "rules: []\n", wantErr: true},
+		{name: "existing file forced", existing: "rules: []\n", force: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if tt.existing != "" {
+				if err := os.WriteFile(path, []byte(tt.existing), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := generateConfig(path, tt.force)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+
+			written, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr {
+				if string(written) != tt.existing {
+					t.Errorf("existing file was changed to %q", written)
+				}
+				return
+			}
+			if !bytes.Equal(written, exampleConfig) {
+				t.Errorf("wrote %q, want the example config", written)
+			}
+
+			// the scaffold is a valid config with a rule to start from
+			config, err := loadConfig(path, "")
+			if err != nil {
+				t.Fatalf("cannot load generated config: %v", err)
+			}
+			if len(config.Rules) == 0 {
+				t.Error("generated config has no rules")
+			}
+		})
+	}
+}
@@ -9,40 +9,103 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v3"
+	"io"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 )
 
 type cliArgs struct {
-	Version    kong.VersionFlag `help:"Show version"`
-	ConfigPath string           `arg:"" type:"existingfile" help:"Path to config file"`
-	Token      string           `env:"TELEGRAM_BOT_TOKEN" required:"" help:"Telegram bot token"`
-	Debug      bool             `env:"DEBUG" default:"false" help:"Enable debug logging"`
+	Version        kong.VersionFlag `help:"Show version"`
+	ConfigPath     string           `arg:"" optional:"" type:"existingfile" help:"Path to config file"`
+	ConfigDir      string           `type:"existingdir" help:"Directory of config files merged in name order, files ending in .disabled are skipped. Changes are picked up while running"`
+	Token          string           `env:"TELEGRAM_BOT_TOKEN" help:"Telegram bot token"`
+	Debug          bool             `env:"DEBUG" default:"false" help:"Enable debug logging"`
+	Once           bool             `help:"Handle a single message without connecting to Telegram and print the reply"`
+	Message        string           `help:"Message text to handle in --once mode, read from stdin if not set"`
+	PrintConfig    bool             `help:"Print the effective config with defaults filled in and secrets masked and exit"`
+	ListRules      bool             `help:"Print a table of the rules in the config and exit"`
+	GenerateConfig string           `placeholder:"PATH" help:"Write an example config to PATH and exit"`
+	Force          bool             `help:"Overwrite the file with --generate-config"`
 }
 
 func main() {
 	var args cliArgs
-	kong.Parse(&args, kong.Vars{"version": version.GitVersion().String()})
-
+	kctx := kong.Parse(&args, kong.Vars{"version": version.GitVersion().String()})
 	level := zerolog.InfoLevel
 	if args.Debug {
 		level = zerolog.DebugLevel
 	}
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).Level(level)
 
-	config, err := loadConfig(args.ConfigPath)
+	if args.GenerateConfig != "" {
+		if err := generateConfig(args.GenerateConfig, args.Force); err != nil {
+			log.Fatal().Err(err).Msg("cannot generate config")
+		}
+		log.Info().Str("path", args.GenerateConfig).Msg("wrote example config")
+		return
+	}
+
+	config, err := loadConfig(args.ConfigPath, args.ConfigDir)
 	if err != nil {
 		log.Fatal().Err(err).Msg("error loading config")
 	}
 
+	if !args.Once && !args.PrintConfig && !args.ListRules && args.Token == "" && config.TokenFile == "" && len(config.Bots) == 0 {
+		kctx.Fatalf("missing flags: --token=STRING")
+	}
+
 	config.Debug = args.Debug
 	config.BotToken = args.Token
 
+	if args.PrintConfig {
+		if err := printConfig(os.Stdout, config); err != nil {
+			log.Fatal().Err(err).Msg("cannot print config")
+		}
+		return
+	}
+
+	if args.ListRules {
+		if err := listRules(os.Stdout, config); err != nil {
+			log.Fatal().Err(err).Msg("cannot list rules")
+		}
+		return
+	}
+
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
 	defer cancel()
 
-	tc := telecmd.New(config)
+	reloadConfig := func() (telecmd.Config, error) {
+		config, err := loadConfig(args.ConfigPath, args.ConfigDir)
+		if err != nil {
+			return telecmd.Config{}, err
+		}
+		config.Debug = args.Debug
+		config.BotToken = args.Token
+		return config, nil
+	}
+
+	tc := telecmd.New(config).WithLoader(reloadConfig)
+
+	if args.Once {
+		if err := runOnce(ctx, tc, args.Message, os.Stdin, os.Stdout); err != nil {
+			log.Fatal().Err(err).Msg("exit with error")
+		}
+		return
+	}
+
+	if args.ConfigDir != "" {
+		go watchConfigDir(ctx, args.ConfigDir, func() {
+			config, err := reloadConfig()
+			if err != nil {
+				log.Error().Err(err).Msg("not reloading invalid config")
+				return
+			}
+			tc.Reload(config)
+			log.Info().Int("rules", len(config.Rules)).Msg("reloaded config")
+		})
+	}
 
 	if err := tc.Run(ctx); err != nil {
 		log.Fatal().Err(err).Msg("exit with error")
@@ -51,19 +114,58 @@ func main() {
 	log.Info().Msg("shutting down")
 }
 
-func loadConfig(configPath string) (telecmd.Config, error) {
-	if configPath == "" {
+// runOnce handles the message text, or the one read from stdin if it's empty, and writes the reply to stdout
+func runOnce(ctx context.Context, tc telecmd.Telecmd, text string, stdin io.Reader, stdout io.Writer) error {
+	if text == "" {
+		b, err := io.ReadAll(stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read message from stdin: %w", err)
+		}
+		text = strings.TrimRight(string(b), "\n")
+	}
+
+	return tc.RunOnce(ctx, text, stdout)
+}
+
+// printConfig writes the config with its defaults filled in and secrets masked as YAML.
+// The token from the flags isn't part of the config file, so it's noted in a comment.
+func printConfig(w io.Writer, config telecmd.Config) error {
+	config = config.Effective().Masked()
+	if config.BotToken != "" {
+		if _, err := fmt.Fprintf(w, "# token: %s\n", config.BotToken); err != nil {
+			return err
+		}
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(config); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func loadConfig(configPath string, configDir string) (telecmd.Config, error) {
+	if configPath == "" && configDir == "" {
 		return telecmd.Config{}, fmt.Errorf("config not specified")
 	}
 
 	var config telecmd.Config
-	b, err := os.ReadFile(configPath)
-	if err != nil {
-		return telecmd.Config{}, fmt.Errorf("failed to read config file: %w", err)
+	if configPath != "" {
+		if err := decodeConfigFile(configPath, &config); err != nil {
+			return telecmd.Config{}, err
+		}
 	}
-
-	if err := yaml.Unmarshal(b, &config); err != nil {
-		return telecmd.Config{}, fmt.Errorf("failed to parse config file: %w", err)
+	if configDir != "" {
+		paths, err := configDirFiles(configDir)
+		if err != nil {
+			return telecmd.Config{}, err
+		}
+		for _, path := range paths {
+			if err := decodeConfigFile(path, &config); err != nil {
+				return telecmd.Config{}, err
+			}
+		}
 	}
 
 	if err := config.Validate(); err != nil {
@@ -72,3 +174,20 @@ func loadConfig(configPath string) (telecmd.Config, error) {
 
 	return config, nil
 }
+
+// decodeConfigFile reads the file over config, settings in the file replace the existing ones and rules are appended
+func decodeConfigFile(path string, config *telecmd.Config) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	rules := config.Rules
+	config.Rules = nil
+	if err := yaml.Unmarshal(b, config); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	config.Rules = append(rules, config.Rules...)
+
+	return nil
+}
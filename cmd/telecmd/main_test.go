@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/abdusco/telecmd/internal/telecmd"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrintConfig(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.yaml": `
+adminToken: admin-secret-token
+messages:
+  busy: hold on
+rules:
+  - name: deploy
+    pattern: /deploy
+    command: [echo, deploy]
+    env: [API_TOKEN=deploy-secret-token]
+`,
+	})
+	config, err := loadConfig(filepath.Join(dir, "config.yaml"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.BotToken = "123456:bot-secret-token"
+
+	var out bytes.Buffer
+	if err := printConfig(&out, config); err != nil {
+		t.Fatal(err)
+	}
+	printed := out.String()
+
+	tests := []struct {
+		name    string
+		text    string
+		present bool
+	}{
+		{name: "masked token", text: "# token: 1234****\n", present: true},
+		{name: "masked admin token", text: "adminToken: admi****\n", present: true},
+		{name: "masked env value", text: "API_TOKEN=depl****", present: true},
+		{name: "default command timeout", text: "commandTimeout: 1m0s\n", present: true},
+		{name: "default poll timeout", text: "pollTimeout: 1m0s\n", present: true},
+		{name: "rule timeout", text: "    timeout: 1m0s\n", present: true},
+		{name: "default message", text: "nothingRunning: nothing is running\n", present: true},
+		{name: "overridden message", text: "busy: hold on\n", present: true},
+		{name: "no secrets", text: "secret"},
+		{name: "no raw token key", text: "bottoken"},
+		{name: "no empty fields", text: "eventSocket"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if strings.Contains(printed, tt.text) != tt.present {
+				t.Errorf("output contains %q = %v, want %v\n%s", tt.text, !tt.present, tt.present, printed)
+			}
+		})
+	}
+
+	// the printed config is loaded like the one it came from
+	path := filepath.Join(writeConfigFiles(t, map[string]string{"printed.yaml": printed}), "printed.yaml")
+	reloaded, err := loadConfig(path, "")
+	if err != nil {
+		t.Fatalf("cannot load printed config: %v", err)
+	}
+	if reloaded.CommandTimeout != "1m0s" || len(reloaded.Rules) != 1 || reloaded.Rules[0].Name != "deploy" {
+		t.Errorf("reloaded config = %+v", reloaded)
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+	tc := telecmd.New(telecmd.Config{Rules: []telecmd.Rule{
+		{Name: "echo", Pattern: "/echo.*", Command: []string{"echo"}, ArgSeparator: new(string)},
+		{Name: "json", Pattern: "/json", Script: `echo '[{"message": "a"}, {"message": "b"}]'`},
+	}})
+
+	tests := []struct {
+		name    string
+		text    string
+		stdin   string
+		want    string
+		wantErr bool
+	}{
+		{name: "message flag", text: "/echo hi", want: "/echo hi\n"},
+		{name: "stdin", stdin: "/echo piped\n", want: "/echo piped\n"},
+		{name: "flag over stdin", text: "/echo flag", stdin: "/echo piped\n", want: "/echo flag\n"},
+		{name: "json replies", text: "/json", want: "a\nb\n"},
+		{name: "no match", stdin: "hello\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			err := runOnce(context.Background(), tc, tt.text, strings.NewReader(tt.stdin), &stdout)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if stdout.String() != tt.want {
+				t.Errorf("stdout = %q, want %q", stdout.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"github.com/abdusco/telecmd/internal/telecmd"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// listRules writes a table of the rules in evaluation order with their effective pattern, command and options
+func listRules(w io.Writer, config telecmd.Config) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tNAME\tPATTERN\tCOMMAND\tTIMEOUT\tFLAGS")
+	for _, rule := range config.OrderedRules() {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n",
+			rule.Index(),
+			rule.Name,
+			config.RulePattern(rule),
+			ruleCommand(rule),
+			config.RuleTimeout(rule, false),
+			strings.Join(ruleFlags(rule), ","),
+		)
+	}
+	return tw.Flush()
+}
+
+func ruleCommand(rule telecmd.Rule) string {
+	switch {
+	case rule.Script != "":
+		return "script: " + rule.ScriptInterpreter()
+	case len(rule.Commands) > 0:
+		var commands []string
+		for _, command := range rule.Commands {
+			commands = append(commands, joinArgs(command))
+		}
+		return strings.Join(commands, " ; ")
+	}
+	return joinArgs(rule.Command)
+}
+
+// joinArgs joins args with spaces, quoting the ones with whitespace to keep the table on one line per rule
+func joinArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'") {
+			arg = strconv.Quote(arg)
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
+
+func ruleFlags(rule telecmd.Rule) []string {
+	options := []struct {
+		name string
+		set  bool
+	}{
+		{"useStdin", rule.UseStdin},
+		{"jsonOutput", rule.JSONOutput},
+		{"combineOutput", rule.CombineOutput},
+		{"downloadFile", rule.DownloadFile},
+		{"removeKeyboard", rule.RemoveKeyboard},
+		{"showCommand", rule.ShowCommand},
+		{"showDuration", rule.ShowDuration},
+		{"silent", rule.Silent},
+		{"isReplyToBot", rule.IsReplyToBot},
+		{"continueOnFailure", rule.ContinueOnFailure},
+		{"dedupeLines", rule.DedupeLines},
+		{"singleFlight", rule.SingleFlight},
+		{"guard", len(rule.Guard) > 0},
+		{"schedule=" + rule.Schedule, rule.Schedule != ""},
+		{"fallbackRule=" + rule.FallbackRule, rule.FallbackRule != ""},
+		{"runAs=" + rule.RunAs, rule.RunAs != ""},
+		{"replyOn=" + rule.ReplyOn, rule.ReplyOn != ""},
+		{"outputType=" + rule.OutputType, rule.OutputType != ""},
+		{"parseMode=" + rule.ParseMode, rule.ParseMode != ""},
+		{"passRawUpdate=" + rule.PassRawUpdate, rule.PassRawUpdate != ""},
+	}
+
+	var flags []string
+	for _, o := range options {
+		if o.set {
+			flags = append(flags, o.name)
+		}
+	}
+	return flags
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListRules(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.yaml": `
+commandTimeout: 30s
+rules:
+  - name: status
+    pattern: /status
+    command: [uptime]
+  - name: deploy
+    pattern: /deploy.*
+    command: [deploy.sh, --env, "prod eu"]
+    timeout: 5m
+    silent: true
+    replyOn: failure
+  - name: report
+    pattern: /report
+    priority: 10
+    script: echo report
+`,
+	})
+	config, err := loadConfig(filepath.Join(dir, "config.yaml"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := listRules(&out, config); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+
+	tests := []struct {
+		line int
+		want []string
+	}{
+		{line: 0, want: []string{"#", "NAME", "PATTERN", "COMMAND", "TIMEOUT", "FLAGS"}},
+		// by priority first
+		{line: 1, want: []string{"2", "report", "/report", "script: /bin/sh", "30s"}},
+		{line: 2, want: []string{"0", "status", "/status", "uptime", "30s"}},
+		{line: 3, want: []string{"1", "deploy", "/deploy.*", `deploy.sh --env "prod eu"`, "5m0s", "silent,replyOn=failure"}},
+	}
+	if len(lines) != len(tests) {
+		t.Fatalf("printed %d lines, want %d:\n%s", len(lines), len(tests), out.String())
+	}
+	for _, tt := range tests {
+		for _, want := range tt.want {
+			if !strings.Contains(lines[tt.line], want) {
+				t.Errorf("line %d = %q, want it to contain %q", tt.line, lines[tt.line], want)
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package telecmd
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type adminRule struct {
+	Index   int      `json:"index"`
+	Name    string   `json:"name"`
+	Pattern string   `json:"pattern"`
+	Tags    []string `json:"tags,omitempty"`
+}
+
+type adminStats struct {
+	Uptime      string `json:"uptime"`
+	Rules       int    `json:"rules"`
+	CommandsRun int64  `json:"commandsRun"`
+	InFlight    int64  `json:"inFlight"`
+	LastError   string `json:"lastError,omitempty"`
+	Paused      bool   `json:"paused"`
+	// CommandsByTag counts commands run by the tags of their rules
+	CommandsByTag map[string]int64 `json:"commandsByTag,omitempty"`
+}
+
+// WithLoader returns a copy of telecmd that can reload its config with load, e.g. from the admin API
+func (t Telecmd) WithLoader(load func() (Config, error)) Telecmd {
+	t.loader = load
+	return t
+}
+
+// serveAdmin serves the admin API on addr until ctx is cancelled.
+// Every request must carry the admin token as a bearer token.
+func (t Telecmd) serveAdmin(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rules", t.adminHandler(http.MethodGet, t.adminRules))
+	mux.HandleFunc("/stats", t.adminHandler(http.MethodGet, t.adminStats))
+	mux.HandleFunc("/reload", t.adminHandler(http.MethodPost, t.adminReload))
+	mux.HandleFunc("/pause", t.adminHandler(http.MethodPost, func() (any, error) {
+		t.paused.Store(true)
+		log.Info().Msg("paused handling updates")
+		return t.adminStats()
+	}))
+	mux.HandleFunc("/resume", t.adminHandler(http.MethodPost, func() (any, error) {
+		t.paused.Store(false)
+		log.Info().Msg("resumed handling updates")
+		return t.adminStats()
+	}))
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msg("admin api stopped")
+		}
+	}()
+
+	log.Info().Str("addr", listener.Addr().String()).Msg("serving admin api")
+	return nil
+}
+
+func (t Telecmd) adminHandler(method string, handle func() (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the raw token without the scheme isn't accepted
+		token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !bearer || t.config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(t.config.AdminToken)) != 1 {
+			writeAdminJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		if r.Method != method {
+			writeAdminJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		res, err := handle()
+		if err != nil {
+			writeAdminJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, res)
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("failed to write admin response")
+	}
+}
+
+func (t Telecmd) adminRules() (any, error) {
+	current := t.current()
+	rules := make([]adminRule, 0, len(current.config.Rules))
+	for _, rule := range current.config.Rules {
+		rules = append(rules, adminRule{Index: rule.index, Name: rule.Name, Pattern: current.config.RulePattern(rule), Tags: rule.Tags})
+	}
+	return rules, nil
+}
+
+func (t Telecmd) adminStats() (any, error) {
+	s := adminStats{
+		Uptime:      time.Since(t.stats.startedAt).Round(time.Second).String(),
+		Rules:       len(t.current().config.Rules),
+		CommandsRun: t.stats.commandsRun.Load(),
+		InFlight:    t.stats.inFlight.Load(),
+		Paused:      t.paused.Load(),
+		// tags of rules removed by a reload are kept
+		CommandsByTag: t.stats.tagCounts(),
+	}
+	t.stats.mu.Lock()
+	s.LastError = t.stats.lastError
+	t.stats.mu.Unlock()
+	return s, nil
+}
+
+func (t Telecmd) adminReload() (any, error) {
+	if t.loader == nil {
+		return nil, fmt.Errorf("reloading is not supported")
+	}
+
+	config, err := t.loader()
+	if err != nil {
+		return nil, err
+	}
+	t.Reload(config)
+	log.Info().Int("rules", len(config.Rules)).Msg("reloaded config")
+	return t.adminStats()
+}
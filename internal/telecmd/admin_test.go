@@ -0,0 +1,83 @@
+package telecmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAdminHandlerAuth(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		method        string
+		want          int
+	}{
+		{name: "bearer token", authorization: "Bearer s3cret-admin", method: http.MethodGet, want: http.StatusOK},
+		{name: "raw token", authorization: "s3cret-admin", method: http.MethodGet, want: http.StatusUnauthorized},
+		{name: "wrong token", authorization: "Bearer wrong", method: http.MethodGet, want: http.StatusUnauthorized},
+		{name: "other scheme", authorization: "Basic s3cret-admin", method: http.MethodGet, want: http.StatusUnauthorized},
+		{name: "empty bearer", authorization: "Bearer ", method: http.MethodGet, want: http.StatusUnauthorized},
+		{name: "missing", method: http.MethodGet, want: http.StatusUnauthorized},
+		{name: "wrong method", authorization: "Bearer s3cret-admin", method: http.MethodPost, want: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := New(Config{AdminToken: "s3cret-admin"})
+			handler := tc.adminHandler(http.MethodGet, func() (any, error) {
+				return map[string]string{"ok": "yes"}, nil
+			})
+
+			req := httptest.NewRequest(tt.method, "/stats", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminStatsCommandsByTag(t *testing.T) {
+	deploy := shellRule("deploy", "/deploy", "true")
+	deploy.Tags = []string{"deploy", "prod"}
+	rollback := shellRule("rollback", "/rollback", "exit 1")
+	rollback.Tags = []string{"deploy"}
+	tc := New(Config{Rules: []Rule{deploy, rollback, shellRule("status", "/status", "true")}})
+
+	tests := []struct {
+		text string
+		want map[string]int64
+	}{
+		{text: "/status", want: map[string]int64{}},
+		{text: "/deploy", want: map[string]int64{"deploy": 1, "prod": 1}},
+		// failed commands are counted too
+		{text: "/rollback", want: map[string]int64{"deploy": 2, "prod": 1}},
+	}
+
+	for _, tt := range tests {
+		if _, ok := handle(t, tc, tt.text); !ok {
+			t.Fatalf("%s didn't run", tt.text)
+		}
+		stats, err := tc.adminStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := stats.(adminStats).CommandsByTag; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("after %s commands by tag = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+
+	rules, err := tc.adminRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rules.([]adminRule)[0].Tags; !reflect.DeepEqual(got, deploy.Tags) {
+		t.Errorf("rule tags = %v, want %v", got, deploy.Tags)
+	}
+}
@@ -0,0 +1,64 @@
+package telecmd
+
+import "testing"
+
+func TestHandleSplitArgs(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: `/grep foo bar`, want: "/grep|foo|bar|"},
+		{text: `/grep "foo bar" 'baz qux'`, want: "/grep|foo bar|baz qux|"},
+		{text: `/grep foo\ bar "say \"hi\""`, want: `/grep|foo bar|say "hi"|`},
+		{text: `/grep 'it''s'`, want: "/grep|its|"},
+		{text: `/grep "foo`, want: "cannot split the message into arguments: unbalanced \" quote"},
+		{text: `/grep 'foo`, want: "cannot split the message into arguments: unbalanced ' quote"},
+		{text: `/grep foo\`, want: "cannot split the message into arguments: trailing backslash"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			rule := shellRule("grep", "/grep.*", `printf '%s|' "$@"`)
+			rule.SplitArgs = true
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, tt.text)
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleArgSeparator(t *testing.T) {
+	tests := []struct {
+		name      string
+		separator *string
+		useStdin  bool
+		want      string
+	}{
+		{name: "default", want: "--|/echo hi|"},
+		{name: "custom", separator: ptr("::"), want: "::|/echo hi|"},
+		{name: "none", separator: ptr(""), want: "/echo hi|"},
+		// printf prints the format once without arguments
+		{name: "not with stdin", separator: ptr("::"), useStdin: true, want: "|"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := Rule{Name: "echo", Pattern: "/echo.*", Command: []string{"printf", "%s|"}, ArgSeparator: tt.separator, UseStdin: tt.useStdin}
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, "/echo hi")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
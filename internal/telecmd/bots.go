@@ -0,0 +1,83 @@
+package telecmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/sourcegraph/conc/pool"
+	"golang.org/x/exp/slices"
+)
+
+// BotConfig is one of several bots driven by the same process
+type BotConfig struct {
+	Name       string   `yaml:"name,omitempty"`
+	Token      string   `yaml:"token,omitempty"`
+	Rules      []string `yaml:"rules,omitempty"`
+	OffsetFile string   `yaml:"offsetFile,omitempty"`
+}
+
+func (b BotConfig) Validate(rules []Rule) error {
+	if b.Name == "" {
+		return fmt.Errorf("name cannot be empty")
+	}
+	if b.Token == "" {
+		return fmt.Errorf("token cannot be empty")
+	}
+	for _, name := range b.Rules {
+		if !slices.ContainsFunc(rules, func(r Rule) bool { return r.Name == name }) {
+			return fmt.Errorf("unknown rule %q", name)
+		}
+	}
+	return nil
+}
+
+// forBot returns a copy of telecmd that uses the bot's token and only its rules.
+// Stats and events stay shared between bots.
+func (t Telecmd) forBot(bot BotConfig) Telecmd {
+	t.botName = bot.Name
+	t.config.BotToken = bot.Token
+	t.config.TokenFile = ""
+	t.config.OffsetFile = bot.OffsetFile
+	// heartbeat is posted by the first bot only
+	t.config.Heartbeat = nil
+
+	if len(bot.Rules) > 0 {
+		var rules []Rule
+		for _, rule := range t.config.Rules {
+			if slices.Contains(bot.Rules, rule.Name) {
+				rules = append(rules, rule)
+			}
+		}
+		t.config.Rules = rules
+	}
+	return t
+}
+
+// runBots polls updates for each configured bot and stops all of them when one fails
+func (t Telecmd) runBots(ctx context.Context) error {
+	p := pool.New().WithContext(ctx).WithCancelOnError()
+	scheduled := make(map[string]bool)
+	for i, bot := range t.config.Bots {
+		child := t.forBot(bot)
+		if i == 0 {
+			child.config.Heartbeat = t.config.Heartbeat
+		}
+		child.scheduledElsewhere = make(map[string]bool)
+		for _, rule := range child.config.Rules {
+			if rule.Schedule == "" {
+				continue
+			}
+			if scheduled[rule.Name] {
+				child.scheduledElsewhere[rule.Name] = true
+			}
+			scheduled[rule.Name] = true
+		}
+		name := bot.Name
+		p.Go(func(ctx context.Context) error {
+			if err := child.runBot(ctx); err != nil {
+				return fmt.Errorf("bot %s: %w", name, err)
+			}
+			return nil
+		})
+	}
+	return p.Wait()
+}
@@ -0,0 +1,118 @@
+package telecmd
+
+import (
+	"context"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"testing"
+	"time"
+)
+
+func TestRunBots(t *testing.T) {
+	f := newFakeTelegram(t)
+	tc := New(Config{
+		Rules: []Rule{
+			shellRule("alpha", "/alpha", "echo alpha"),
+			shellRule("beta", "/beta", "echo beta"),
+			shellRule("shared", "/shared", "echo shared"),
+		},
+		Bots: []BotConfig{
+			{Name: "first", Token: "first-token", Rules: []string{"alpha", "shared"}},
+			{Name: "second", Token: "second-token", Rules: []string{"beta", "shared"}},
+		},
+	})
+	tc.newClient = f.newClient
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- tc.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	// both bots see update 1, offsets are tracked per bot
+	for _, token := range []string{"first-token", "second-token"} {
+		for i, text := range []string{"/alpha", "/beta", "/shared"} {
+			f.push(token, tgbotapi.Update{UpdateID: i + 1, Message: testMessage(text)})
+		}
+	}
+
+	tests := []struct {
+		token string
+		want  []string
+	}{
+		{token: "first-token", want: []string{"alpha\n", "shared\n"}},
+		{token: "second-token", want: []string{"beta\n", "shared\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			waitFor(t, "replies", func() bool { return len(f.sent(tt.token, "sendMessage")) >= len(tt.want) })
+			// let any wrong reply arrive
+			time.Sleep(50 * time.Millisecond)
+
+			sent := f.sent(tt.token, "sendMessage")
+			got := map[string]bool{}
+			for _, r := range sent {
+				got[r.params.Get("text")] = true
+			}
+			if len(sent) != len(tt.want) {
+				t.Errorf("replies = %v, want %v", got, tt.want)
+			}
+			for _, text := range tt.want {
+				if !got[text] {
+					t.Errorf("missing reply %q in %v", text, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRunBotsSchedulesOnce(t *testing.T) {
+	tests := []struct {
+		name       string
+		firstRules []string
+		want       string
+	}{
+		{name: "shared rule runs on the first bot", want: "first-token"},
+		{name: "rule of the second bot only", firstRules: []string{"other"}, want: "second-token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			report := shellRule("report", "", "echo report")
+			report.Schedule = "50ms"
+			report.ScheduleChatID = 100
+			tc := New(Config{
+				Rules: []Rule{report, shellRule("other", "/other", "echo other")},
+				Bots: []BotConfig{
+					{Name: "first", Token: "first-token", Rules: tt.firstRules},
+					{Name: "second", Token: "second-token"},
+				},
+			})
+			tc.newClient = f.newClient
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- tc.Run(ctx)
+			}()
+			t.Cleanup(func() {
+				cancel()
+				<-done
+			})
+
+			waitFor(t, "scheduled runs", func() bool { return len(f.sent(tt.want, "sendMessage")) >= 3 })
+			for _, token := range []string{"first-token", "second-token"} {
+				if token == tt.want {
+					continue
+				}
+				if sent := f.sent(token, "sendMessage"); len(sent) > 0 {
+					t.Errorf("%s sent %d scheduled outputs, want none", token, len(sent))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package telecmd
+
+import (
+	"fmt"
+	"github.com/abdusco/telecmd/internal/version"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"strings"
+)
+
+// builtinReply answers built-in commands like /status, /version, /whoami and /cancel, which take precedence over rules when enabled
+func (t Telecmd) builtinReply(message *tgbotapi.Message) (string, bool) {
+	switch t.builtinCommand(message) {
+	case "status":
+		if !t.config.Builtins.Status {
+			return "", false
+		}
+		if !t.config.IsAdmin(message.From) {
+			log.Debug().Msg("ignoring builtin command from non-admin")
+			return "", false
+		}
+		return t.stats.render(len(t.config.Rules)), true
+	case "version":
+		if !t.config.Builtins.Version {
+			return "", false
+		}
+		if !t.config.IsAdmin(message.From) {
+			log.Debug().Msg("ignoring builtin command from non-admin")
+			return "", false
+		}
+		return version.GitVersion().String(), true
+	case "whoami":
+		// anyone can ask, it's how users find the ids to allow
+		if !t.config.Builtins.Whoami {
+			return "", false
+		}
+		return t.config.Message(messageWhoami, t.whoami(message)), true
+	case "cancel":
+		// users can cancel the commands of the rules they're allowed to run, admins all of them
+		if !t.config.Builtins.Cancel {
+			return "", false
+		}
+		cancelled, running := t.running.cancel(message.Chat.ID, func(rule Rule) bool {
+			return t.config.IsAdmin(message.From) || rule.AllowsUser(message.From)
+		})
+		switch {
+		case cancelled > 0:
+			return t.config.Message(messageCancelled, map[string]any{"Count": cancelled}), true
+		case running > 0:
+			return t.config.Message(messageNotAuthorized, nil), true
+		}
+		return t.config.Message(messageNothingRunning, nil), true
+	}
+
+	return "", false
+}
+
+// enabled reports whether the command is a built-in that is turned on
+func (b Builtins) enabled(command string) bool {
+	switch command {
+	case "status":
+		return b.Status
+	case "version":
+		return b.Version
+	case "run":
+		return b.Run
+	case "cancel":
+		return b.Cancel
+	case "whoami":
+		return b.Whoami
+	}
+	return false
+}
+
+// builtinCommand is the command of the message without the bot mention,
+// it's empty for commands addressed to other bots, like /status@otherbot in groups
+func (t Telecmd) builtinCommand(message *tgbotapi.Message) string {
+	command, mention, mentioned := strings.Cut(message.CommandWithAt(), "@")
+	if mentioned && t.client() != nil && !strings.EqualFold(mention, t.client().Self.UserName) {
+		return ""
+	}
+	return command
+}
+
+// whoami is what /whoami tells about the sender, the chat and the topic of the message, if it's in one
+func (t Telecmd) whoami(message *tgbotapi.Message) map[string]any {
+	data := map[string]any{"ChatID": message.Chat.ID, "ChatType": message.Chat.Type, "UserID": "", "Username": "", "ThreadID": ""}
+	if message.From != nil {
+		data["UserID"] = message.From.ID
+		data["Username"] = message.From.UserName
+	}
+	if threadID, ok := t.threads.get(message.Chat.ID, message.MessageID); ok {
+		data["ThreadID"] = threadID
+	}
+	return data
+}
+
+// ruleToRun handles /run <rule> <text>, which runs the named rule with the rest of the message as its text,
+// regardless of the rule's pattern. It returns false if the message isn't a /run command from an admin.
+func (t Telecmd) ruleToRun(message *tgbotapi.Message) (Rule, *tgbotapi.Message, bool, error) {
+	if !t.config.Builtins.Run || t.builtinCommand(message) != "run" {
+		return Rule{}, nil, false, nil
+	}
+	if !t.config.IsAdmin(message.From) {
+		log.Debug().Msg("ignoring builtin command from non-admin")
+		return Rule{}, nil, false, nil
+	}
+
+	name, text, _ := strings.Cut(strings.TrimSpace(message.CommandArguments()), " ")
+	if name == "" {
+		return Rule{}, nil, true, fmt.Errorf("usage: /run <rule> <text>")
+	}
+	for _, rule := range t.config.Rules {
+		if rule.Name == name {
+			runMessage := *message
+			runMessage.Text = strings.TrimSpace(text)
+			runMessage.Entities = nil
+			rule.argsOnly = true
+			return rule, &runMessage, true, nil
+		}
+	}
+	return Rule{}, nil, true, fmt.Errorf("no rule named %q", name)
+}
@@ -0,0 +1,43 @@
+package telecmd
+
+import (
+	"context"
+	"github.com/abdusco/telecmd/internal/version"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"testing"
+)
+
+func TestVersionCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		admins  []int64
+		want    string
+	}{
+		{name: "enabled", enabled: true, admins: []int64{42}, want: version.GitVersion().String()},
+		{name: "user rule isn't shadowed when disabled", admins: []int64{42}, want: "user rule\n"},
+		{name: "not an admin", enabled: true, admins: []int64{1}, want: "user rule\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			tc := f.connect(t, New(Config{
+				Rules:    []Rule{shellRule("version", "/version", "echo user rule")},
+				Builtins: Builtins{Version: tt.enabled},
+				Admins:   tt.admins,
+			}), "token")
+
+			message := commandMessage("/version")
+			tc.handleMessage(context.Background(), tgbotapi.Update{Message: message}, message)
+
+			sent := f.sent("token", "sendMessage")
+			if len(sent) != 1 {
+				t.Fatalf("sent %d replies, want 1", len(sent))
+			}
+			if got := sent[0].params.Get("text"); got != tt.want {
+				t.Errorf("reply = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
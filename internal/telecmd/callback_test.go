@@ -0,0 +1,62 @@
+package telecmd
+
+import (
+	"context"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"testing"
+)
+
+func TestHandleCallbackQuery(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		withMessage bool
+		wantReply   string
+	}{
+		{name: "button data runs the matching rule", data: "/echo hi", withMessage: true, wantReply: "got /echo hi\n"},
+		{name: "unmatched data only answers", data: "nothing", withMessage: true},
+		{name: "inline message only answers", data: "/echo hi"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			tc := New(Config{Rules: []Rule{shellRule("echo", "/echo.*", `echo "got $1"`)}})
+			tc = f.connect(t, tc, "token")
+
+			query := &tgbotapi.CallbackQuery{
+				ID:   "query-1",
+				From: &tgbotapi.User{ID: 42, FirstName: "tester"},
+				Data: tt.data,
+			}
+			if tt.withMessage {
+				// the message with the button was sent by the bot
+				query.Message = testMessage("pick one")
+				query.Message.From = &tgbotapi.User{ID: 1, IsBot: true}
+			}
+			tc.handleUpdate(context.Background(), tgbotapi.Update{UpdateID: 1, CallbackQuery: query})
+
+			answers := f.sent("token", "answerCallbackQuery")
+			if len(answers) != 1 || answers[0].params.Get("callback_query_id") != "query-1" {
+				t.Fatalf("answered %v, want a single answer to query-1", answers)
+			}
+
+			replies := f.sent("token", "sendMessage")
+			if tt.wantReply == "" {
+				if len(replies) != 0 {
+					t.Fatalf("sent %d replies, want none", len(replies))
+				}
+				return
+			}
+			if len(replies) != 1 {
+				t.Fatalf("sent %d replies, want 1", len(replies))
+			}
+			if got := replies[0].params.Get("text"); got != tt.wantReply {
+				t.Errorf("reply = %q, want %q", got, tt.wantReply)
+			}
+			if got := replies[0].params.Get("chat_id"); got != "100" {
+				t.Errorf("reply sent to chat %s, want the chat of the button", got)
+			}
+		})
+	}
+}
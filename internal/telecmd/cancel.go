@@ -0,0 +1,67 @@
+package telecmd
+
+import (
+	"context"
+	"sync"
+)
+
+// runningCommands keeps the cancel funcs of commands in flight by chat, so /cancel can stop them
+type runningCommands struct {
+	mu     sync.Mutex
+	nextID uint64
+	byChat map[int64]map[uint64]runningCommand
+}
+
+type runningCommand struct {
+	rule   Rule
+	cancel context.CancelFunc
+}
+
+func newRunningCommands() *runningCommands {
+	return &runningCommands{byChat: make(map[int64]map[uint64]runningCommand)}
+}
+
+// add tracks a command of the rule running for the chat until the returned func is called
+func (r *runningCommands) add(chatID int64, rule Rule, cancel context.CancelFunc) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	id := r.nextID
+	if r.byChat[chatID] == nil {
+		r.byChat[chatID] = make(map[uint64]runningCommand)
+	}
+	r.byChat[chatID][id] = runningCommand{rule: rule, cancel: cancel}
+
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.byChat[chatID], id)
+		if len(r.byChat[chatID]) == 0 {
+			delete(r.byChat, chatID)
+		}
+	}
+}
+
+// cancel stops the commands running for the chat whose rules are allowed,
+// it returns how many were stopped and how many are running in total
+func (r *runningCommands) cancel(chatID int64, allowed func(Rule) bool) (int, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	running := r.byChat[chatID]
+	cancelled := 0
+	for id, command := range running {
+		if !allowed(command.rule) {
+			continue
+		}
+		command.cancel()
+		delete(running, id)
+		cancelled++
+	}
+	total := cancelled + len(running)
+	if len(running) == 0 {
+		delete(r.byChat, chatID)
+	}
+	return cancelled, total
+}
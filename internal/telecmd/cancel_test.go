@@ -0,0 +1,119 @@
+package telecmd
+
+import (
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"testing"
+	"time"
+)
+
+func TestCancelCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		// user sends /cancel
+		user       int64
+		admin      bool
+		wantReply  string
+		wantCancel bool
+	}{
+		{name: "allowed user", user: 42, wantReply: "cancelled 1 running command(s)", wantCancel: true},
+		{name: "admin", user: 7, admin: true, wantReply: "cancelled 1 running command(s)", wantCancel: true},
+		{name: "user not allowed to run the rule", user: 7, wantReply: "you're not allowed to run this"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the shell waits for sleep, which keeps the output open until the whole group is killed
+			rule := shellRule("slow", "/slow", "sleep 5; echo done")
+			rule.Users = []int64{42}
+			config := Config{Rules: []Rule{rule}, Builtins: Builtins{Cancel: true}}
+			if tt.admin {
+				config.Admins = []int64{tt.user}
+			}
+			tc := New(config)
+
+			type result struct {
+				output string
+				took   time.Duration
+			}
+			done := make(chan result, 1)
+			go func() {
+				start := time.Now()
+				output, _ := handle(t, tc, "/slow")
+				done <- result{output: output, took: time.Since(start)}
+			}()
+			waitFor(t, "command to start", func() bool {
+				tc.running.mu.Lock()
+				defer tc.running.mu.Unlock()
+				return len(tc.running.byChat[100]) > 0
+			})
+
+			message := commandMessage("/cancel")
+			message.From = &tgbotapi.User{ID: tt.user}
+			reply, ok := tc.builtinReply(message)
+			if !ok || reply != tt.wantReply {
+				t.Errorf("reply = %q, %v, want %q", reply, ok, tt.wantReply)
+			}
+
+			if !tt.wantCancel {
+				select {
+				case r := <-done:
+					t.Fatalf("command stopped with %q, want it to keep running", r.output)
+				case <-time.After(200 * time.Millisecond):
+				}
+				// stop it for the next test
+				tc.running.cancel(100, func(Rule) bool { return true })
+			}
+			r := <-done
+			if tt.wantCancel && r.output != "command was cancelled" {
+				t.Errorf("output = %q, want the command cancelled", r.output)
+			}
+			if r.took > 3*time.Second {
+				t.Errorf("cancelled command took %s to return", r.took)
+			}
+		})
+	}
+}
+
+func TestCancelNothingRunning(t *testing.T) {
+	tc := New(Config{Rules: []Rule{shellRule("echo", "/echo", "echo")}, Builtins: Builtins{Cancel: true}})
+	if reply, _ := tc.builtinReply(commandMessage("/cancel")); reply != "nothing is running" {
+		t.Errorf("reply = %q", reply)
+	}
+}
+
+func TestBuiltinCommandMention(t *testing.T) {
+	tests := []struct {
+		text   string
+		wantOK bool
+	}{
+		{text: "/whoami", wantOK: true},
+		{text: "/whoami@bot_token", wantOK: true},
+		{text: "/whoami@BOT_TOKEN", wantOK: true},
+		{text: "/whoami@otherbot"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			tc := f.connect(t, New(Config{Rules: []Rule{shellRule("echo", "/echo", "echo")}, Builtins: Builtins{Whoami: true}}), "token")
+
+			if _, ok := tc.builtinReply(commandMessage(tt.text)); ok != tt.wantOK {
+				t.Errorf("answered = %v, want %v", ok, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRunIgnoresOtherBots(t *testing.T) {
+	f := newFakeTelegram(t)
+	tc := f.connect(t, New(Config{Rules: []Rule{shellRule("echo", "^$", "echo ran")}, Builtins: Builtins{Run: true}, Admins: []int64{42}}), "token")
+
+	message := commandMessage("/run@otherbot echo")
+	if _, _, isRun, _ := tc.ruleToRun(message); isRun {
+		t.Error("ran a /run addressed to another bot")
+	}
+	message = commandMessage("/run@bot_token echo")
+	if _, _, isRun, _ := tc.ruleToRun(message); !isRun {
+		t.Error("didn't run a /run addressed to this bot")
+	}
+}
@@ -0,0 +1,95 @@
+package telecmd
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf16"
+)
+
+// maxMessageLength is the longest text Telegram accepts in a message, in UTF-16 code units
+const maxMessageLength = 4096
+
+// splitMessage splits text into chunks of at most limit UTF-16 code units.
+// Chunks end at a line break if there's one in the second half of the chunk,
+// and never inside a multi-byte character or a sequence of combining characters, like emoji with modifiers.
+func splitMessage(text string, limit int) []string {
+	var chunks []string
+	runes := []rune(text)
+	for len(runes) > 0 {
+		end, size := 0, 0
+		for end < len(runes) {
+			n := utf16.RuneLen(runes[end])
+			if n < 0 {
+				n = 1
+			}
+			if size+n > limit {
+				break
+			}
+			size += n
+			end++
+		}
+		if end == len(runes) {
+			chunks = append(chunks, string(runes))
+			break
+		}
+
+		cut := end
+		for cut > 0 && !canSplitBefore(runes, cut) {
+			cut--
+		}
+		if cut == 0 {
+			// a single unbreakable sequence longer than the limit
+			cut = end
+		}
+		if newline := lastIndexRune(runes[:cut], '\n'); newline >= cut/2 {
+			cut = newline + 1
+		}
+
+		if chunk := strings.TrimRight(string(runes[:cut]), "\n"); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		runes = runes[cut:]
+	}
+	return chunks
+}
+
+// canSplitBefore reports whether runes can be split at i without breaking apart a character sequence
+func canSplitBefore(runes []rune, i int) bool {
+	const zeroWidthJoiner = '\u200d'
+	if i == 0 || i >= len(runes) {
+		return true
+	}
+	r, prev := runes[i], runes[i-1]
+	switch {
+	case prev == zeroWidthJoiner || r == zeroWidthJoiner:
+		return false
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Variation_Selector):
+		return false
+	case r >= 0x1f3fb && r <= 0x1f3ff:
+		// emoji skin tone modifiers
+		return false
+	case unicode.Is(unicode.Regional_Indicator, r) && unicode.Is(unicode.Regional_Indicator, prev):
+		// keep flags together, which are pairs of regional indicators
+		return !regionalIndicatorPairEnds(runes, i)
+	}
+	return true
+}
+
+// regionalIndicatorPairEnds reports whether an odd number of regional indicators come right before i,
+// meaning the rune at i completes a flag
+func regionalIndicatorPairEnds(runes []rune, i int) bool {
+	count := 0
+	for j := i - 1; j >= 0 && unicode.Is(unicode.Regional_Indicator, runes[j]); j-- {
+		count++
+	}
+	return count%2 == 1
+}
+
+func lastIndexRune(runes []rune, r rune) int {
+	for i := len(runes) - 1; i >= 0; i-- {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
+}
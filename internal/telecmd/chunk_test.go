@@ -0,0 +1,69 @@
+package telecmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		want  []string
+	}{
+		{name: "short", text: "hello", limit: 10, want: []string{"hello"}},
+		{name: "ascii", text: "abcdefgh", limit: 3, want: []string{"abc", "def", "gh"}},
+		{name: "cjk", text: "你好世界和平", limit: 4, want: []string{"你好世界", "和平"}},
+		// emoji outside the BMP are two UTF-16 code units
+		{name: "emoji at the boundary", text: "ab😀cd", limit: 3, want: []string{"ab", "😀c", "d"}},
+		{name: "skin tone modifier", text: "ab👍🏽", limit: 4, want: []string{"ab", "👍🏽"}},
+		{name: "combining accent", text: "cafés", limit: 4, want: []string{"caf", "és"}},
+		{name: "flags", text: "a🇹🇷🇩🇪", limit: 4, want: []string{"a", "🇹🇷", "🇩🇪"}},
+		{name: "zero width joiner", text: "ab👩‍💻", limit: 5, want: []string{"ab", "👩‍💻"}},
+		{name: "line break", text: "line one\nline two", limit: 12, want: []string{"line one", "line two"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitMessage(tt.text, tt.limit)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitMessage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitMessageTelegramLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{name: "emoji", text: strings.Repeat("😀", 3000)},
+		{name: "cjk", text: strings.Repeat("漢字", 3000)},
+		{name: "mixed", text: strings.Repeat("a😀漢👍🏽\n", 1000)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := splitMessage(tt.text, maxMessageLength)
+			if len(chunks) < 2 {
+				t.Fatalf("got %d chunks, want the text split", len(chunks))
+			}
+			for i, chunk := range chunks {
+				if !utf8.ValidString(chunk) {
+					t.Errorf("chunk %d isn't valid UTF-8", i)
+				}
+				if n := len(utf16.Encode([]rune(chunk))); n > maxMessageLength {
+					t.Errorf("chunk %d is %d UTF-16 code units", i, n)
+				}
+			}
+			if joined := strings.Join(chunks, ""); strings.ReplaceAll(joined, "\n", "") != strings.ReplaceAll(tt.text, "\n", "") {
+				t.Error("chunks don't add up to the text")
+			}
+		})
+	}
+}
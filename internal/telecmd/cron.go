@@ -0,0 +1,134 @@
+package telecmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec is a parsed 5-field cron expression: minute, hour, day of month, month and day of week
+type cronSpec struct {
+	minute, hour, dom, month, dow []bool
+	// restricted day fields match either, like in crontab, when both aren't *
+	domAny, dowAny bool
+}
+
+func parseCron(expr string) (cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSpec{}, fmt.Errorf("invalid cron expression %q, must have 5 fields", expr)
+	}
+
+	var spec cronSpec
+	var err error
+	if spec.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return cronSpec{}, fmt.Errorf("invalid minute: %w", err)
+	}
+	if spec.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return cronSpec{}, fmt.Errorf("invalid hour: %w", err)
+	}
+	if spec.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return cronSpec{}, fmt.Errorf("invalid day of month: %w", err)
+	}
+	if spec.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return cronSpec{}, fmt.Errorf("invalid month: %w", err)
+	}
+	// 7 is sunday too
+	if spec.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return cronSpec{}, fmt.Errorf("invalid day of week: %w", err)
+	}
+	spec.dow[0] = spec.dow[0] || spec.dow[7]
+	spec.domAny = strings.HasPrefix(fields[2], "*")
+	spec.dowAny = strings.HasPrefix(fields[4], "*")
+	return spec, nil
+}
+
+// parseCronField parses a comma separated list of *, values and ranges, each with an optional /step
+func parseCronField(field string, min, max int) ([]bool, error) {
+	allowed := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step %q", stepText)
+			}
+		}
+
+		from, to := min, max
+		if rng != "*" {
+			fromText, toText, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = strconv.Atoi(fromText); err != nil {
+				return nil, fmt.Errorf("invalid value %q", fromText)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(toText); err != nil {
+					return nil, fmt.Errorf("invalid value %q", toText)
+				}
+			} else if hasStep {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("%q is out of range %d-%d", rng, min, max)
+		}
+
+		for v := from; v <= to; v += step {
+			allowed[v] = true
+		}
+	}
+	return allowed, nil
+}
+
+// prev is the last time at or before t the expression fires, in the location of t.
+// It returns false if the expression didn't fire after the given time.
+// Days and hours that don't match are skipped as a whole, so long spans are cheap.
+func (s cronSpec) prev(t time.Time, after time.Time) (time.Time, bool) {
+	loc := t.Location()
+	for day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc); day.AddDate(0, 0, 1).After(after); day = day.AddDate(0, 0, -1) {
+		if !s.matchesDay(day) {
+			continue
+		}
+		for hour := 23; hour >= 0; hour-- {
+			if !s.hour[hour] {
+				continue
+			}
+			for minute := 59; minute >= 0; minute-- {
+				if !s.minute[minute] {
+					continue
+				}
+				at := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, loc)
+				if at.After(t) {
+					continue
+				}
+				if !at.After(after) {
+					return time.Time{}, false
+				}
+				return at, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// matchesDay reports whether the expression fires on the day of t
+func (s cronSpec) matchesDay(t time.Time) bool {
+	if !s.month[int(t.Month())] {
+		return false
+	}
+
+	dom, dow := s.dom[t.Day()], s.dow[int(t.Weekday())]
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	}
+	return dom || dow
+}
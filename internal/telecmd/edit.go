@@ -0,0 +1,72 @@
+package telecmd
+
+import (
+	"context"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"sync"
+)
+
+type replyKey struct {
+	chatID int64
+	rule   int
+}
+
+// lastReplies remembers the last reply of each rule in each chat, to edit it for rules with editInPlace
+type lastReplies struct {
+	mu  sync.Mutex
+	ids map[replyKey]int
+}
+
+func newLastReplies() *lastReplies {
+	return &lastReplies{ids: make(map[replyKey]int)}
+}
+
+func (l *lastReplies) get(key replyKey) (int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	id, ok := l.ids[key]
+	return id, ok
+}
+
+func (l *lastReplies) set(key replyKey, messageID int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ids[key] = messageID
+}
+
+// editOrSend edits the previous reply of the rule in the chat, or sends a new reply if there's none or it can't be edited,
+// e.g. because it was deleted
+func (t Telecmd) editOrSend(ctx context.Context, rule Rule, message *tgbotapi.Message, c tgbotapi.Chattable) error {
+	m, ok := c.(tgbotapi.MessageConfig)
+	if !ok {
+		_, err := t.sendNew(ctx, rule, message, c)
+		return err
+	}
+
+	key := replyKey{chatID: m.ChatID, rule: rule.index}
+	if messageID, ok := t.replies.get(key); ok {
+		edit := tgbotapi.NewEditMessageText(m.ChatID, messageID, m.Text)
+		edit.ParseMode = m.ParseMode
+		edit.Entities = m.Entities
+		edit.DisableWebPagePreview = m.DisableWebPagePreview
+		if markup, ok := m.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup); ok {
+			edit.ReplyMarkup = &markup
+		}
+
+		_, err := t.send(ctx, edit)
+		if err == nil || strings.Contains(err.Error(), "message is not modified") {
+			return nil
+		}
+		log.Debug().Err(err).Msg("cannot edit previous reply, sending a new one")
+	}
+
+	// edits keep the message in the topic it was sent to
+	sent, err := t.sendNew(ctx, rule, message, m)
+	if err != nil {
+		return err
+	}
+	t.replies.set(key, sent.MessageID)
+	return nil
+}
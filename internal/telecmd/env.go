@@ -0,0 +1,122 @@
+package telecmd
+
+import (
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const truncatedMarker = "…[truncated]"
+
+var (
+	envRefPattern  = regexp.MustCompile(`^\$(?:(\w+)|\{(\w+)\})$`)
+	envNamePattern = regexp.MustCompile(`^\w+$`)
+)
+
+// envRef returns the name of the variable the value refers to if it's only $NAME or ${NAME}
+func envRef(value string) (string, bool) {
+	groups := envRefPattern.FindStringSubmatch(value)
+	if groups == nil {
+		return "", false
+	}
+	return groups[1] + groups[2], true
+}
+
+// resolveEnvRef replaces a value of a KEY=VALUE pair that refers to a variable with its value in telecmd's environment.
+// Values with anything else around the reference are passed as is.
+func resolveEnvRef(kv string) string {
+	key, value, _ := strings.Cut(kv, "=")
+	name, ok := envRef(value)
+	if !ok {
+		return kv
+	}
+	resolved, ok := os.LookupEnv(name)
+	if !ok {
+		log.Warn().Str("key", key).Str("ref", name).Msg("referenced environment variable is not set")
+	}
+	return key + "=" + resolved
+}
+
+// envFromRefs copies variables from telecmd's environment, each entry is NAME or NAME=SOURCE to rename it.
+// Unlike references in env, the variables must be set.
+func envFromRefs(refs []string) ([]string, error) {
+	env := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		name, source, renamed := strings.Cut(ref, "=")
+		if !renamed {
+			source = name
+		}
+		value, ok := os.LookupEnv(source)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", source)
+		}
+		env = append(env, name+"="+value)
+	}
+	return env, nil
+}
+
+// expandArgs replaces $NAME and ${NAME} in args with their values in env, later entries winning like they do for the command.
+// Unset variables expand to nothing and $$ is a literal $.
+func expandArgs(args []string, env []string) []string {
+	values := make(map[string]string, len(env))
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		values[key] = value
+	}
+
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		expanded[i] = os.Expand(arg, func(name string) string {
+			if name == "$" {
+				return "$"
+			}
+			return values[name]
+		})
+	}
+	return expanded
+}
+
+// sanitizeEnv removes NUL bytes from the value of a KEY=VALUE pair, which can't be passed to a command.
+// With strict, other control characters are removed too and line breaks become spaces.
+func sanitizeEnv(kv string, strict bool) string {
+	key, value, _ := strings.Cut(kv, "=")
+	value = strings.Map(func(r rune) rune {
+		switch {
+		case r == 0:
+			return -1
+		case !strict || r == '\t':
+			return r
+		case r == '\n' || r == '\r':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, value)
+	return key + "=" + value
+}
+
+// truncateEnv shortens the value of a KEY=VALUE pair to maxLength bytes including a marker,
+// so long messages don't make the environment too large to start the command.
+// Limits too small for the marker cut the value without it.
+func truncateEnv(kv string, maxLength int) string {
+	key, value, _ := strings.Cut(kv, "=")
+	if maxLength < 0 || len(value) <= maxLength {
+		return kv
+	}
+
+	marker := truncatedMarker
+	if maxLength < len(marker) {
+		marker = ""
+	}
+	end := maxLength - len(marker)
+	// don't cut a multibyte character in half
+	for end > 0 && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return key + "=" + value[:end] + marker
+}
@@ -0,0 +1,342 @@
+package telecmd
+
+import (
+	"context"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"strings"
+	"testing"
+)
+
+func TestHandleExpandArgs(t *testing.T) {
+	tests := []struct {
+		name       string
+		expandArgs bool
+		want       string
+	}{
+		{name: "configured args are expanded", expandArgs: true, want: "chat=100|/where $HOME|"},
+		{name: "nothing is expanded by default", want: "chat=${TELEGRAM_CHAT_ID}|/where $HOME|"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := Rule{
+				Name:         "where",
+				Pattern:      "/where.*",
+				Command:      []string{"printf", "%s|", "chat=${TELEGRAM_CHAT_ID}"},
+				ArgSeparator: new(string),
+				ExpandArgs:   tt.expandArgs,
+			}
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, "/where $HOME")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleValidateExpandArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Rule
+		wantErr bool
+	}{
+		{name: "with command", rule: Rule{Pattern: "/x", Command: []string{"echo", "$HOME"}, ExpandArgs: true}},
+		{name: "with script", rule: Rule{Pattern: "/x", Script: "echo $HOME", ExpandArgs: true}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTruncateEnv(t *testing.T) {
+	tests := []struct {
+		name      string
+		kv        string
+		maxLength int
+		want      string
+	}{
+		{name: "short value", kv: "K=hello", maxLength: 5, want: "K=hello"},
+		{name: "no limit", kv: "K=hello", maxLength: -1, want: "K=hello"},
+		{name: "with marker", kv: "K=" + strings.Repeat("a", 30), maxLength: 20, want: "K=" + strings.Repeat("a", 20-len(truncatedMarker)) + truncatedMarker},
+		{name: "limit smaller than the marker", kv: "K=hello world", maxLength: 3, want: "K=hel"},
+		{name: "zero limit", kv: "K=hello", maxLength: 0, want: "K="},
+		{name: "multibyte character isn't cut", kv: "K=héllo", maxLength: 2, want: "K=h"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateEnv(tt.kv, tt.maxLength)
+			if got != tt.want {
+				t.Errorf("truncateEnv() = %q, want %q", got, tt.want)
+			}
+			if _, value, _ := strings.Cut(got, "="); tt.maxLength >= 0 && len(value) > tt.maxLength {
+				t.Errorf("value is %d bytes, longer than %d", len(value), tt.maxLength)
+			}
+		})
+	}
+}
+
+func TestEnvsFromUpdateMentions(t *testing.T) {
+	alice := &tgbotapi.User{ID: 7, FirstName: "Alice", UserName: "alice"}
+	bob := &tgbotapi.User{ID: 8, FirstName: "Bob"}
+
+	tests := []struct {
+		name          string
+		text          string
+		entities      []tgbotapi.MessageEntity
+		wantIDs       string
+		wantUsernames string
+	}{
+		{name: "no mentions", text: "/ban"},
+		{
+			name:          "mention",
+			text:          "/ban @carol",
+			entities:      []tgbotapi.MessageEntity{{Type: "mention", Offset: 5, Length: 6}},
+			wantUsernames: "carol",
+		},
+		{
+			name:          "text mention",
+			text:          "/ban Alice",
+			entities:      []tgbotapi.MessageEntity{{Type: "text_mention", Offset: 5, Length: 5, User: alice}},
+			wantIDs:       "7",
+			wantUsernames: "alice",
+		},
+		{
+			name: "both kinds",
+			text: "/ban @carol Bob Alice",
+			entities: []tgbotapi.MessageEntity{
+				{Type: "mention", Offset: 5, Length: 6},
+				{Type: "text_mention", Offset: 12, Length: 3, User: bob},
+				{Type: "text_mention", Offset: 16, Length: 5, User: alice},
+			},
+			wantIDs:       "8\n7",
+			wantUsernames: "carol\nalice",
+		},
+		{
+			// offsets count UTF-16 code units, the emoji takes two
+			name:          "after an emoji",
+			text:          "🔨 @carol",
+			entities:      []tgbotapi.MessageEntity{{Type: "mention", Offset: 3, Length: 6}},
+			wantUsernames: "carol",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := testMessage(tt.text)
+			message.Entities = tt.entities
+
+			envs := map[string]string{}
+			for _, kv := range envsFromUpdate(message, false, -1) {
+				key, value, _ := strings.Cut(kv, "=")
+				envs[key] = value
+			}
+			if got := envs["TELEGRAM_MENTIONED_USER_ID"]; got != tt.wantIDs {
+				t.Errorf("TELEGRAM_MENTIONED_USER_ID = %q, want %q", got, tt.wantIDs)
+			}
+			if got := envs["TELEGRAM_MENTIONED_USERNAME"]; got != tt.wantUsernames {
+				t.Errorf("TELEGRAM_MENTIONED_USERNAME = %q, want %q", got, tt.wantUsernames)
+			}
+		})
+	}
+}
+
+func TestHandleRuleEnv(t *testing.T) {
+	const script = `printf '%s|%s|%s' "$TELEGRAM_RULE_NAME" "$TELEGRAM_RULE_INDEX" "$TELEGRAM_RULE_PATTERN"`
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: "/status", want: "status|0|/status"},
+		{text: "/deploy prod", want: "deploy|1|/deploy.*"},
+		{text: "/ship prod", want: "deploy|1|/ship.*"},
+		// the index is the position in the config, not in the priority order
+		{text: "/urgent", want: "urgent|2|/urgent"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			deploy := shellRule("deploy", "", script)
+			deploy.Patterns = []string{"/deploy.*", "/ship.*"}
+			urgent := shellRule("urgent", "/urgent", script)
+			urgent.Priority = 10
+			tc := New(Config{Rules: []Rule{shellRule("status", "/status", script), deploy, urgent}})
+
+			output, ok := handle(t, tc, tt.text)
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleForwardedMessages(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		forward   func(message *tgbotapi.Message)
+		wantReply string
+	}{
+		{name: "not forwarded", mode: "skip", wantReply: "from=\n"},
+		{name: "handled by default", forward: func(m *tgbotapi.Message) { m.ForwardFrom = &tgbotapi.User{ID: 7} }, wantReply: "from=7\n"},
+		{name: "from a channel", mode: "handle", forward: func(m *tgbotapi.Message) { m.ForwardFromChat = &tgbotapi.Chat{ID: -1001} }, wantReply: "from=-1001\n"},
+		{name: "from a hidden account", forward: func(m *tgbotapi.Message) { m.ForwardSenderName = "Anonymous" }, wantReply: "from=Anonymous\n"},
+		{name: "skipped", mode: "skip", forward: func(m *tgbotapi.Message) { m.ForwardFrom = &tgbotapi.User{ID: 7} }},
+		{name: "skipped by date only", mode: "skip", forward: func(m *tgbotapi.Message) { m.ForwardDate = 1700000000 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			rule := shellRule("from", "/from", `echo "from=$TELEGRAM_FORWARDED_FROM"`)
+			tc := f.connect(t, New(Config{Rules: []Rule{rule}, ForwardedMessages: tt.mode}), "token")
+
+			message := testMessage("/from")
+			if tt.forward != nil {
+				tt.forward(message)
+			}
+			tc.handleMessage(context.Background(), tgbotapi.Update{Message: message}, message)
+
+			var replies []string
+			for _, r := range f.sent("token", "sendMessage") {
+				replies = append(replies, r.params.Get("text"))
+			}
+			if tt.wantReply == "" && len(replies) > 0 {
+				t.Errorf("replied %q to a skipped message", replies)
+			}
+			if tt.wantReply != "" && (len(replies) != 1 || replies[0] != tt.wantReply) {
+				t.Errorf("replied %q, want %q", replies, tt.wantReply)
+			}
+		})
+	}
+}
+
+func TestHandleSanitizeEnv(t *testing.T) {
+	const replyText = "line one\nline two\x00\x07\tend\r"
+
+	tests := []struct {
+		name     string
+		sanitize bool
+		want     string
+	}{
+		{name: "NUL bytes are always removed", want: "line one\nline two\x07\tend\r"},
+		{name: "sanitized", sanitize: true, want: "line one line two\tend "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := shellRule("reply", "/reply", `printf %s "$TELEGRAM_REPLY_TO_MESSAGE_TEXT"`)
+			tc := New(Config{Rules: []Rule{rule}, SanitizeEnv: tt.sanitize})
+
+			message := testMessage("/reply")
+			message.ReplyToMessage = &tgbotapi.Message{MessageID: 9, Text: replyText}
+			_, output, ok := tc.Handle(context.Background(), tgbotapi.Update{Message: message}, message)
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleBotEnv(t *testing.T) {
+	tests := []struct {
+		name      string
+		connected bool
+		want      string
+	}{
+		{name: "connected", connected: true, want: "1|bot_token"},
+		// like --once, without getMe
+		{name: "not connected", want: "|"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := New(Config{Rules: []Rule{shellRule("me", "/me", `printf '%s|%s' "$TELEGRAM_BOT_ID" "$TELEGRAM_BOT_USERNAME"`)}})
+			if tt.connected {
+				// the fake answers getMe with id 1 and bot_<token>
+				tc = newFakeTelegram(t).connect(t, tc, "token")
+			}
+
+			output, ok := handle(t, tc, "/me")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleEnvRefs(t *testing.T) {
+	const script = `printf '%s|%s|%s|%s' "$API_KEY" "$TOKEN" "$GREETING" "$MISSING"`
+
+	tests := []struct {
+		name    string
+		env     []string
+		fromEnv []string
+		secret  string
+		want    string
+		wantRan bool
+	}{
+		{name: "reference", env: []string{"API_KEY=$TELECMD_TEST_SECRET"}, secret: "s1", want: "s1|||", wantRan: true},
+		{name: "braced reference", env: []string{"API_KEY=${TELECMD_TEST_SECRET}"}, secret: "s1", want: "s1|||", wantRan: true},
+		{name: "not only a reference", env: []string{"GREETING=hi $TELECMD_TEST_SECRET"}, secret: "s1", want: "||hi $TELECMD_TEST_SECRET|", wantRan: true},
+		{name: "unset reference", env: []string{"MISSING=$TELECMD_TEST_UNSET"}, want: "|||", wantRan: true},
+		{name: "fromEnv", fromEnv: []string{"TELECMD_TEST_SECRET", "TOKEN=TELECMD_TEST_SECRET"}, secret: "s1", want: "|s1||", wantRan: true},
+		{name: "env overrides fromEnv", env: []string{"TOKEN=inline"}, fromEnv: []string{"TOKEN=TELECMD_TEST_SECRET"}, secret: "s1", want: "|inline||", wantRan: true},
+		{name: "fromEnv must be set", fromEnv: []string{"TOKEN=TELECMD_TEST_UNSET"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TELECMD_TEST_SECRET", tt.secret)
+			rule := shellRule("env", "/env", script)
+			rule.Environment = tt.env
+			rule.FromEnv = tt.fromEnv
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, "/env")
+			if ok != tt.wantRan {
+				t.Fatalf("ran = %v, want %v", ok, tt.wantRan)
+			}
+			if ok && output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleEnvRefsResolvedOnEveryRun(t *testing.T) {
+	rule := shellRule("env", "/env", `printf %s "$API_KEY"`)
+	rule.Environment = []string{"API_KEY=$TELECMD_TEST_SECRET"}
+	tc := New(Config{Rules: []Rule{rule}})
+
+	for _, secret := range []string{"old", "rotated"} {
+		t.Setenv("TELECMD_TEST_SECRET", secret)
+		output, ok := handle(t, tc, "/env")
+		if !ok {
+			t.Fatal("rule didn't run")
+		}
+		if output != secret {
+			t.Errorf("output = %q, want %q", output, secret)
+		}
+	}
+}
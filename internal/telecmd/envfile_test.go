@@ -0,0 +1,76 @@
+package telecmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadEnvFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "sample",
+			content: `# database
+DB_HOST=localhost
+DB_PORT = 5432
+
+export API_KEY=abc123 # rotated monthly
+GREETING="hello \"world\"\n"
+RAW='no $expansion # here'
+EMPTY=
+`,
+			want: []string{
+				"DB_HOST=localhost",
+				"DB_PORT=5432",
+				"API_KEY=abc123",
+				"GREETING=hello \"world\"\n",
+				"RAW=no $expansion # here",
+				"EMPTY=",
+			},
+		},
+		{name: "hash in unquoted value", content: "URL=http://example.com/#anchor", want: []string{"URL=http://example.com/#anchor"}},
+		{name: "missing equals", content: "JUST_A_KEY", wantErr: true},
+		{name: "missing key", content: "=value", wantErr: true},
+		{name: "unterminated double quote", content: `KEY="value`, wantErr: true},
+		{name: "unterminated single quote", content: `KEY='value`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ".env")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readEnvFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readEnvFile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleEnvFileReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	rule := shellRule("env", "/env", `printf %s "$TOKEN"`)
+	rule.EnvFile = path
+	tc := New(Config{Rules: []Rule{rule}})
+
+	for _, token := range []string{"first", "second"} {
+		if err := os.WriteFile(path, []byte("TOKEN="+token+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if output, _ := handle(t, tc, "/env"); output != token {
+			t.Errorf("output = %q, want %q", output, token)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package telecmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	ChatID   int64     `json:"chatId,omitempty"`
+	UserID   int64     `json:"userId,omitempty"`
+	Text     string    `json:"text,omitempty"`
+	Rule     string    `json:"rule,omitempty"`
+	Tags     []string  `json:"tags,omitempty"`
+	ExitCode *int      `json:"exitCode,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// eventHub publishes events as JSON lines to clients connected to a unix socket.
+// Slow clients miss events instead of blocking the publisher.
+type eventHub struct {
+	mu      sync.Mutex
+	clients map[net.Conn]chan []byte
+}
+
+func listenEvents(ctx context.Context, path string) (*eventHub, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+
+	hub := &eventHub{clients: make(map[net.Conn]chan []byte)}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Error().Err(err).Msg("failed to accept event client")
+				}
+				hub.closeAll()
+				return
+			}
+			hub.serve(conn)
+		}
+	}()
+
+	return hub, nil
+}
+
+func (h *eventHub) serve(conn net.Conn) {
+	queue := make(chan []byte, 64)
+
+	h.mu.Lock()
+	h.clients[conn] = queue
+	h.mu.Unlock()
+
+	go func() {
+		defer h.remove(conn)
+		for line := range queue {
+			if _, err := conn.Write(line); err != nil {
+				log.Debug().Err(err).Msg("event client disconnected")
+				return
+			}
+		}
+	}()
+}
+
+func (h *eventHub) remove(conn net.Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if queue, ok := h.clients[conn]; ok {
+		delete(h.clients, conn)
+		close(queue)
+	}
+	conn.Close()
+}
+
+func (h *eventHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for conn, queue := range h.clients {
+		delete(h.clients, conn)
+		close(queue)
+		conn.Close()
+	}
+}
+
+func (h *eventHub) publish(e event) {
+	if h == nil {
+		return
+	}
+
+	e.Time = time.Now()
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to serialize event")
+		return
+	}
+	b = append(b, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, queue := range h.clients {
+		select {
+		case queue <- b:
+		default:
+		}
+	}
+}
+
+func messageEvent(eventType string, message *tgbotapi.Message) event {
+	e := event{Type: eventType, Text: message.Text}
+	if message.Chat != nil {
+		e.ChatID = message.Chat.ID
+	}
+	if message.From != nil {
+		e.UserID = message.From.ID
+	}
+	return e
+}
@@ -0,0 +1,83 @@
+package telecmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEventSocket(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		tags     []string
+		exitCode int
+		wantErr  bool
+	}{
+		{name: "successful command", script: "echo ok", tags: []string{"ops"}, exitCode: 0},
+		{name: "failed command", script: "echo oops >&2; exit 2", exitCode: 2, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			path := filepath.Join(t.TempDir(), "events.sock")
+			hub, err := listenEvents(ctx, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			waitFor(t, "client to be accepted", func() bool {
+				hub.mu.Lock()
+				defer hub.mu.Unlock()
+				return len(hub.clients) == 1
+			})
+
+			rule := shellRule("check", "/check", tt.script)
+			rule.Tags = tt.tags
+			tc := New(Config{Rules: []Rule{rule}})
+			tc.events = hub
+			handle(t, tc, "/check now")
+
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			scanner := bufio.NewScanner(conn)
+			var events []event
+			for len(events) < 2 && scanner.Scan() {
+				var e event
+				if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+					t.Fatalf("invalid event %q: %v", scanner.Text(), err)
+				}
+				events = append(events, e)
+			}
+			if len(events) != 2 {
+				t.Fatalf("read %d events, want 2: %v", len(events), scanner.Err())
+			}
+
+			matched, result := events[0], events[1]
+			if matched.Type != "matched" || matched.Rule != "check" || matched.ChatID != 100 || matched.UserID != 42 || matched.Text != "/check now" {
+				t.Errorf("unexpected matched event %+v", matched)
+			}
+			if !reflect.DeepEqual(matched.Tags, tt.tags) || !reflect.DeepEqual(result.Tags, tt.tags) {
+				t.Errorf("event tags = %v and %v, want %v", matched.Tags, result.Tags, tt.tags)
+			}
+			if result.Type != "result" || result.Rule != "check" || result.ExitCode == nil || *result.ExitCode != tt.exitCode {
+				t.Errorf("unexpected result event %+v", result)
+			}
+			if (result.Error != "") != tt.wantErr {
+				t.Errorf("result error = %q, want error %v", result.Error, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package telecmd
+
+import (
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// extractableEntities are the entity types extractEntity can pull from a message
+var extractableEntities = []string{"pre", "code"}
+
+// firstEntityText returns the text of the first entity of the type in the message.
+// Captions matched as text have their own entities.
+func firstEntityText(message *tgbotapi.Message, entityType string) (string, bool) {
+	entities := message.Entities
+	if len(entities) == 0 && message.Text == message.Caption {
+		entities = message.CaptionEntities
+	}
+
+	for _, entity := range entities {
+		if entity.Type != entityType {
+			continue
+		}
+		if text := entityText(message.Text, entity); text != "" {
+			return text, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,63 @@
+package telecmd
+
+import (
+	"context"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"testing"
+)
+
+func TestHandleExtractEntity(t *testing.T) {
+	const sqlText = "/sql run this\nselect 1;"
+
+	tests := []struct {
+		name          string
+		text          string
+		extractEntity string
+		entities      []tgbotapi.MessageEntity
+		caption       bool
+		want          string
+	}{
+		{name: "code block", text: sqlText, extractEntity: "pre", entities: []tgbotapi.MessageEntity{{Type: "pre", Offset: 14, Length: 9}}, want: "select 1;"},
+		{name: "inline code", text: "/sql `select 2`", extractEntity: "code", entities: []tgbotapi.MessageEntity{{Type: "code", Offset: 6, Length: 8}}, want: "select 2"},
+		{
+			name:          "first of several",
+			text:          "/sql select 1 select 2",
+			extractEntity: "code",
+			entities: []tgbotapi.MessageEntity{
+				{Type: "bold", Offset: 0, Length: 4},
+				{Type: "code", Offset: 5, Length: 8},
+				{Type: "code", Offset: 14, Length: 8},
+			},
+			want: "select 1",
+		},
+		{name: "no entity", text: sqlText, extractEntity: "pre", want: sqlText},
+		{name: "other entity type", text: sqlText, extractEntity: "pre", entities: []tgbotapi.MessageEntity{{Type: "code", Offset: 14, Length: 9}}, want: sqlText},
+		{name: "not extracted by default", text: sqlText, entities: []tgbotapi.MessageEntity{{Type: "pre", Offset: 14, Length: 9}}, want: sqlText},
+		// offsets count UTF-16 code units, the emoji takes two
+		{name: "after an emoji", text: "/sql 🔍 select 3", extractEntity: "code", entities: []tgbotapi.MessageEntity{{Type: "code", Offset: 8, Length: 8}}, want: "select 3"},
+		{name: "caption", text: "/sql select 4", extractEntity: "code", entities: []tgbotapi.MessageEntity{{Type: "code", Offset: 5, Length: 8}}, caption: true, want: "select 4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := shellRule("sql", "/sql.*", `printf %s "$1"`)
+			rule.ExtractEntity = tt.extractEntity
+			tc := New(Config{Rules: []Rule{rule}})
+
+			message := testMessage(tt.text)
+			if tt.caption {
+				message.Caption = tt.text
+				message.CaptionEntities = tt.entities
+			} else {
+				message.Entities = tt.entities
+			}
+			_, output, ok := tc.Handle(context.Background(), tgbotapi.Update{Message: message}, message)
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
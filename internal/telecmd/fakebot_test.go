@@ -0,0 +1,252 @@
+package telecmd
+
+import (
+	"context"
+	"encoding/json"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+// fakeTelegram is a bot API server for clients created with newClient.
+// It records the requests of the bots and hands out the updates pushed for each token.
+type fakeTelegram struct {
+	server *httptest.Server
+	// closed cuts the delays short when the test ends
+	closed chan struct{}
+
+	mu       sync.Mutex
+	requests []fakeRequest
+	updates  map[string][]tgbotapi.Update
+	nextID   int
+	// delays is how long each method takes to respond
+	delays map[string]time.Duration
+	// threads are the topics of pushed updates by update id, the client's updates have no field for them
+	threads map[int]int
+}
+
+type fakeRequest struct {
+	token  string
+	method string
+	params url.Values
+	at     time.Time
+}
+
+func newFakeTelegram(t *testing.T) *fakeTelegram {
+	f := &fakeTelegram{
+		updates: make(map[string][]tgbotapi.Update),
+		delays:  make(map[string]time.Duration),
+		threads: make(map[int]int),
+		closed:  make(chan struct{}),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(func() {
+		close(f.closed)
+		f.server.Close()
+	})
+	return f
+}
+
+// newClient creates a bot client talking to the fake server, it can replace tgbotapi.NewBotAPI
+func (f *fakeTelegram) newClient(token string) (*tgbotapi.BotAPI, error) {
+	return tgbotapi.NewBotAPIWithClient(token, f.server.URL+"/bot%s/%s", f.server.Client())
+}
+
+// connect makes telecmd send with a client of the fake server
+func (f *fakeTelegram) connect(t *testing.T, tc Telecmd, token string) Telecmd {
+	t.Helper()
+	bot, err := f.newClient(token)
+	if err != nil {
+		t.Fatalf("cannot create fake client: %v", err)
+	}
+	tc.bot = &atomic.Pointer[tgbotapi.BotAPI]{}
+	tc.bot.Store(bot)
+	return tc
+}
+
+func (f *fakeTelegram) setDelay(method string, delay time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.delays[method] = delay
+}
+
+// push queues an update for the bot with the token
+func (f *fakeTelegram) push(token string, update tgbotapi.Update) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.updates[token] = append(f.updates[token], update)
+}
+
+// pushInThread queues an update whose message was sent to a topic
+func (f *fakeTelegram) pushInThread(token string, update tgbotapi.Update, threadID int) {
+	f.mu.Lock()
+	f.threads[update.UpdateID] = threadID
+	f.mu.Unlock()
+	f.push(token, update)
+}
+
+// sent returns the recorded requests of the method, of any bot if token is empty
+func (f *fakeTelegram) sent(token string, method string) []fakeRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var requests []fakeRequest
+	for _, r := range f.requests {
+		if r.method == method && (token == "" || r.token == token) {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+func (f *fakeTelegram) handle(w http.ResponseWriter, r *http.Request) {
+	// paths are /bot<token>/<method>
+	at := time.Now()
+	token, method, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/bot"), "/")
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		_ = r.ParseMultipartForm(1 << 20)
+	} else {
+		_ = r.ParseForm()
+	}
+	params := url.Values{}
+	for key, values := range r.Form {
+		params[key] = values
+	}
+	if r.MultipartForm != nil {
+		for key, files := range r.MultipartForm.File {
+			params.Set(key, files[0].Filename)
+		}
+	}
+
+	f.mu.Lock()
+	delay := f.delays[method]
+	f.mu.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		case <-f.closed:
+			return
+		}
+	}
+
+	var result any
+	switch method {
+	case "getMe":
+		result = tgbotapi.User{ID: 1, IsBot: true, FirstName: "fake", UserName: "bot_" + token}
+	case "getUpdates":
+		result = f.withThreads(f.takeUpdates(r.Context(), token))
+	case "getFile":
+		result = tgbotapi.File{FileID: params.Get("file_id"), FilePath: "files/" + params.Get("file_id")}
+	case "answerCallbackQuery", "leaveChat":
+		result = true
+	default:
+		chatID, _ := strconv.ParseInt(params.Get("chat_id"), 10, 64)
+		f.mu.Lock()
+		f.nextID++
+		result = tgbotapi.Message{MessageID: f.nextID, Chat: &tgbotapi.Chat{ID: chatID}, Text: params.Get("text")}
+		f.mu.Unlock()
+	}
+
+	if method != "getMe" && method != "getUpdates" {
+		f.mu.Lock()
+		f.requests = append(f.requests, fakeRequest{token: token, method: method, params: params, at: at})
+		f.mu.Unlock()
+	}
+
+	b, _ := json.Marshal(result)
+	_ = json.NewEncoder(w).Encode(tgbotapi.APIResponse{Ok: true, Result: b})
+}
+
+// withThreads adds the topic of the updates pushed in one to their messages
+func (f *fakeTelegram) withThreads(updates []tgbotapi.Update) []map[string]any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	raw := make([]map[string]any, len(updates))
+	for i, update := range updates {
+		b, _ := json.Marshal(update)
+		_ = json.Unmarshal(b, &raw[i])
+		if threadID, ok := f.threads[update.UpdateID]; ok {
+			if message, ok := raw[i]["message"].(map[string]any); ok {
+				message["message_thread_id"] = threadID
+			}
+		}
+	}
+	return raw
+}
+
+// takeUpdates long polls the updates of the bot with the token for a short while
+func (f *fakeTelegram) takeUpdates(ctx context.Context, token string) []tgbotapi.Update {
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for {
+		f.mu.Lock()
+		updates := f.updates[token]
+		delete(f.updates, token)
+		f.mu.Unlock()
+
+		if len(updates) > 0 || time.Now().After(deadline) || ctx.Err() != nil {
+			return updates
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitFor fails the test if cond doesn't become true in a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testMessage is a private message from a user
+func testMessage(text string) *tgbotapi.Message {
+	return &tgbotapi.Message{
+		MessageID: 1,
+		Date:      int(time.Now().Unix()),
+		Text:      text,
+		Chat:      &tgbotapi.Chat{ID: 100, Type: "private"},
+		From:      &tgbotapi.User{ID: 42, FirstName: "tester", UserName: "tester"},
+	}
+}
+
+// handle runs Handle for a message with the text
+func handle(t *testing.T, tc Telecmd, text string) (string, bool) {
+	t.Helper()
+	message := testMessage(text)
+	_, output, ok := tc.Handle(context.Background(), tgbotapi.Update{Message: message}, message)
+	return output, ok
+}
+
+// shellRule runs the shell script with the message text as $1
+func shellRule(name string, pattern string, script string) Rule {
+	return Rule{Name: name, Pattern: pattern, Command: []string{"sh", "-c", script, "sh"}, ArgSeparator: new(string)}
+}
+
+// commandMessage is a private message starting with a bot command, like /status@bot args
+func commandMessage(text string) *tgbotapi.Message {
+	message := testMessage(text)
+	command, _, _ := strings.Cut(text, " ")
+	message.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(command)}}
+	return message
+}
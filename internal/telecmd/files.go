@@ -0,0 +1,115 @@
+package telecmd
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type attachedFile struct {
+	ID       string
+	Name     string
+	MimeType string
+}
+
+func fileFromMessage(message *tgbotapi.Message) (attachedFile, bool) {
+	switch {
+	case message.Document != nil:
+		return attachedFile{ID: message.Document.FileID, Name: message.Document.FileName, MimeType: message.Document.MimeType}, true
+	case len(message.Photo) > 0:
+		// photos come in several sizes, the last one is the largest
+		photo := message.Photo[len(message.Photo)-1]
+		return attachedFile{ID: photo.FileID, Name: "photo.jpg", MimeType: "image/jpeg"}, true
+	case message.Audio != nil:
+		return attachedFile{ID: message.Audio.FileID, Name: message.Audio.FileName, MimeType: message.Audio.MimeType}, true
+	case message.Video != nil:
+		return attachedFile{ID: message.Video.FileID, Name: message.Video.FileName, MimeType: message.Video.MimeType}, true
+	case message.Voice != nil:
+		return attachedFile{ID: message.Voice.FileID, Name: "voice.ogg", MimeType: message.Voice.MimeType}, true
+	}
+	return attachedFile{}, false
+}
+
+// allowedBy checks the file against a list of MIME types like image/png or image/*, and extensions like .png
+func (f attachedFile) allowedBy(fileTypes []string) bool {
+	mimeType := f.MimeType
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(filepath.Ext(f.Name))
+	}
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+
+	for _, fileType := range fileTypes {
+		fileType = strings.ToLower(fileType)
+		switch {
+		case strings.HasPrefix(fileType, "."):
+			if strings.EqualFold(filepath.Ext(f.Name), fileType) {
+				return true
+			}
+		case strings.HasSuffix(fileType, "/*"):
+			if strings.HasPrefix(strings.ToLower(mimeType), strings.TrimSuffix(fileType, "*")) {
+				return true
+			}
+		default:
+			if strings.EqualFold(mimeType, fileType) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// downloadFile saves the file to a temporary path owned by the runAs user, which the caller must remove
+func (t Telecmd) downloadFile(ctx context.Context, file attachedFile, runAs string) (string, error) {
+	if t.client() == nil {
+		return "", fmt.Errorf("not connected to telegram")
+	}
+
+	url, err := withContext(ctx, func() (string, error) {
+		return t.client().GetFileDirectURL(file.ID)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get file url: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to download file: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download file: status %d", res.StatusCode)
+	}
+
+	return saveTempFile(res.Body, file.Name, runAs)
+}
+
+// saveTempFile copies r to a temp file with the extension of name and hands it over to the runAs user
+func saveTempFile(r io.Reader, name string, runAs string) (string, error) {
+	f, err := os.CreateTemp("", "telecmd-file-*"+path.Ext(name))
+	if err != nil {
+		return "", fmt.Errorf("failed to create file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to save file: %w", err)
+	}
+	if err := chownRunAs(f.Name(), runAs); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to hand over file: %w", err)
+	}
+
+	return f.Name(), nil
+}
@@ -0,0 +1,186 @@
+package telecmd
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandlerTimeoutBoundsSlowRequests(t *testing.T) {
+	tests := []struct {
+		name       string
+		slowMethod string
+		withFile   bool
+		// ran is whether the command runs before the handler times out
+		ran bool
+	}{
+		{name: "file lookup", slowMethod: "getFile", withFile: true, ran: false},
+		{name: "reply", slowMethod: "sendMessage", ran: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			f.setDelay(tt.slowMethod, 5*time.Second)
+
+			ran := filepath.Join(t.TempDir(), "ran")
+			rule := shellRule("upload", "/upload", fmt.Sprintf(`touch %q; echo stored`, ran))
+			rule.DownloadFile = true
+			tc := f.connect(t, New(Config{HandlerTimeout: "200ms", Rules: []Rule{rule}}), "token")
+
+			message := testMessage("/upload")
+			if tt.withFile {
+				message.Document = &tgbotapi.Document{FileID: "doc-1", FileName: "report.txt"}
+			}
+			start := time.Now()
+			tc.handleMessage(context.Background(), tgbotapi.Update{Message: message}, message)
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("handling took %s, want it bounded by handlerTimeout", elapsed)
+			}
+
+			if _, err := os.Stat(ran); (err == nil) != tt.ran {
+				t.Errorf("command ran = %v, want %v", err == nil, tt.ran)
+			}
+		})
+	}
+}
+
+func TestHandleAllowedFileTypes(t *testing.T) {
+	tests := []struct {
+		name     string
+		document *tgbotapi.Document
+		photo    []tgbotapi.PhotoSize
+		want     string
+	}{
+		{name: "mime type", document: &tgbotapi.Document{FileID: "1", FileName: "a.png", MimeType: "image/png"}, want: "ran\n"},
+		{name: "wildcard", document: &tgbotapi.Document{FileID: "1", FileName: "a.gif", MimeType: "image/gif"}, want: "ran\n"},
+		{name: "extension", document: &tgbotapi.Document{FileID: "1", FileName: "notes.TXT", MimeType: "application/octet-stream"}, want: "ran\n"},
+		{name: "mime type from the extension", document: &tgbotapi.Document{FileID: "1", FileName: "a.jpg"}, want: "ran\n"},
+		{name: "photo", photo: []tgbotapi.PhotoSize{{FileID: "small"}, {FileID: "large"}}, want: "ran\n"},
+		{name: "rejected", document: &tgbotapi.Document{FileID: "1", FileName: "a.pdf", MimeType: "application/pdf"}, want: "file type application/pdf is not allowed"},
+		{name: "no file", want: "ran\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := filepath.Join(t.TempDir(), "ran")
+			rule := shellRule("upload", "/upload", fmt.Sprintf(`touch %q; echo ran`, ran))
+			rule.AllowedFileTypes = []string{"image/*", "application/json", ".txt"}
+			tc := New(Config{Rules: []Rule{rule}})
+
+			message := testMessage("/upload")
+			message.Document = tt.document
+			message.Photo = tt.photo
+			_, output, ok := tc.Handle(context.Background(), tgbotapi.Update{Message: message}, message)
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+			if _, err := os.Stat(ran); (err == nil) != (tt.want == "ran\n") {
+				t.Errorf("command ran = %v", err == nil)
+			}
+		})
+	}
+}
+
+func TestHandleWorkingDirTemplate(t *testing.T) {
+	tests := []struct {
+		name       string
+		workingDir string
+		create     bool
+		// wantDir is relative to the temp dir, empty if the command can't run
+		wantDir string
+	}{
+		{name: "chat id", workingDir: "{{.ChatID}}", create: true, wantDir: "100"},
+		{name: "user and rule", workingDir: "{{.Username}}/{{.Rule}}", create: true, wantDir: "tester/pwd"},
+		{name: "missing without create", workingDir: "{{.ChatID}}"},
+		{name: "invalid template", workingDir: "{{.ChatID", create: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := t.TempDir()
+			rule := shellRule("pwd", "/pwd", "pwd")
+			rule.WorkingDirectory = filepath.Join(base, tt.workingDir)
+			rule.CreateWorkingDir = tt.create
+			tc := New(Config{Rules: []Rule{rule}, StateDir: t.TempDir()})
+
+			output, ok := handle(t, tc, "/pwd")
+			if tt.wantDir == "" {
+				if output != "" {
+					t.Errorf("ran with output %q, want it not to run", output)
+				}
+				if entries, _ := os.ReadDir(base); len(entries) > 0 {
+					t.Errorf("created %s", entries[0].Name())
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			want := filepath.Join(base, tt.wantDir)
+			if output != want+"\n" {
+				t.Errorf("ran in %q, want %q", output, want)
+			}
+			if info, err := os.Stat(want); err != nil || !info.IsDir() {
+				t.Errorf("working dir wasn't created: %v", err)
+			}
+		})
+	}
+}
+
+func TestHelpersAbortWhenCancelled(t *testing.T) {
+	// blocks until the test ends
+	release := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(stuck.Close)
+	t.Cleanup(func() { close(release) })
+
+	tests := []struct {
+		name string
+		run  func(ctx context.Context, t *testing.T) error
+	}{
+		{name: "download", run: func(ctx context.Context, t *testing.T) error {
+			f := newFakeTelegram(t)
+			f.setDelay("getFile", 5*time.Second)
+			tc := f.connect(t, New(Config{}), "token")
+			_, err := tc.downloadFile(ctx, attachedFile{ID: "doc-1", Name: "report.txt"}, "")
+			return err
+		}},
+		{name: "paste upload", run: func(ctx context.Context, t *testing.T) error {
+			_, err := PasteUpload{URL: stuck.URL}.Upload(ctx, "output")
+			return err
+		}},
+		{name: "template", run: func(ctx context.Context, t *testing.T) error {
+			<-ctx.Done()
+			_, err := renderTemplateContext(ctx, "{{.Rule}}", templateContext{Rule: "x"})
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+
+			start := time.Now()
+			err := tt.run(ctx, t)
+			if err == nil {
+				t.Error("didn't fail when cancelled")
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("took %s to stop after the context was cancelled", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package telecmd
+
+import (
+	"context"
+	"sync"
+)
+
+// flightKey identifies identical triggers of a rule in a chat.
+// Runs aren't shared across chats, the command sees the chat in its env and /cancel works by chat.
+type flightKey struct {
+	rule int
+	chat int64
+	text string
+	file string
+}
+
+type flight struct {
+	done   chan struct{}
+	result ruleResult
+}
+
+// flights runs a function once for concurrent calls with the same key, like x/sync/singleflight
+type flights struct {
+	mu      sync.Mutex
+	running map[flightKey]*flight
+}
+
+func newFlights() *flights {
+	return &flights{running: make(map[flightKey]*flight)}
+}
+
+// do runs fn unless it's already running for the key, in which case it waits for that run and returns its result.
+// shared is true for callers that got the result of another call.
+// Callers stop waiting once ctx is done, with an empty result.
+func (f *flights) do(ctx context.Context, key flightKey, fn func() ruleResult) (result ruleResult, shared bool) {
+	f.mu.Lock()
+	if running, exists := f.running[key]; exists {
+		f.mu.Unlock()
+		select {
+		case <-running.done:
+			return running.result, true
+		case <-ctx.Done():
+			return ruleResult{}, false
+		}
+	}
+	current := &flight{done: make(chan struct{})}
+	f.running[key] = current
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.running, key)
+		f.mu.Unlock()
+		close(current.done)
+	}()
+	current.result = fn()
+	return current.result, false
+}
@@ -0,0 +1,119 @@
+package telecmd
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandleSingleFlight(t *testing.T) {
+	tests := []struct {
+		name         string
+		singleFlight bool
+		chats        []int64
+		texts        []string
+		wantRuns     int
+	}{
+		{name: "identical messages run once", singleFlight: true, chats: []int64{1, 1, 1}, texts: []string{"/report", "/report", "/report"}, wantRuns: 1},
+		{name: "different chats run separately", singleFlight: true, chats: []int64{1, 2, 3}, texts: []string{"/report", "/report", "/report"}, wantRuns: 3},
+		{name: "different texts run separately", singleFlight: true, chats: []int64{1, 1, 1}, texts: []string{"/report a", "/report b", "/report c"}, wantRuns: 3},
+		{name: "without singleFlight", chats: []int64{1, 1, 1}, texts: []string{"/report", "/report", "/report"}, wantRuns: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := filepath.Join(t.TempDir(), "runs")
+			// the runs overlap while the command sleeps
+			rule := shellRule("report", "/report.*", fmt.Sprintf(`echo run >> %q; sleep 0.3; echo done`, runs))
+			rule.SingleFlight = tt.singleFlight
+			tc := New(Config{Rules: []Rule{rule}})
+
+			outputs := make([]string, len(tt.chats))
+			var wg sync.WaitGroup
+			for i := range tt.chats {
+				i := i
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					message := testMessage(tt.texts[i])
+					message.Chat = &tgbotapi.Chat{ID: tt.chats[i], Type: "private"}
+					_, outputs[i], _ = tc.Handle(context.Background(), tgbotapi.Update{Message: message}, message)
+				}()
+			}
+			wg.Wait()
+
+			b, err := os.ReadFile(runs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Count(string(b), "run\n"); got != tt.wantRuns {
+				t.Errorf("command ran %d times, want %d", got, tt.wantRuns)
+			}
+			for i, output := range outputs {
+				if output != "done\n" {
+					t.Errorf("output of message %d = %q, want every message to get the output", i, output)
+				}
+			}
+		})
+	}
+}
+
+func TestFlightsWaiterStopsWithContext(t *testing.T) {
+	f := newFlights()
+	key := flightKey{rule: 1, chat: 100, text: "/report"}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go f.do(context.Background(), key, func() ruleResult {
+		close(started)
+		<-release
+		return ruleResult{output: "done", ok: true}
+	})
+	<-started
+	defer close(release)
+
+	tests := []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+	}{
+		{name: "cancelled", ctx: func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx, cancel
+		}},
+		{name: "timed out", ctx: func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 50*time.Millisecond)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := tt.ctx()
+			defer cancel()
+
+			done := make(chan ruleResult, 1)
+			go func() {
+				result, _ := f.do(ctx, key, func() ruleResult {
+					t.Error("waiter ran the function")
+					return ruleResult{}
+				})
+				done <- result
+			}()
+
+			select {
+			case result := <-done:
+				if result.ok {
+					t.Errorf("result = %+v, want none", result)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("waiter didn't stop with its context")
+			}
+		})
+	}
+}
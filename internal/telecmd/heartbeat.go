@@ -0,0 +1,85 @@
+package telecmd
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"text/template"
+	"time"
+)
+
+type Heartbeat struct {
+	ChatID   int64  `yaml:"chatId,omitempty"`
+	Interval string `yaml:"interval,omitempty"`
+	Message  string `yaml:"message,omitempty"`
+	Edit     bool   `yaml:"edit,omitempty"`
+}
+
+func (h Heartbeat) IntervalDuration() time.Duration {
+	interval, _ := time.ParseDuration(h.Interval)
+	return interval
+}
+
+func (h Heartbeat) Validate() error {
+	if h.ChatID == 0 {
+		return fmt.Errorf("chatId cannot be empty")
+	}
+	if interval, err := time.ParseDuration(h.Interval); err != nil || interval <= 0 {
+		return fmt.Errorf("invalid interval %q", h.Interval)
+	}
+	if _, err := template.New("").Parse(h.Message); err != nil {
+		return fmt.Errorf("invalid message: %w", err)
+	}
+	return nil
+}
+
+func (h Heartbeat) text(now time.Time) string {
+	message := h.Message
+	if message == "" {
+		message = "alive at {{.Time.Format \"2006-01-02 15:04:05\"}}"
+	}
+
+	text, err := renderTemplate(message, map[string]any{"Time": now})
+	if err != nil {
+		log.Error().Err(err).Msg("cannot render heartbeat message")
+		return message
+	}
+	return text
+}
+
+// runHeartbeat posts the heartbeat message to the chat at every interval until ctx is cancelled.
+// With edit enabled, the first message is edited instead of posting new ones.
+func (t Telecmd) runHeartbeat(ctx context.Context, heartbeat Heartbeat) {
+	ticker := time.NewTicker(heartbeat.IntervalDuration())
+	defer ticker.Stop()
+
+	messageID := 0
+	beat := func(now time.Time) {
+		text := heartbeat.text(now)
+		if heartbeat.Edit && messageID != 0 {
+			_, err := t.send(ctx, tgbotapi.NewEditMessageText(heartbeat.ChatID, messageID, text))
+			if err == nil {
+				return
+			}
+			log.Warn().Err(err).Msg("cannot edit heartbeat, sending a new one")
+		}
+
+		sent, err := t.send(ctx, tgbotapi.NewMessage(heartbeat.ChatID, text))
+		if err != nil {
+			log.Error().Err(err).Msg("failed to send heartbeat")
+			return
+		}
+		messageID = sent.MessageID
+	}
+
+	beat(t.config.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			beat(now.In(t.config.Location()))
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package telecmd
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunHeartbeat(t *testing.T) {
+	tests := []struct {
+		name      string
+		edit      bool
+		wantSent  int
+		wantEdits int
+	}{
+		{name: "new messages", wantSent: 3},
+		{name: "edited", edit: true, wantSent: 1, wantEdits: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			tc := f.connect(t, New(Config{}), "token")
+			heartbeat := Heartbeat{ChatID: 100, Interval: "50ms", Message: "up since {{.Time.Year}}", Edit: tt.edit}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				tc.runHeartbeat(ctx, heartbeat)
+				close(done)
+			}()
+
+			waitFor(t, "heartbeats", func() bool {
+				return len(f.sent("token", "sendMessage"))+len(f.sent("token", "editMessageText")) >= tt.wantSent+tt.wantEdits
+			})
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("heartbeat didn't stop with the context")
+			}
+
+			sent := f.sent("token", "sendMessage")
+			edits := f.sent("token", "editMessageText")
+			// a beat may have been underway when the wait ended
+			if len(sent) < tt.wantSent || (tt.edit && len(sent) != 1) || len(edits) < tt.wantEdits {
+				t.Errorf("sent %d and edited %d, want %d and %d", len(sent), len(edits), tt.wantSent, tt.wantEdits)
+			}
+			if text := sent[0].params.Get("text"); !strings.HasPrefix(text, "up since ") || sent[0].params.Get("chat_id") != "100" {
+				t.Errorf("sent %q to %s", text, sent[0].params.Get("chat_id"))
+			}
+			for _, edit := range edits {
+				if edit.params.Get("message_id") != "1" {
+					t.Errorf("edited message %s, want the first heartbeat", edit.params.Get("message_id"))
+				}
+			}
+		})
+	}
+}
+
+func TestHeartbeatValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		heartbeat Heartbeat
+		wantErr   bool
+	}{
+		{name: "valid", heartbeat: Heartbeat{ChatID: 100, Interval: "1h"}},
+		{name: "no chat", heartbeat: Heartbeat{Interval: "1h"}, wantErr: true},
+		{name: "no interval", heartbeat: Heartbeat{ChatID: 100}, wantErr: true},
+		{name: "negative interval", heartbeat: Heartbeat{ChatID: 100, Interval: "-1m"}, wantErr: true},
+		{name: "invalid message", heartbeat: Heartbeat{ChatID: 100, Interval: "1h", Message: "{{.Time"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.heartbeat.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
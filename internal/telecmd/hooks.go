@@ -0,0 +1,33 @@
+package telecmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"strings"
+)
+
+// runHook runs a hook or guard with the same arguments and environment as the rule's command.
+// The error of a failed hook carries its stderr.
+func (t Telecmd) runHook(ctx context.Context, hook []string, rule Rule, message *tgbotapi.Message, env ...string) error {
+	hookRule := rule
+	hookRule.Command = hook
+	cmd, err := t.commandFromMessage(ctx, hookRule, message)
+	if err != nil {
+		return fmt.Errorf("cannot parse hook: %w", err)
+	}
+	cmd.Env = append(cmd.Env, env...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return errors.New(msg)
+		}
+		return fmt.Errorf("hook failed: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package telecmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHandleHooks(t *testing.T) {
+	tests := []struct {
+		name         string
+		preHook      string
+		script       string
+		want         string
+		wantRan      bool
+		wantExitCode string
+	}{
+		{name: "pre-hook passes", preHook: "true", script: "echo ran", want: "ran\n", wantRan: true, wantExitCode: "0"},
+		{name: "pre-hook aborts with its stderr", preHook: "echo locked >&2; exit 1", script: "echo ran", want: "locked"},
+		{name: "pre-hook aborts without stderr", preHook: "exit 3", script: "echo ran", want: "hook failed: exit status 3"},
+		{name: "pre-hook sees the message", preHook: `[ "$1" = /hook ]`, script: "echo ran", want: "ran\n", wantRan: true, wantExitCode: "0"},
+		{name: "post-hook gets the exit code", preHook: "true", script: "echo ran; exit 4", want: "command exited with code=4", wantRan: true, wantExitCode: "4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ran := filepath.Join(dir, "ran")
+			exitCode := filepath.Join(dir, "exit-code")
+
+			rule := shellRule("hook", "/hook", "touch "+ran+"; "+tt.script)
+			tc := New(Config{
+				Rules:    []Rule{rule},
+				PreHook:  []string{"sh", "-c", tt.preHook, "sh"},
+				PostHook: []string{"sh", "-c", `printf %s "$TELEGRAM_EXIT_CODE" > ` + exitCode, "sh"},
+			})
+
+			output, ok := handle(t, tc, "/hook")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+			if _, err := os.Stat(ran); (err == nil) != tt.wantRan {
+				t.Errorf("command ran = %v, want %v", err == nil, tt.wantRan)
+			}
+			if b, _ := os.ReadFile(exitCode); string(b) != tt.wantExitCode {
+				t.Errorf("post-hook got exit code %q, want %q", b, tt.wantExitCode)
+			}
+		})
+	}
+}
+
+func TestHandleGuard(t *testing.T) {
+	tests := []struct {
+		name       string
+		guard      string
+		guardReply string
+		want       string
+		wantRan    bool
+	}{
+		{name: "passes", guard: "true", want: "ran\n", wantRan: true},
+		{name: "fails silently", guard: "false"},
+		{name: "fails with reply", guard: "false", guardReply: "feature is off", want: "feature is off"},
+		{name: "sees the rule env", guard: `[ "$TELEGRAM_RULE_NAME" = guarded ]`, want: "ran\n", wantRan: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := filepath.Join(t.TempDir(), "ran")
+			rule := shellRule("guarded", "/guarded", "touch "+ran+"; echo ran")
+			rule.Guard = []string{"sh", "-c", tt.guard}
+			rule.GuardReply = tt.guardReply
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, "/guarded")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+			if _, err := os.Stat(ran); (err == nil) != tt.wantRan {
+				t.Errorf("command ran = %v, want %v", err == nil, tt.wantRan)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package telecmd
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"text/template"
+)
+
+// OnJoin is what the bot does when it's added to a chat
+type OnJoin struct {
+	Message    string `yaml:"message,omitempty"`
+	LeaveChats bool   `yaml:"leaveChats,omitempty"`
+}
+
+func (j OnJoin) Validate() error {
+	if _, err := template.New("").Parse(j.Message); err != nil {
+		return fmt.Errorf("invalid message: %w", err)
+	}
+	return nil
+}
+
+// joined reports whether the update is the bot being added to the chat
+func joined(update *tgbotapi.ChatMemberUpdated) bool {
+	wasOut := update.OldChatMember.HasLeft() || update.OldChatMember.WasKicked()
+	isIn := !update.NewChatMember.HasLeft() && !update.NewChatMember.WasKicked()
+	return wasOut && isIn
+}
+
+// handleMyChatMember reacts to the bot being added to a chat.
+// Chats filtered with chatAllow and chatBlock are left if leaveChats is set, others get the welcome message.
+func (t Telecmd) handleMyChatMember(ctx context.Context, update *tgbotapi.ChatMemberUpdated) {
+	log.Info().
+		Int64("chat_id", update.Chat.ID).
+		Str("chat", update.Chat.Title).
+		Str("status", update.NewChatMember.Status).
+		Msg("bot membership changed")
+
+	if t.config.OnJoin == nil || !joined(update) {
+		return
+	}
+	onJoin := *t.config.OnJoin
+
+	if !t.config.ChatAllowed(&update.Chat) {
+		if !onJoin.LeaveChats {
+			return
+		}
+		log.Info().Int64("chat_id", update.Chat.ID).Msg("leaving filtered chat")
+		if _, err := t.client().Request(tgbotapi.LeaveChatConfig{ChatID: update.Chat.ID}); err != nil {
+			log.Error().Err(err).Msg("failed to leave chat")
+		}
+		return
+	}
+
+	if onJoin.Message == "" {
+		return
+	}
+	text, err := renderTemplate(onJoin.Message, map[string]any{
+		"ChatID":    update.Chat.ID,
+		"ChatTitle": update.Chat.Title,
+		"User":      update.From.FirstName,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("cannot render join message")
+		return
+	}
+	if _, err := t.send(ctx, tgbotapi.NewMessage(update.Chat.ID, text)); err != nil {
+		log.Error().Err(err).Msg("failed to send join message")
+	}
+}
@@ -0,0 +1,55 @@
+package telecmd
+
+import (
+	"context"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"testing"
+)
+
+func TestHandleMyChatMember(t *testing.T) {
+	tests := []struct {
+		name      string
+		onJoin    *OnJoin
+		oldStatus string
+		newStatus string
+		chatID    int64
+		wantReply string
+		wantLeave bool
+	}{
+		{name: "added", onJoin: &OnJoin{Message: "hi {{.ChatTitle}}, added by {{.User}}"}, oldStatus: "left", newStatus: "member", chatID: -100, wantReply: "hi ops, added by tester"},
+		{name: "added as admin after a kick", onJoin: &OnJoin{Message: "hi"}, oldStatus: "kicked", newStatus: "administrator", chatID: -100, wantReply: "hi"},
+		{name: "promoted", onJoin: &OnJoin{Message: "hi"}, oldStatus: "member", newStatus: "administrator", chatID: -100},
+		{name: "removed", onJoin: &OnJoin{Message: "hi"}, oldStatus: "member", newStatus: "left", chatID: -100},
+		{name: "without onJoin", oldStatus: "left", newStatus: "member", chatID: -100},
+		{name: "filtered chat is left", onJoin: &OnJoin{Message: "hi", LeaveChats: true}, oldStatus: "left", newStatus: "member", chatID: -200, wantLeave: true},
+		{name: "filtered chat is ignored", onJoin: &OnJoin{Message: "hi"}, oldStatus: "left", newStatus: "member", chatID: -200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			tc := f.connect(t, New(Config{OnJoin: tt.onJoin, ChatBlock: `^-200$`}), "token")
+
+			tc.handleMyChatMember(context.Background(), &tgbotapi.ChatMemberUpdated{
+				Chat:          tgbotapi.Chat{ID: tt.chatID, Type: "group", Title: "ops"},
+				From:          tgbotapi.User{ID: 42, FirstName: "tester"},
+				OldChatMember: tgbotapi.ChatMember{Status: tt.oldStatus},
+				NewChatMember: tgbotapi.ChatMember{Status: tt.newStatus},
+			})
+
+			var replies []string
+			for _, r := range f.sent("token", "sendMessage") {
+				replies = append(replies, r.params.Get("text"))
+			}
+			if tt.wantReply == "" && len(replies) > 0 {
+				t.Errorf("replied %q, want no reply", replies)
+			}
+			if tt.wantReply != "" && (len(replies) != 1 || replies[0] != tt.wantReply) {
+				t.Errorf("replied %q, want %q", replies, tt.wantReply)
+			}
+			if left := len(f.sent("token", "leaveChat")) > 0; left != tt.wantLeave {
+				t.Errorf("left = %v, want %v", left, tt.wantLeave)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package telecmd
+
+import (
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+type inlineButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callbackData"`
+	URL          string `json:"url"`
+}
+
+func (b inlineButton) Validate() error {
+	if b.Text == "" {
+		return fmt.Errorf("button text cannot be empty")
+	}
+	if (b.CallbackData == "") == (b.URL == "") {
+		return fmt.Errorf("button %q must have either callbackData or url", b.Text)
+	}
+	// telegram rejects callback data longer than 64 bytes
+	if len(b.CallbackData) > 64 {
+		return fmt.Errorf("callback data of button %q is longer than 64 bytes", b.Text)
+	}
+	return nil
+}
+
+func inlineKeyboardMarkup(rows [][]inlineButton) (tgbotapi.InlineKeyboardMarkup, error) {
+	if len(rows) == 0 {
+		return tgbotapi.InlineKeyboardMarkup{}, fmt.Errorf("keyboard has no rows")
+	}
+
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for i, row := range rows {
+		if len(row) == 0 {
+			return tgbotapi.InlineKeyboardMarkup{}, fmt.Errorf("row %d has no buttons", i)
+		}
+
+		var buttons []tgbotapi.InlineKeyboardButton
+		for _, b := range row {
+			if err := b.Validate(); err != nil {
+				return tgbotapi.InlineKeyboardMarkup{}, fmt.Errorf("invalid button in row %d: %w", i, err)
+			}
+			if b.URL != "" {
+				buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonURL(b.Text, b.URL))
+			} else {
+				buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(b.Text, b.CallbackData))
+			}
+		}
+		keyboard = append(keyboard, buttons)
+	}
+
+	return tgbotapi.NewInlineKeyboardMarkup(keyboard...), nil
+}
+
+type replyKeyboard struct {
+	Buttons [][]string `json:"buttons"`
+	OneTime bool       `json:"oneTime"`
+	Resize  bool       `json:"resize"`
+}
+
+func (k replyKeyboard) Markup() (tgbotapi.ReplyKeyboardMarkup, error) {
+	if len(k.Buttons) == 0 {
+		return tgbotapi.ReplyKeyboardMarkup{}, fmt.Errorf("keyboard has no rows")
+	}
+
+	var keyboard [][]tgbotapi.KeyboardButton
+	for i, row := range k.Buttons {
+		if len(row) == 0 {
+			return tgbotapi.ReplyKeyboardMarkup{}, fmt.Errorf("row %d has no buttons", i)
+		}
+
+		var buttons []tgbotapi.KeyboardButton
+		for _, text := range row {
+			if text == "" {
+				return tgbotapi.ReplyKeyboardMarkup{}, fmt.Errorf("button text cannot be empty in row %d", i)
+			}
+			buttons = append(buttons, tgbotapi.NewKeyboardButton(text))
+		}
+		keyboard = append(keyboard, buttons)
+	}
+
+	markup := tgbotapi.NewReplyKeyboard(keyboard...)
+	markup.OneTimeKeyboard = k.OneTime
+	markup.ResizeKeyboard = k.Resize
+	return markup, nil
+}
@@ -0,0 +1,109 @@
+package telecmd
+
+import (
+	"fmt"
+	"golang.org/x/exp/slices"
+	"strings"
+	"time"
+)
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// MaintenanceWindow is a recurring time when commands don't run.
+// It opens when its cron expression fires and stays open for the duration,
+// or it's a time of day from and to, on some days of the week.
+// A from-to window ending before it starts spans midnight, its days are the days it starts on.
+type MaintenanceWindow struct {
+	Cron     string   `yaml:"cron,omitempty"`
+	Duration string   `yaml:"duration,omitempty"`
+	From     string   `yaml:"from,omitempty"`
+	To       string   `yaml:"to,omitempty"`
+	Days     []string `yaml:"days,omitempty"`
+}
+
+func (w MaintenanceWindow) Validate() error {
+	if w.Cron != "" {
+		if w.From != "" || w.To != "" || len(w.Days) > 0 {
+			return fmt.Errorf("cron cannot be used with from, to and days")
+		}
+		if _, err := parseCron(w.Cron); err != nil {
+			return err
+		}
+		if duration, err := time.ParseDuration(w.Duration); err != nil || duration <= 0 {
+			return fmt.Errorf("invalid duration %q", w.Duration)
+		}
+		return nil
+	}
+	if w.Duration != "" {
+		return fmt.Errorf("duration requires cron")
+	}
+
+	for _, at := range []string{w.From, w.To} {
+		if _, err := time.Parse("15:04", at); err != nil {
+			return fmt.Errorf("invalid time %q, must be like 02:30", at)
+		}
+	}
+	if w.From == w.To {
+		return fmt.Errorf("from and to cannot be the same")
+	}
+	for _, day := range w.Days {
+		if !slices.Contains(weekdays, strings.ToLower(day)) {
+			return fmt.Errorf("invalid day %q, must be one of %s", day, strings.Join(weekdays, ", "))
+		}
+	}
+	return nil
+}
+
+// contains reports whether the window is open at now, in the location of now
+func (w MaintenanceWindow) contains(now time.Time) bool {
+	if w.Cron != "" {
+		return w.containsCron(now)
+	}
+
+	from, _ := time.Parse("15:04", w.From)
+	to, _ := time.Parse("15:04", w.To)
+	start := from.Hour()*60 + from.Minute()
+	end := to.Hour()*60 + to.Minute()
+	minutes := now.Hour()*60 + now.Minute()
+
+	startDay := now
+	switch {
+	case start < end && minutes >= start && minutes < end:
+	case start > end && minutes >= start:
+	case start > end && minutes < end:
+		// opened the day before
+		startDay = now.AddDate(0, 0, -1)
+	default:
+		return false
+	}
+
+	if len(w.Days) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(w.Days, func(day string) bool {
+		return strings.ToLower(day) == weekdays[startDay.Weekday()]
+	})
+}
+
+// containsCron reports whether the cron expression fired less than the duration before now
+func (w MaintenanceWindow) containsCron(now time.Time) bool {
+	spec, err := parseCron(w.Cron)
+	if err != nil {
+		return false
+	}
+	duration, _ := time.ParseDuration(w.Duration)
+
+	_, fired := spec.prev(now, now.Add(-duration))
+	return fired
+}
+
+// InMaintenance reports whether any of the maintenance windows is open at now, in the configured timezone
+func (c Config) InMaintenance(now time.Time) bool {
+	now = now.In(c.Location())
+	for _, w := range c.MaintenanceWindows {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package telecmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{expr: "0 2 * * *"},
+		{expr: "*/15 0-6 1,15 * 1-5"},
+		{expr: "30 23 * * 7"},
+		{expr: "0 2 * *", wantErr: true},
+		{expr: "60 2 * * *", wantErr: true},
+		{expr: "0 2 0 * *", wantErr: true},
+		{expr: "0 2 * 13 *", wantErr: true},
+		{expr: "0 2 * * 8", wantErr: true},
+		{expr: "*/0 2 * * *", wantErr: true},
+		{expr: "5-1 2 * * *", wantErr: true},
+		{expr: "a 2 * * *", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if _, err := parseCron(tt.expr); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMaintenanceWindowCron(t *testing.T) {
+	// 2024-01-01 is a monday
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name     string
+		cron     string
+		duration string
+		now      time.Time
+		want     bool
+	}{
+		{name: "at the start", cron: "0 2 * * *", duration: "30m", now: at(1, 2, 0), want: true},
+		{name: "inside", cron: "0 2 * * *", duration: "30m", now: at(1, 2, 29), want: true},
+		{name: "at the end", cron: "0 2 * * *", duration: "30m", now: at(1, 2, 30), want: false},
+		{name: "before", cron: "0 2 * * *", duration: "30m", now: at(1, 1, 59), want: false},
+		{name: "over midnight", cron: "30 23 * * *", duration: "1h", now: at(2, 0, 15), want: true},
+		{name: "weekday only", cron: "0 2 * * 1-5", duration: "1h", now: at(6, 2, 10), want: false},
+		{name: "sunday as 7", cron: "0 2 * * 7", duration: "1h", now: at(7, 2, 10), want: true},
+		{name: "steps", cron: "*/20 * * * *", duration: "5m", now: at(1, 10, 42), want: true},
+		{name: "between steps", cron: "*/20 * * * *", duration: "5m", now: at(1, 10, 46), want: false},
+		// restricted day of month and day of week match either, like crontab
+		{name: "day of month or weekday", cron: "0 2 15 * 1", duration: "1h", now: at(8, 2, 0), want: true},
+		{name: "neither day", cron: "0 2 15 * 1", duration: "1h", now: at(9, 2, 0), want: false},
+		{name: "long window", cron: "0 0 1 1 *", duration: "720h", now: at(20, 12, 0), want: true},
+		{name: "long window never fires", cron: "0 0 31 2 *", duration: "87600h", now: at(20, 12, 0), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := MaintenanceWindow{Cron: tt.cron, Duration: tt.duration}
+			if err := w.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.contains(tt.now); got != tt.want {
+				t.Errorf("contains(%s) = %v, want %v", tt.now.Format(time.RFC3339), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaintenanceWindowCronValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		window  MaintenanceWindow
+		wantErr bool
+	}{
+		{name: "cron with duration", window: MaintenanceWindow{Cron: "0 2 * * *", Duration: "1h"}},
+		{name: "missing duration", window: MaintenanceWindow{Cron: "0 2 * * *"}, wantErr: true},
+		{name: "cron with from", window: MaintenanceWindow{Cron: "0 2 * * *", Duration: "1h", From: "02:00"}, wantErr: true},
+		{name: "cron with days", window: MaintenanceWindow{Cron: "0 2 * * *", Duration: "1h", Days: []string{"mon"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.window.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
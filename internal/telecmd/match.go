@@ -0,0 +1,155 @@
+package telecmd
+
+import (
+	"context"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"math/rand"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// ruleFromMessage finds the rule to handle the message.
+// It's the first matching rule, or a weighted random one among all matching rules with matchMode: random.
+func (t Telecmd) ruleFromMessage(ctx context.Context, message *tgbotapi.Message) (Rule, bool) {
+	var matches []Rule
+	for i, rule := range t.config.Rules {
+		if err := ctx.Err(); err != nil {
+			log.Warn().Err(err).Msg("stopped matching rules")
+			return Rule{}, false
+		}
+		if rule.ScheduleOnly() {
+			continue
+		}
+
+		var groups []string
+		for _, pattern := range rule.PatternList() {
+			anchored := t.config.anchorPattern(rule, pattern)
+			re, err := regexp.Compile(anchored)
+			if err != nil {
+				log.Warn().Err(err).Str("pattern", anchored).Msg("skipping invalid pattern")
+				continue
+			}
+
+			var ok bool
+			groups, ok = findWithTimeout(ctx, re, message.Text, t.config.MatchTimeoutDuration())
+			if !ok {
+				log.Warn().Int("index", i).Str("rule", rule.Name).Str("pattern", pattern).Msg("skipping pattern, matching took too long")
+				continue
+			}
+			log.Debug().
+				Int("index", i).
+				Str("rule", rule.Name).
+				Str("pattern", anchored).
+				Bool("matched", groups != nil).
+				Msg("evaluated rule")
+			if groups != nil {
+				// the command sees the pattern that matched in TELEGRAM_RULE_PATTERN
+				rule.Pattern = pattern
+				break
+			}
+		}
+
+		if groups != nil && rule.ExcludePattern != "" {
+			re, err := regexp.Compile(rule.ExcludePattern)
+			if err != nil {
+				log.Warn().Err(err).Str("pattern", rule.ExcludePattern).Msg("skipping rule with invalid exclude pattern")
+				continue
+			}
+			excluded, ok := findWithTimeout(ctx, re, message.Text, t.config.MatchTimeoutDuration())
+			if !ok {
+				log.Warn().Int("index", i).Str("rule", rule.Name).Msg("skipping rule, matching the exclude pattern took too long")
+				continue
+			}
+			if excluded != nil {
+				log.Debug().Int("index", i).Str("rule", rule.Name).Msg("excluded by exclude pattern")
+				continue
+			}
+		}
+
+		if groups != nil && rule.IsReplyToBot && !t.isReplyToBot(message) {
+			log.Debug().Int("index", i).Str("rule", rule.Name).Msg("skipped, not a reply to the bot")
+			continue
+		}
+
+		if groups != nil {
+			log.Debug().Str("rule", rule.Name).Strs("groups", groups).Msg("captured groups")
+			if t.config.MatchMode != "random" {
+				return rule, true
+			}
+			matches = append(matches, rule)
+		}
+	}
+
+	if len(matches) == 0 {
+		return Rule{}, false
+	}
+	return t.rand.pickWeighted(matches), true
+}
+
+// findWithTimeout matches text against re, giving up after timeout or once ctx is done.
+// The match can't be interrupted, so it keeps running in the background after giving up.
+// Without a timeout it matches right away, ctx is checked between rules then.
+func findWithTimeout(ctx context.Context, re *regexp.Regexp, text string, timeout time.Duration) ([]string, bool) {
+	if timeout <= 0 {
+		return re.FindStringSubmatch(text), true
+	}
+
+	result := make(chan []string, 1)
+	go func() {
+		result <- re.FindStringSubmatch(text)
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case groups := <-result:
+		return groups, true
+	case <-expired:
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// isReplyToBot reports whether the message replies to one of the bot's own messages
+func (t Telecmd) isReplyToBot(message *tgbotapi.Message) bool {
+	reply := message.ReplyToMessage
+	if reply == nil || reply.From == nil || !reply.From.IsBot {
+		return false
+	}
+	return t.client() == nil || reply.From.ID == t.client().Self.ID
+}
+
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+func (l *lockedRand) pickWeighted(rules []Rule) Rule {
+	total := 0
+	for _, rule := range rules {
+		total += rule.RuleWeight()
+	}
+
+	l.mu.Lock()
+	n := l.r.Intn(total)
+	l.mu.Unlock()
+
+	for _, rule := range rules {
+		n -= rule.RuleWeight()
+		if n < 0 {
+			return rule
+		}
+	}
+	return rules[len(rules)-1]
+}
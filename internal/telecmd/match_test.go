@@ -0,0 +1,458 @@
+package telecmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleExcludePattern(t *testing.T) {
+	// long enough for the exclude pattern to take well over the match timeout
+	long := "/grep " + strings.Repeat("word ", 20000)
+
+	tests := []struct {
+		name         string
+		text         string
+		matchTimeout string
+		wantRun      bool
+	}{
+		{name: "excluded", text: "/grep secret"},
+		{name: "not excluded", text: "/grep public", wantRun: true},
+		{name: "slow exclude without timeout", text: long, wantRun: true},
+		{name: "slow exclude skips the rule", text: long, matchTimeout: "5ms"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := shellRule("grep", "/grep.*", "echo ran")
+			rule.ExcludePattern = `(?:\w*\s*){1,20}secret`
+			tc := New(Config{Rules: []Rule{rule}, MatchTimeout: tt.matchTimeout})
+
+			output, ok := handle(t, tc, tt.text)
+			if ran := ok && output == "ran\n"; ran != tt.wantRun {
+				t.Errorf("ran = %v with output %q, want %v", ran, output, tt.wantRun)
+			}
+		})
+	}
+}
+
+func TestFindWithTimeout(t *testing.T) {
+	re := regexp.MustCompile(`(?:\w*\s*){1,20}secret`)
+	long := strings.Repeat("word ", 20000)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		text      string
+		timeout   time.Duration
+		wantMatch bool
+		wantOK    bool
+	}{
+		{name: "match", ctx: context.Background(), text: "a secret", timeout: time.Second, wantMatch: true, wantOK: true},
+		{name: "no match", ctx: context.Background(), text: "public", timeout: time.Second, wantOK: true},
+		{name: "timed out", ctx: context.Background(), text: long, timeout: time.Millisecond},
+		{name: "cancelled", ctx: cancelled, text: long, timeout: time.Minute},
+		// without a timeout the match runs in place and finishes
+		{name: "no timeout", ctx: cancelled, text: "a secret", wantMatch: true, wantOK: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups, ok := findWithTimeout(tt.ctx, re, tt.text, tt.timeout)
+			if ok != tt.wantOK || (groups != nil) != tt.wantMatch {
+				t.Errorf("findWithTimeout() = %v, %v, want match %v, ok %v", groups, ok, tt.wantMatch, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRuleValidateEmptyMatch(t *testing.T) {
+	tests := []struct {
+		name            string
+		rule            Rule
+		allowEmptyMatch bool
+		wantErr         bool
+	}{
+		{name: "empty pattern", rule: Rule{Command: []string{"echo"}}, wantErr: true},
+		{name: "empty pattern allowed", rule: Rule{Command: []string{"echo"}}, allowEmptyMatch: true},
+		{name: "matches anything", rule: Rule{Pattern: ".*", Command: []string{"echo"}}, wantErr: true},
+		{name: "one of the patterns matches anything", rule: Rule{Patterns: []string{"/a", "x*"}, Command: []string{"echo"}}, wantErr: true},
+		{name: "matches anything allowed", rule: Rule{Pattern: ".*", Command: []string{"echo"}}, allowEmptyMatch: true},
+		{name: "matches every message with text", rule: Rule{Pattern: ".+", Command: []string{"echo"}}},
+		{name: "anchored to an empty message", rule: Rule{Pattern: "^$", Command: []string{"echo"}}},
+		{name: "schedule only", rule: Rule{Schedule: "1h", ScheduleChatID: 100, Command: []string{"echo"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.AllowEmptyMatch = tt.allowEmptyMatch
+			if err := tt.rule.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRuleFromMessageAnchorPatterns(t *testing.T) {
+	tests := []struct {
+		name          string
+		text          string
+		anchor        bool
+		anchorPattern *bool
+		wantMatch     bool
+	}{
+		{name: "substring without anchoring", text: "please don't deploy", wantMatch: true},
+		{name: "substring with anchoring", text: "please don't deploy", anchor: true},
+		{name: "whole message with anchoring", text: "deploy", anchor: true, wantMatch: true},
+		{name: "alternatives are anchored together", text: "release", anchor: true, wantMatch: true},
+		{name: "rule opts out", text: "please don't deploy", anchor: true, anchorPattern: ptr(false), wantMatch: true},
+		{name: "rule opts in", text: "please don't deploy", anchorPattern: ptr(true)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := shellRule("deploy", "deploy|release", "echo")
+			rule.AnchorPattern = tt.anchorPattern
+			tc := New(Config{Rules: []Rule{rule}, AnchorPatterns: tt.anchor})
+
+			_, matched := tc.ruleFromMessage(context.Background(), testMessage(tt.text))
+			if matched != tt.wantMatch {
+				t.Errorf("matched = %v, want %v", matched, tt.wantMatch)
+			}
+		})
+	}
+}
+
+// captureLogs writes debug logs to the returned buffer as JSON until the test ends
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := log.Logger
+	log.Logger = zerolog.New(&buf)
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	t.Cleanup(func() {
+		log.Logger = previous
+		zerolog.SetGlobalLevel(zerolog.Disabled)
+	})
+	return &buf
+}
+
+func TestRuleFromMessageTrace(t *testing.T) {
+	buf := captureLogs(t)
+
+	tc := New(Config{Rules: []Rule{
+		shellRule("status", "/status", "echo"),
+		shellRule("deploy", `/deploy (\w+)`, "echo"),
+		shellRule("echo", "/.*", "echo"),
+	}})
+	if _, ok := tc.ruleFromMessage(context.Background(), testMessage("/deploy prod")); !ok {
+		t.Fatal("no rule matched")
+	}
+
+	type entry struct {
+		Message string   `json:"message"`
+		Rule    string   `json:"rule"`
+		Matched *bool    `json:"matched"`
+		Groups  []string `json:"groups"`
+	}
+	var entries []entry
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var e entry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+
+	tests := []struct {
+		message string
+		rule    string
+		matched *bool
+		groups  []string
+	}{
+		{message: "evaluated rule", rule: "status", matched: ptr(false)},
+		{message: "evaluated rule", rule: "deploy", matched: ptr(true)},
+		{message: "captured groups", rule: "deploy", groups: []string{"/deploy prod", "prod"}},
+	}
+	if len(entries) != len(tests) {
+		t.Fatalf("logged %+v, want %d entries", entries, len(tests))
+	}
+	for i, tt := range tests {
+		got := entries[i]
+		if got.Message != tt.message || got.Rule != tt.rule || !reflect.DeepEqual(got.Matched, tt.matched) || !reflect.DeepEqual(got.Groups, tt.groups) {
+			t.Errorf("entry %d = %+v, want %+v", i, got, tt)
+		}
+	}
+}
+
+func TestRuleFromMessageRandom(t *testing.T) {
+	const picks = 3000
+
+	tests := []struct {
+		name      string
+		matchMode string
+		// want is the share of picks of each rule
+		want map[string]float64
+	}{
+		{name: "first", matchMode: "first", want: map[string]float64{"a": 1}},
+		{name: "random by weight", matchMode: "random", want: map[string]float64{"a": 0.25, "b": 0.5, "c": 0.25}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := shellRule("b", "hi", "echo")
+			b.Weight = 2
+			tc := New(Config{MatchMode: tt.matchMode, Rules: []Rule{
+				shellRule("a", "hi", "echo"),
+				b,
+				shellRule("c", "hi", "echo"),
+				shellRule("unmatched", "bye", "echo"),
+			}})
+			tc.rand = newLockedRand(1)
+
+			counts := map[string]int{}
+			for i := 0; i < picks; i++ {
+				rule, ok := tc.ruleFromMessage(context.Background(), testMessage("hi"))
+				if !ok {
+					t.Fatal("no rule matched")
+				}
+				counts[rule.Name]++
+			}
+
+			for name, count := range counts {
+				if _, ok := tt.want[name]; !ok {
+					t.Errorf("picked %s %d times, want never", name, count)
+				}
+			}
+			for name, share := range tt.want {
+				if got := float64(counts[name]) / picks; got < share-0.05 || got > share+0.05 {
+					t.Errorf("picked %s %.2f of the time, want %.2f", name, got, share)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleMaxMessageLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		limit   int
+		want    string
+		wantRan bool
+	}{
+		{name: "no limit", text: "/echo " + strings.Repeat("a", 1000), wantRan: true},
+		{name: "within the limit", text: "/echo abcd", limit: 10, wantRan: true},
+		{name: "characters, not bytes", text: "/echo çğüş", limit: 10, wantRan: true},
+		{name: "oversized", text: "/echo abcde", limit: 10, want: "message is too long, the limit is 10 characters"},
+		{name: "oversized without a matching rule", text: "hello there", limit: 10, want: "message is too long, the limit is 10 characters"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := filepath.Join(t.TempDir(), "ran")
+			rule := shellRule("echo", "/echo.*", "touch "+ran+"; echo ran")
+			tc := New(Config{Rules: []Rule{rule}, MaxMessageLength: tt.limit})
+
+			output, ok := handle(t, tc, tt.text)
+			if !ok {
+				t.Fatal("message wasn't handled")
+			}
+			if _, err := os.Stat(ran); (err == nil) != tt.wantRan {
+				t.Errorf("command ran = %v, want %v", err == nil, tt.wantRan)
+			}
+			if !tt.wantRan && output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleFromMessageIsReplyToBot(t *testing.T) {
+	tests := []struct {
+		name    string
+		replyTo *tgbotapi.Message
+		want    string
+	}{
+		{name: "reply to the bot", replyTo: &tgbotapi.Message{MessageID: 5, From: &tgbotapi.User{ID: 1, IsBot: true}}, want: "answer"},
+		{name: "reply to another bot", replyTo: &tgbotapi.Message{MessageID: 5, From: &tgbotapi.User{ID: 2, IsBot: true}}, want: "fallback"},
+		{name: "reply to a user", replyTo: &tgbotapi.Message{MessageID: 5, From: &tgbotapi.User{ID: 1}}, want: "fallback"},
+		{name: "not a reply", want: "fallback"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			answer := shellRule("answer", ".*", "echo")
+			answer.IsReplyToBot = true
+			// the fake bot's id is 1
+			tc := f.connect(t, New(Config{Rules: []Rule{answer, shellRule("fallback", ".*", "echo")}}), "token")
+
+			message := testMessage("yes")
+			message.ReplyToMessage = tt.replyTo
+			rule, ok := tc.ruleFromMessage(context.Background(), message)
+			if !ok || rule.Name != tt.want {
+				t.Errorf("matched %q, want %q", rule.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleUnmatchedReply(t *testing.T) {
+	const hint = "didn't understand that, try /help"
+
+	tests := []struct {
+		name      string
+		text      string
+		chatType  string
+		reply     string
+		wantReply string
+	}{
+		{name: "private chat", text: "hello", chatType: "private", reply: hint, wantReply: hint},
+		{name: "group", text: "hello", chatType: "group", reply: hint},
+		{name: "supergroup", text: "hello", chatType: "supergroup", reply: hint},
+		{name: "not configured", text: "hello", chatType: "private"},
+		{name: "matched", text: "/ping", chatType: "private", reply: hint, wantReply: "pong\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			tc := f.connect(t, New(Config{Rules: []Rule{shellRule("ping", "/ping", "echo pong")}, UnmatchedReply: tt.reply}), "token")
+
+			message := testMessage(tt.text)
+			message.Chat.Type = tt.chatType
+			tc.handleMessage(context.Background(), tgbotapi.Update{Message: message}, message)
+
+			var replies []string
+			for _, r := range f.sent("token", "sendMessage") {
+				replies = append(replies, r.params.Get("text"))
+			}
+			if tt.wantReply == "" && len(replies) > 0 {
+				t.Errorf("replied %q, want no reply", replies)
+			}
+			if tt.wantReply != "" && (len(replies) != 1 || replies[0] != tt.wantReply) {
+				t.Errorf("replied %q, want %q", replies, tt.wantReply)
+			}
+		})
+	}
+}
+
+func TestHandleBlankMessages(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		mode      string
+		document  bool
+		wantReply bool
+	}{
+		{name: "spaces", text: "   "},
+		{name: "newlines and tabs", text: "\n\t\n", mode: "skip"},
+		{name: "empty", text: ""},
+		{name: "handled", text: "   ", mode: "handle", wantReply: true},
+		{name: "text", text: " hi ", wantReply: true},
+		// uploads without a caption have no text
+		{name: "document without caption", document: true, wantReply: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			rule := shellRule("any", ".*", "echo ran")
+			rule.AllowEmptyMatch = true
+			tc := f.connect(t, New(Config{Rules: []Rule{rule}, BlankMessages: tt.mode}), "token")
+
+			message := testMessage(tt.text)
+			if tt.document {
+				message.Document = &tgbotapi.Document{FileID: "file", FileName: "notes.txt"}
+			}
+			tc.handleMessage(context.Background(), tgbotapi.Update{Message: message}, message)
+
+			if replied := len(f.sent("token", "sendMessage")) > 0; replied != tt.wantReply {
+				t.Errorf("replied = %v, want %v", replied, tt.wantReply)
+			}
+		})
+	}
+}
+
+func TestRuleFromMessagePatterns(t *testing.T) {
+	tests := []struct {
+		text        string
+		wantRule    string
+		wantPattern string
+		wantGroups  []string
+	}{
+		{text: "/deploy prod", wantRule: "deploy", wantPattern: `/deploy (\w+)`, wantGroups: []string{"/deploy prod", "prod"}},
+		{text: "ship prod now", wantRule: "deploy", wantPattern: `ship (\w+) (\w+)`, wantGroups: []string{"ship prod now", "prod", "now"}},
+		// the first matching pattern wins
+		{text: "/deploy ship it", wantRule: "deploy", wantPattern: `/deploy (\w+)`, wantGroups: []string{"/deploy ship", "ship"}},
+		{text: "/status", wantRule: "status", wantPattern: "/status", wantGroups: []string{"/status"}},
+		{text: "hello"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			buf := captureLogs(t)
+			deploy := shellRule("deploy", "", "echo")
+			deploy.Patterns = []string{`/deploy (\w+)`, `ship (\w+) (\w+)`}
+			tc := New(Config{Rules: []Rule{deploy, shellRule("status", "/status", "echo")}})
+
+			rule, ok := tc.ruleFromMessage(context.Background(), testMessage(tt.text))
+			if ok != (tt.wantRule != "") || rule.Name != tt.wantRule || rule.Pattern != tt.wantPattern {
+				t.Fatalf("matched %q with %q, want %q with %q", rule.Name, rule.Pattern, tt.wantRule, tt.wantPattern)
+			}
+
+			var groups []string
+			dec := json.NewDecoder(buf)
+			for dec.More() {
+				var e struct {
+					Message string   `json:"message"`
+					Groups  []string `json:"groups"`
+				}
+				if err := dec.Decode(&e); err != nil {
+					t.Fatal(err)
+				}
+				if e.Message == "captured groups" {
+					groups = e.Groups
+				}
+			}
+			if !reflect.DeepEqual(groups, tt.wantGroups) {
+				t.Errorf("groups = %q, want %q", groups, tt.wantGroups)
+			}
+		})
+	}
+}
+
+func TestRuleValidatePatterns(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Rule
+		wantErr bool
+	}{
+		{name: "pattern", rule: Rule{Pattern: "/a", Command: []string{"echo"}}},
+		{name: "patterns", rule: Rule{Patterns: []string{"/a", "/b"}, Command: []string{"echo"}}},
+		{name: "both", rule: Rule{Pattern: "/a", Patterns: []string{"/b"}, Command: []string{"echo"}}, wantErr: true},
+		{name: "invalid one of the patterns", rule: Rule{Patterns: []string{"/a", "(/b"}, Command: []string{"echo"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package telecmd
+
+import (
+	"fmt"
+	"text/template"
+)
+
+const (
+	messageCommandTimeout     = "commandTimeout"
+	messageCommandFailed      = "commandFailed"
+	messageFileTypeNotAllowed = "fileTypeNotAllowed"
+	messageBusy               = "busy"
+	messageRunning            = "running"
+	messageTooLong            = "messageTooLong"
+	messageStillWorking       = "stillWorking"
+	messageNotEnoughArgs      = "notEnoughArgs"
+	messageCommandCancelled   = "commandCancelled"
+	messageCancelled          = "cancelled"
+	messageNothingRunning     = "nothingRunning"
+	messageMaintenance        = "maintenance"
+	messageWhoami             = "whoami"
+	messageDuration           = "duration"
+	messageNotAuthorized      = "notAuthorized"
+	messageInvalidArgs        = "invalidArgs"
+)
+
+// defaultMessages are the built-in replies, overridable by key with Config.Messages
+var defaultMessages = map[string]string{
+	messageCommandTimeout:     "command took too long to finish",
+	messageCommandFailed:      "command exited with code={{.ExitCode}}{{if .Stderr}}\n\n{{.Stderr}}{{end}}{{if .Stdout}}\n\n{{.Stdout}}{{end}}",
+	messageFileTypeNotAllowed: "file type {{.MimeType}} is not allowed",
+	messageBusy:               "too busy right now, try again later",
+	messageRunning:            "running {{.Rule}}…",
+	messageTooLong:            "message is too long, the limit is {{.Limit}} characters",
+	messageStillWorking:       "still working… ({{.Elapsed}} elapsed)",
+	messageNotEnoughArgs:      "expected at least {{.MinArgs}} arguments, got {{.Args}}",
+	messageCommandCancelled:   "command was cancelled",
+	messageCancelled:          "cancelled {{.Count}} running command(s)",
+	messageNothingRunning:     "nothing is running",
+	messageMaintenance:        "in maintenance window, try again later",
+	messageDuration:           "\n\n(took {{.Duration}})",
+	messageNotAuthorized:      "you're not allowed to run this",
+	messageInvalidArgs:        "cannot split the message into arguments: {{.Error}}",
+	messageWhoami:             "chat id: {{.ChatID}}\nchat type: {{.ChatType}}\nuser id: {{.UserID}}\nusername: {{.Username}}{{if .ThreadID}}\nthread id: {{.ThreadID}}{{end}}",
+}
+
+func validateMessages(messages map[string]string) error {
+	for key, text := range messages {
+		if _, ok := defaultMessages[key]; !ok {
+			return fmt.Errorf("unknown message %q", key)
+		}
+		if _, err := template.New(key).Parse(text); err != nil {
+			return fmt.Errorf("invalid message %q: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func (c Config) Message(key string, data any) string {
+	text, ok := c.Messages[key]
+	if !ok {
+		text = defaultMessages[key]
+	}
+
+	rendered, err := renderTemplate(text, data)
+	if err != nil {
+		return text
+	}
+	return rendered
+}
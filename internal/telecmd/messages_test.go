@@ -0,0 +1,64 @@
+package telecmd
+
+import "testing"
+
+func TestConfigMessage(t *testing.T) {
+	messages := map[string]string{
+		messageCommandTimeout: "komut zaman aşımına uğradı",
+		messageNotEnoughArgs:  "en az {{.MinArgs}} argüman gerekli",
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		data any
+		want string
+	}{
+		{name: "overridden", key: messageCommandTimeout, want: "komut zaman aşımına uğradı"},
+		{name: "overridden template", key: messageNotEnoughArgs, data: map[string]any{"MinArgs": 2, "Args": 0}, want: "en az 2 argüman gerekli"},
+		{name: "default", key: messageNothingRunning, want: "nothing is running"},
+		{name: "default template", key: messageCancelled, data: map[string]any{"Count": 3}, want: "cancelled 3 running command(s)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (Config{Messages: messages}).Message(tt.key, tt.data); got != tt.want {
+				t.Errorf("Message() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleLocalizedMessage(t *testing.T) {
+	rule := shellRule("slow", "/slow", "exec sleep 5")
+	rule.Timeout = "50ms"
+	tc := New(Config{Rules: []Rule{rule}, Messages: map[string]string{messageCommandTimeout: "çok uzun sürdü"}})
+
+	output, ok := handle(t, tc, "/slow")
+	if !ok {
+		t.Fatal("rule didn't run")
+	}
+	if output != "çok uzun sürdü" {
+		t.Errorf("output = %q, want the overridden message", output)
+	}
+}
+
+func TestValidateMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages map[string]string
+		wantErr  bool
+	}{
+		{name: "known key", messages: map[string]string{messageBusy: "meşgul"}},
+		{name: "unknown key", messages: map[string]string{"greeting": "merhaba"}, wantErr: true},
+		{name: "invalid template", messages: map[string]string{messageBusy: "{{.Oops"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateMessages(tt.messages); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package telecmd
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func setNice(cmd *exec.Cmd, nice int) error {
+	return fmt.Errorf("nice is not supported on this platform")
+}
@@ -0,0 +1,50 @@
+//go:build unix
+
+package telecmd
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHandleNice(t *testing.T) {
+	out, err := exec.Command("nice").Output()
+	if err != nil {
+		t.Skipf("nice is not available: %v", err)
+	}
+	base, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base+5 > 19 {
+		t.Skipf("tests already run at niceness %d", base)
+	}
+
+	tests := []struct {
+		name   string
+		script string
+		want   int
+	}{
+		{name: "command", script: "nice", want: base + 5},
+		// children started by the command inherit the priority
+		{name: "child", script: "sh -c nice", want: base + 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := shellRule("nice", "/nice", tt.script)
+			rule.Nice = 5
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, "/nice")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if got := strings.TrimSpace(output); got != strconv.Itoa(tt.want) {
+				t.Errorf("niceness = %q, want %d", got, tt.want)
+			}
+		})
+	}
+}
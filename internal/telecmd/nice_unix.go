@@ -0,0 +1,20 @@
+//go:build unix
+
+package telecmd
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// setNice makes cmd start through nice, so it runs with the priority from its first instruction
+func setNice(cmd *exec.Cmd, nice int) error {
+	path, err := exec.LookPath("nice")
+	if err != nil {
+		return fmt.Errorf("failed to find nice: %w", err)
+	}
+	cmd.Args = append([]string{"nice", "-n", strconv.Itoa(nice), cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = path
+	return nil
+}
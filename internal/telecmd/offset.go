@@ -0,0 +1,110 @@
+package telecmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// readOffset returns the saved update offset, or 0 if nothing was saved yet
+func readOffset(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to read offset file: %w", err)
+	}
+
+	offset, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid offset: %w", err)
+	}
+	return offset, nil
+}
+
+func writeOffset(path string, offset int) error {
+	// write to a temp file first so a crash doesn't leave a partial offset behind
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create offset file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(strconv.Itoa(offset)); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write offset file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write offset file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace offset file: %w", err)
+	}
+	return nil
+}
+
+// offsetTracker saves the offset of the first update that isn't handled yet.
+// Updates are handled concurrently, so the saved offset stays at the oldest one in progress,
+// and updates interrupted by a restart are received again.
+type offsetTracker struct {
+	path string
+
+	mu      sync.Mutex
+	pending map[int]bool
+	// next is the offset after the last received update
+	next  int
+	saved int
+}
+
+// newOffsetTracker returns nil without a path, the methods of a nil tracker do nothing
+func newOffsetTracker(path string, offset int) *offsetTracker {
+	if path == "" {
+		return nil
+	}
+	return &offsetTracker{path: path, pending: make(map[int]bool), next: offset, saved: offset}
+}
+
+// receive marks the update as in progress
+func (o *offsetTracker) receive(updateID int) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.pending[updateID] = true
+	if updateID+1 > o.next {
+		o.next = updateID + 1
+	}
+}
+
+// finish marks the update as handled, or dropped, and saves the offset if it moved
+func (o *offsetTracker) finish(updateID int) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delete(o.pending, updateID)
+	offset := o.next
+	for id := range o.pending {
+		if id < offset {
+			offset = id
+		}
+	}
+	if offset <= o.saved {
+		return
+	}
+	if err := writeOffset(o.path, offset); err != nil {
+		log.Error().Err(err).Msg("failed to save update offset")
+		return
+	}
+	o.saved = offset
+}
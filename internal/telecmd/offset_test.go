@@ -0,0 +1,116 @@
+package telecmd
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOffsetTracker(t *testing.T) {
+	type step struct {
+		finish   bool
+		updateID int
+		// want is the saved offset after the step, 0 if nothing was saved yet
+		want int
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{name: "in order", steps: []step{
+			{updateID: 1}, {updateID: 2},
+			{finish: true, updateID: 1, want: 2},
+			{finish: true, updateID: 2, want: 3},
+		}},
+		{name: "later update finishes first", steps: []step{
+			{updateID: 1}, {updateID: 2}, {updateID: 3},
+			{finish: true, updateID: 3, want: 1},
+			{finish: true, updateID: 2, want: 1},
+			{finish: true, updateID: 1, want: 4},
+		}},
+		{name: "oldest update in progress holds the offset", steps: []step{
+			{updateID: 1}, {updateID: 2},
+			{finish: true, updateID: 2, want: 1},
+			{updateID: 3, want: 1},
+			{finish: true, updateID: 3, want: 1},
+			{finish: true, updateID: 1, want: 4},
+		}},
+		{name: "received while others finish", steps: []step{
+			{updateID: 1},
+			{finish: true, updateID: 1, want: 2},
+			{updateID: 2, want: 2}, {updateID: 3, want: 2},
+			{finish: true, updateID: 2, want: 3},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "offset")
+			tracker := newOffsetTracker(path, 0)
+
+			for i, s := range tt.steps {
+				if s.finish {
+					tracker.finish(s.updateID)
+				} else {
+					tracker.receive(s.updateID)
+				}
+				saved, err := readOffset(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if saved != s.want {
+					t.Fatalf("offset after step %d = %d, want %d", i, saved, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestOffsetTrackerWithoutFile(t *testing.T) {
+	tracker := newOffsetTracker("", 0)
+	// a nil tracker ignores updates
+	tracker.receive(1)
+	tracker.finish(1)
+}
+
+func TestRunSavesOffsetAfterHandling(t *testing.T) {
+	f := newFakeTelegram(t)
+	path := filepath.Join(t.TempDir(), "offset")
+	release := filepath.Join(t.TempDir(), "release")
+	// the command runs until the test lets it finish
+	rule := shellRule("slow", "/slow", fmt.Sprintf("while [ ! -e %q ]; do sleep 0.01; done; echo done", release))
+	tc := New(Config{BotToken: "token", OffsetFile: path, Rules: []Rule{rule}})
+	tc.newClient = f.newClient
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- tc.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	f.push("token", tgbotapi.Update{UpdateID: 7, Message: testMessage("/slow")})
+	waitFor(t, "command to start", func() bool {
+		tc.running.mu.Lock()
+		defer tc.running.mu.Unlock()
+		return len(tc.running.byChat) > 0
+	})
+	if saved, _ := readOffset(path); saved != 0 {
+		t.Errorf("offset = %d while the update is handled, want it unsaved", saved)
+	}
+
+	if err := os.WriteFile(release, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "offset", func() bool {
+		saved, _ := readOffset(path)
+		return saved == 8
+	})
+}
@@ -0,0 +1,73 @@
+package telecmd
+
+import (
+	"context"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOutboxDoesNotBlockHandlers(t *testing.T) {
+	const (
+		messages  = 4
+		sendDelay = 200 * time.Millisecond
+	)
+
+	tests := []struct {
+		name   string
+		outbox bool
+		// handled is whether all messages are handled before the first reply is sent
+		handled bool
+	}{
+		{name: "with outbox", outbox: true, handled: true},
+		{name: "sending right away", outbox: false, handled: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			f.setDelay("sendMessage", sendDelay)
+			tc := f.connect(t, New(Config{Rules: []Rule{shellRule("echo", "/echo.*", `echo "${1#/echo }"`)}}), "token")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.outbox {
+				tc.outbox = newOutbox()
+				tc.outbox.run(ctx)
+			}
+
+			start := time.Now()
+			for i := 1; i <= messages; i++ {
+				message := testMessage("/echo " + strconv.Itoa(i))
+				tc.handleMessage(ctx, tgbotapi.Update{Message: message}, message)
+			}
+			if handled := time.Since(start) < sendDelay; handled != tt.handled {
+				t.Errorf("handled %d messages in %s, want handled before the first reply %v", messages, time.Since(start), tt.handled)
+			}
+
+			waitFor(t, "replies", func() bool { return len(f.sent("token", "sendMessage")) == messages })
+			for i, r := range f.sent("token", "sendMessage") {
+				if got, want := r.params.Get("text"), strconv.Itoa(i+1)+"\n"; got != want {
+					t.Errorf("reply %d = %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOutboxTryPush(t *testing.T) {
+	o := newOutbox()
+	// nothing runs the outbox, so the queue of the chat fills up
+	for i := 0; i < outboxCapacity; i++ {
+		if !o.tryPush(1, func() {}) {
+			t.Fatalf("push %d was dropped before the queue was full", i)
+		}
+	}
+	if o.tryPush(1, func() {}) {
+		t.Error("push to a full queue was queued")
+	}
+	if !o.tryPush(2, func() {}) {
+		t.Error("push to another chat's queue was dropped")
+	}
+}
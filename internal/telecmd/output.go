@@ -0,0 +1,402 @@
+package telecmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/exp/slices"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+type jsonMessage struct {
+	Message        string           `json:"message"`
+	InlineKeyboard [][]inlineButton `json:"inlineKeyboard"`
+	ReplyKeyboard  *replyKeyboard   `json:"replyKeyboard"`
+	RemoveKeyboard bool             `json:"removeKeyboard"`
+	Entities       []messageEntity  `json:"entities"`
+	ParseMode      string           `json:"parseMode"`
+	Location       *jsonLocation    `json:"location"`
+	Venue          *jsonVenue       `json:"venue"`
+}
+
+type jsonLocation struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+func (l jsonLocation) Validate() error {
+	if l.Lat < -90 || l.Lat > 90 {
+		return fmt.Errorf("latitude %v is out of range", l.Lat)
+	}
+	if l.Lon < -180 || l.Lon > 180 {
+		return fmt.Errorf("longitude %v is out of range", l.Lon)
+	}
+	return nil
+}
+
+type jsonVenue struct {
+	jsonLocation
+	Title   string `json:"title"`
+	Address string `json:"address"`
+}
+
+func (v jsonVenue) Validate() error {
+	if v.Title == "" || v.Address == "" {
+		return fmt.Errorf("venue needs a title and an address")
+	}
+	return v.jsonLocation.Validate()
+}
+
+// messageEntity formats a part of the message, offset and length are in UTF-16 code units
+type messageEntity struct {
+	Type     string `json:"type"`
+	Offset   int    `json:"offset"`
+	Length   int    `json:"length"`
+	URL      string `json:"url"`
+	Language string `json:"language"`
+}
+
+func messageEntities(text string, entities []messageEntity) ([]tgbotapi.MessageEntity, error) {
+	textLength := len(utf16.Encode([]rune(text)))
+
+	var res []tgbotapi.MessageEntity
+	for i, e := range entities {
+		if e.Type == "" {
+			return nil, fmt.Errorf("entity %d has no type", i)
+		}
+		if e.Offset < 0 || e.Length <= 0 || e.Offset+e.Length > textLength {
+			return nil, fmt.Errorf("entity %d is out of bounds of the %d long message", i, textLength)
+		}
+		if e.Type == "text_link" && e.URL == "" {
+			return nil, fmt.Errorf("entity %d is a text_link without url", i)
+		}
+		res = append(res, tgbotapi.MessageEntity{
+			Type:     e.Type,
+			Offset:   e.Offset,
+			Length:   e.Length,
+			URL:      e.URL,
+			Language: e.Language,
+		})
+	}
+	return res, nil
+}
+
+func (j jsonMessage) chattable(rule Rule, chatID int64) tgbotapi.Chattable {
+	switch {
+	case j.Location != nil:
+		m := tgbotapi.NewLocation(chatID, j.Location.Lat, j.Location.Lon)
+		m.DisableNotification = rule.Silent
+		return m
+	case j.Venue != nil:
+		m := tgbotapi.NewVenue(chatID, j.Venue.Title, j.Venue.Address, j.Venue.Lat, j.Venue.Lon)
+		m.DisableNotification = rule.Silent
+		return m
+	}
+
+	m := tgbotapi.NewMessage(chatID, j.Message)
+	m.DisableNotification = rule.Silent
+	m.ParseMode = rule.ParseMode
+	if j.ParseMode != "" {
+		m.ParseMode = j.ParseMode
+	}
+	if j.Entities != nil {
+		// entities replace the parse mode
+		m.ParseMode = ""
+		entities, err := messageEntities(j.Message, j.Entities)
+		if err != nil {
+			log.Warn().Err(err).Msg("ignoring malformed entities")
+		} else {
+			m.Entities = entities
+		}
+	}
+	switch {
+	case j.InlineKeyboard != nil:
+		keyboard, err := inlineKeyboardMarkup(j.InlineKeyboard)
+		if err != nil {
+			log.Warn().Err(err).Msg("ignoring malformed inline keyboard")
+		} else {
+			m.ReplyMarkup = keyboard
+		}
+	case j.ReplyKeyboard != nil:
+		keyboard, err := j.ReplyKeyboard.Markup()
+		if err != nil {
+			log.Warn().Err(err).Msg("ignoring malformed reply keyboard")
+		} else {
+			m.ReplyMarkup = keyboard
+		}
+	case j.RemoveKeyboard || rule.RemoveKeyboard:
+		m.ReplyMarkup = tgbotapi.NewRemoveKeyboard(false)
+	}
+	return m
+}
+
+func looksLikeJSON(output string) bool {
+	trimmed := strings.TrimSpace(output)
+	return strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")
+}
+
+// isTextOutput reports whether the output is sent as plain text, which can be trimmed and decorated
+func isTextOutput(rule Rule, output string) bool {
+	switch rule.OutputType {
+	case "text":
+		return true
+	case "":
+		return !looksLikeJSON(output)
+	}
+	return false
+}
+
+// chattablesFromStdout turns command output into replies.
+// Output is either plain text, a JSON message object or an array of them to send in order.
+// Output that only looks like JSON is sent as plain text, unless the rule expects JSON output.
+// Rules with an outputType skip the guessing.
+func (c Config) chattablesFromStdout(rule Rule, chatID int64, output string) ([]tgbotapi.Chattable, error) {
+	rule.ParseMode = c.RuleParseMode(rule)
+
+	switch rule.OutputType {
+	case "text":
+		return textChattables(rule, chatID, output), nil
+	case "photo", "document", "voice":
+		if rule.OutputFileName != "" {
+			// stdout is the content of the file, uploads have no mime type, Telegram goes by the extension of the name
+			file := tgbotapi.FileBytes{Name: rule.OutputFileName, Bytes: []byte(output)}
+			return []tgbotapi.Chattable{fileChattable(rule, chatID, file)}, nil
+		}
+		path := strings.TrimSpace(output)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return []tgbotapi.Chattable{fileChattable(rule, chatID, tgbotapi.FilePath(path))}, nil
+		}
+		log.Warn().Str("output_type", rule.OutputType).Str("path", path).Msg("output is not a file, sending as plain text")
+		// failure replies aren't paths
+		return textChattables(rule, chatID, output), nil
+	}
+
+	messages, err := parseJSONMessages(output)
+	if err != nil {
+		if rule.JSONOutput || rule.OutputType == "json" {
+			return nil, fmt.Errorf("unknown output format: %w", err)
+		}
+		log.Debug().Err(err).Msg("sending output as plain text")
+		return textChattables(rule, chatID, output), nil
+	}
+
+	var chattables []tgbotapi.Chattable
+	for _, m := range messages {
+		chattables = append(chattables, m.chattable(rule, chatID))
+	}
+	return chattables, nil
+}
+
+// textChattables sends the output as plain text, long output is sent in several messages
+func textChattables(rule Rule, chatID int64, output string) []tgbotapi.Chattable {
+	var chattables []tgbotapi.Chattable
+	for _, chunk := range splitMessage(output, maxMessageLength) {
+		m := tgbotapi.NewMessage(chatID, chunk)
+		m.ParseMode = rule.ParseMode
+		m.DisableNotification = rule.Silent
+		if rule.RemoveKeyboard {
+			m.ReplyMarkup = tgbotapi.NewRemoveKeyboard(false)
+		}
+		chattables = append(chattables, m)
+	}
+	return chattables
+}
+
+// fileChattable sends the file as the rule's outputType
+func fileChattable(rule Rule, chatID int64, file tgbotapi.RequestFileData) tgbotapi.Chattable {
+	switch rule.OutputType {
+	case "photo":
+		m := tgbotapi.NewPhoto(chatID, file)
+		m.DisableNotification = rule.Silent
+		return m
+	case "voice":
+		m := tgbotapi.NewVoice(chatID, file)
+		m.DisableNotification = rule.Silent
+		return m
+	}
+	m := tgbotapi.NewDocument(chatID, file)
+	m.DisableNotification = rule.Silent
+	return m
+}
+
+func parseJSONMessages(output string) ([]jsonMessage, error) {
+	trimmed := strings.TrimSpace(output)
+
+	var messages []jsonMessage
+	switch {
+	case strings.HasPrefix(trimmed, "["):
+		if err := json.Unmarshal([]byte(trimmed), &messages); err != nil {
+			return nil, fmt.Errorf("invalid json: %w", err)
+		}
+	case strings.HasPrefix(trimmed, "{"):
+		var message jsonMessage
+		if err := json.Unmarshal([]byte(trimmed), &message); err != nil {
+			return nil, fmt.Errorf("invalid json: %w", err)
+		}
+		messages = append(messages, message)
+	default:
+		return nil, fmt.Errorf("not json")
+	}
+
+	for i, m := range messages {
+		if m.ParseMode != "" && !slices.Contains(parseModes, m.ParseMode) {
+			return nil, fmt.Errorf("message %d has invalid parse mode %q", i, m.ParseMode)
+		}
+		switch {
+		case m.Location != nil:
+			if err := m.Location.Validate(); err != nil {
+				return nil, fmt.Errorf("message %d has invalid location: %w", i, err)
+			}
+		case m.Venue != nil:
+			if err := m.Venue.Validate(); err != nil {
+				return nil, fmt.Errorf("message %d has invalid venue: %w", i, err)
+			}
+		case m.Message == "":
+			return nil, fmt.Errorf("message %d has no text", i)
+		}
+	}
+	return messages, nil
+}
+
+func withReplyTo(c tgbotapi.Chattable, messageID int) tgbotapi.Chattable {
+	switch v := c.(type) {
+	case tgbotapi.MessageConfig:
+		v.ReplyToMessageID = messageID
+		return v
+	case tgbotapi.VoiceConfig:
+		v.ReplyToMessageID = messageID
+		return v
+	case tgbotapi.PhotoConfig:
+		v.ReplyToMessageID = messageID
+		return v
+	case tgbotapi.DocumentConfig:
+		v.ReplyToMessageID = messageID
+		return v
+	case tgbotapi.LocationConfig:
+		v.ReplyToMessageID = messageID
+		return v
+	case tgbotapi.VenueConfig:
+		v.ReplyToMessageID = messageID
+		return v
+	}
+	return c
+}
+
+// sendToThread sends the message to a topic of a forum chat.
+// The chattables of this version of the bot API client have no field for the thread, so the request is built by hand.
+// Chattables threadRequest doesn't know fail instead of landing in the General topic.
+// The reply doesn't refer to the triggering message, which is likely in another topic.
+func (t Telecmd) sendToThread(ctx context.Context, c tgbotapi.Chattable, threadID int) (tgbotapi.Message, error) {
+	method, params, files, err := threadRequest(c, threadID)
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+
+	if chatID, ok := chatOf(c); ok {
+		if err := t.limiter.wait(ctx, chatID); err != nil {
+			return tgbotapi.Message{}, err
+		}
+	}
+	bot := t.client()
+	res, err := withContext(ctx, func() (*tgbotapi.APIResponse, error) {
+		for _, file := range files {
+			if file.Data.NeedsUpload() {
+				return bot.UploadFiles(method, params, files)
+			}
+		}
+		for _, file := range files {
+			params[file.Name] = file.Data.SendData()
+		}
+		return bot.MakeRequest(method, params)
+	})
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+
+	var sent tgbotapi.Message
+	if err := json.Unmarshal(res.Result, &sent); err != nil {
+		return tgbotapi.Message{}, fmt.Errorf("failed to decode sent message: %w", err)
+	}
+	return sent, nil
+}
+
+// threadRequest is the method, params and files of the request sending c to the thread, like the client's Request builds them
+func threadRequest(c tgbotapi.Chattable, threadID int) (string, tgbotapi.Params, []tgbotapi.RequestFile, error) {
+	var (
+		method string
+		chat   tgbotapi.BaseChat
+		files  []tgbotapi.RequestFile
+	)
+	params := tgbotapi.Params{}
+	var err error
+	switch v := c.(type) {
+	case tgbotapi.MessageConfig:
+		method, chat = "sendMessage", v.BaseChat
+		params.AddNonEmpty("text", v.Text)
+		params.AddNonEmpty("parse_mode", v.ParseMode)
+		params.AddBool("disable_web_page_preview", v.DisableWebPagePreview)
+		if len(v.Entities) > 0 {
+			err = params.AddInterface("entities", v.Entities)
+		}
+	case tgbotapi.PhotoConfig:
+		method, chat = "sendPhoto", v.BaseChat
+		files = []tgbotapi.RequestFile{{Name: "photo", Data: v.File}}
+		params.AddNonEmpty("caption", v.Caption)
+		params.AddNonEmpty("parse_mode", v.ParseMode)
+		if len(v.CaptionEntities) > 0 {
+			err = params.AddInterface("caption_entities", v.CaptionEntities)
+		}
+	case tgbotapi.DocumentConfig:
+		method, chat = "sendDocument", v.BaseChat
+		files = []tgbotapi.RequestFile{{Name: "document", Data: v.File}}
+		params.AddNonEmpty("caption", v.Caption)
+		params.AddNonEmpty("parse_mode", v.ParseMode)
+		params.AddBool("disable_content_type_detection", v.DisableContentTypeDetection)
+	case tgbotapi.VoiceConfig:
+		method, chat = "sendVoice", v.BaseChat
+		files = []tgbotapi.RequestFile{{Name: "voice", Data: v.File}}
+		params.AddNonZero("duration", v.Duration)
+		params.AddNonEmpty("caption", v.Caption)
+		params.AddNonEmpty("parse_mode", v.ParseMode)
+		if len(v.CaptionEntities) > 0 {
+			err = params.AddInterface("caption_entities", v.CaptionEntities)
+		}
+	case tgbotapi.LocationConfig:
+		method, chat = "sendLocation", v.BaseChat
+		params.AddNonZeroFloat("latitude", v.Latitude)
+		params.AddNonZeroFloat("longitude", v.Longitude)
+		params.AddNonZeroFloat("horizontal_accuracy", v.HorizontalAccuracy)
+		params.AddNonZero("live_period", v.LivePeriod)
+		params.AddNonZero("heading", v.Heading)
+		params.AddNonZero("proximity_alert_radius", v.ProximityAlertRadius)
+	case tgbotapi.VenueConfig:
+		method, chat = "sendVenue", v.BaseChat
+		params.AddNonZeroFloat("latitude", v.Latitude)
+		params.AddNonZeroFloat("longitude", v.Longitude)
+		params["title"] = v.Title
+		params["address"] = v.Address
+		params.AddNonEmpty("foursquare_id", v.FoursquareID)
+		params.AddNonEmpty("foursquare_type", v.FoursquareType)
+		params.AddNonEmpty("google_place_id", v.GooglePlaceID)
+		params.AddNonEmpty("google_place_type", v.GooglePlaceType)
+	default:
+		return "", nil, nil, fmt.Errorf("cannot send %T to a thread", c)
+	}
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	if err := params.AddFirstValid("chat_id", chat.ChatID, chat.ChannelUsername); err != nil {
+		return "", nil, nil, err
+	}
+	params.AddNonZero("message_thread_id", threadID)
+	params.AddBool("disable_notification", chat.DisableNotification)
+	if err := params.AddInterface("reply_markup", chat.ReplyMarkup); err != nil {
+		return "", nil, nil, err
+	}
+	return method, params, files, nil
+}
@@ -0,0 +1,571 @@
+package telecmd
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSendToThread(t *testing.T) {
+	tests := []struct {
+		name       string
+		chattable  tgbotapi.Chattable
+		wantMethod string
+		// wantParams are checked besides the chat and thread
+		wantParams map[string]string
+		wantErr    bool
+	}{
+		{
+			name:       "message",
+			chattable:  tgbotapi.NewMessage(100, "hello"),
+			wantMethod: "sendMessage",
+			wantParams: map[string]string{"text": "hello"},
+		},
+		{
+			name:       "uploaded photo",
+			chattable:  tgbotapi.NewPhoto(100, tgbotapi.FileBytes{Name: "chart.png", Bytes: []byte("png")}),
+			wantMethod: "sendPhoto",
+			wantParams: map[string]string{"photo": "chart.png"},
+		},
+		{
+			name:       "document by url",
+			chattable:  tgbotapi.NewDocument(100, tgbotapi.FileURL("https://example.com/report.pdf")),
+			wantMethod: "sendDocument",
+			wantParams: map[string]string{"document": "https://example.com/report.pdf"},
+		},
+		{
+			name:       "location",
+			chattable:  tgbotapi.NewLocation(100, 41.5, 29.25),
+			wantMethod: "sendLocation",
+			wantParams: map[string]string{"latitude": "41.500000", "longitude": "29.250000"},
+		},
+		{
+			name:       "venue",
+			chattable:  tgbotapi.NewVenue(100, "office", "main street", 41.5, 29.25),
+			wantMethod: "sendVenue",
+			wantParams: map[string]string{"title": "office", "address": "main street"},
+		},
+		{
+			name:      "unsupported",
+			chattable: tgbotapi.NewEditMessageText(100, 1, "edited"),
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			tc := f.connect(t, New(Config{}), "token")
+
+			_, err := tc.sendToThread(context.Background(), tt.chattable, 7)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if len(f.sent("token", "editMessageText")) != 0 {
+					t.Error("sent the unsupported request outside the thread")
+				}
+				return
+			}
+
+			sent := f.sent("token", tt.wantMethod)
+			if len(sent) != 1 {
+				t.Fatalf("sent %d %s requests, want 1", len(sent), tt.wantMethod)
+			}
+			params := sent[0].params
+			if params.Get("chat_id") != "100" || params.Get("message_thread_id") != "7" {
+				t.Errorf("sent to chat %s thread %s, want chat 100 thread 7", params.Get("chat_id"), params.Get("message_thread_id"))
+			}
+			for key, want := range tt.wantParams {
+				if got := params.Get(key); got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGeneratedRepliesIgnoreDefaultParseMode(t *testing.T) {
+	tests := []struct {
+		name          string
+		text          string
+		users         []int64
+		wantParseMode string
+	}{
+		{name: "command output", text: "/echo *hi*", wantParseMode: "MarkdownV2"},
+		{name: "unmatched reply", text: "hello_there", wantParseMode: ""},
+		{name: "message too long", text: "/echo " + strings.Repeat("_", 100), wantParseMode: ""},
+		{name: "not authorized", text: "/echo *hi*", users: []int64{1}, wantParseMode: ""},
+		{name: "command failed", text: "/fail", wantParseMode: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			echo := shellRule("echo", "/echo.*", `echo "$1"`)
+			echo.Users = tt.users
+			tc := f.connect(t, New(Config{
+				DefaultParseMode: "MarkdownV2",
+				UnmatchedReply:   "try /echo_me",
+				MaxMessageLength: 50,
+				Rules:            []Rule{echo, shellRule("fail", "/fail", "echo bad_thing >&2; exit 1")},
+			}), "token")
+
+			message := testMessage(tt.text)
+			tc.handleMessage(context.Background(), tgbotapi.Update{Message: message}, message)
+
+			sent := f.sent("token", "sendMessage")
+			if len(sent) != 1 {
+				t.Fatalf("sent %d replies, want 1", len(sent))
+			}
+			if got := sent[0].params.Get("parse_mode"); got != tt.wantParseMode {
+				t.Errorf("parse mode of %q = %q, want %q", sent[0].params.Get("text"), got, tt.wantParseMode)
+			}
+		})
+	}
+}
+
+func TestHandleBinaryOutput(t *testing.T) {
+	// a PNG signature with a NUL byte, printf takes octal escapes everywhere
+	const payload = "\x89PNG\r\n\x1a\n\x00\x01"
+	const script = `printf '\211PNG\r\n\032\n\000\001'`
+
+	tests := []struct {
+		outputType string
+		fileName   string
+		want       string
+	}{
+		{outputType: "document", fileName: "report.bin", want: "tgbotapi.DocumentConfig"},
+		{outputType: "photo", fileName: "chart.png", want: "tgbotapi.PhotoConfig"},
+		{outputType: "voice", fileName: "reply.ogg", want: "tgbotapi.VoiceConfig"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.outputType, func(t *testing.T) {
+			rule := shellRule("chart", "/chart", script)
+			rule.OutputType = tt.outputType
+			rule.OutputFileName = tt.fileName
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, "/chart")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			replies, err := tc.config.chattablesFromStdout(tc.config.Rules[0], 100, output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(replies) != 1 || fmt.Sprintf("%T", replies[0]) != tt.want {
+				t.Fatalf("replies = %#v, want one %s", replies, tt.want)
+			}
+
+			var file tgbotapi.RequestFileData
+			switch m := replies[0].(type) {
+			case tgbotapi.DocumentConfig:
+				file = m.File
+			case tgbotapi.PhotoConfig:
+				file = m.File
+			case tgbotapi.VoiceConfig:
+				file = m.File
+			}
+			data, ok := file.(tgbotapi.FileBytes)
+			if !ok {
+				t.Fatalf("file = %T, want bytes", file)
+			}
+			if data.Name != tt.fileName || string(data.Bytes) != payload {
+				t.Errorf("file = %q with %q, want %q with %q", data.Name, data.Bytes, tt.fileName, payload)
+			}
+		})
+	}
+}
+
+func TestSendBinaryOutput(t *testing.T) {
+	f := newFakeTelegram(t)
+	rule := shellRule("chart", "/chart", `printf '\211PNG\000'`)
+	rule.OutputType = "document"
+	rule.OutputFileName = "chart.png"
+	tc := f.connect(t, New(Config{Rules: []Rule{rule}}), "token")
+
+	message := testMessage("/chart")
+	tc.handleMessage(context.Background(), tgbotapi.Update{Message: message}, message)
+
+	sent := f.sent("token", "sendDocument")
+	if len(sent) != 1 {
+		t.Fatalf("sent %d documents, want 1", len(sent))
+	}
+	if name := sent[0].params.Get("document"); name != "chart.png" {
+		t.Errorf("uploaded %q, want chart.png", name)
+	}
+}
+
+func TestChattablesFromStdoutInlineKeyboard(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   tgbotapi.InlineKeyboardMarkup
+	}{
+		{
+			name:   "two rows",
+			output: `{"message": "pick", "inlineKeyboard": [[{"text": "yes", "callbackData": "y"}, {"text": "no", "callbackData": "n"}], [{"text": "docs", "url": "https://example.com"}]]}`,
+			want: tgbotapi.NewInlineKeyboardMarkup(
+				tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("yes", "y"), tgbotapi.NewInlineKeyboardButtonData("no", "n")),
+				tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonURL("docs", "https://example.com")),
+			),
+		},
+		{name: "button without action", output: `{"message": "pick", "inlineKeyboard": [[{"text": "yes"}]]}`},
+		{name: "button with both actions", output: `{"message": "pick", "inlineKeyboard": [[{"text": "yes", "callbackData": "y", "url": "https://example.com"}]]}`},
+		{name: "empty row", output: `{"message": "pick", "inlineKeyboard": [[]]}`},
+		{name: "long callback data", output: `{"message": "pick", "inlineKeyboard": [[{"text": "yes", "callbackData": "` + strings.Repeat("y", 65) + `"}]]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replies, err := Config{}.chattablesFromStdout(Rule{}, 100, tt.output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(replies) != 1 {
+				t.Fatalf("got %d replies, want 1", len(replies))
+			}
+			m, ok := replies[0].(tgbotapi.MessageConfig)
+			if !ok {
+				t.Fatalf("reply = %T, want a message", replies[0])
+			}
+			if m.Text != "pick" {
+				t.Errorf("text = %q, want pick", m.Text)
+			}
+
+			// malformed keyboards are dropped, the text is still sent
+			if len(tt.want.InlineKeyboard) == 0 {
+				if m.ReplyMarkup != nil {
+					t.Errorf("reply markup = %#v, want none", m.ReplyMarkup)
+				}
+				return
+			}
+			if !reflect.DeepEqual(m.ReplyMarkup, tt.want) {
+				t.Errorf("reply markup = %#v, want %#v", m.ReplyMarkup, tt.want)
+			}
+		})
+	}
+}
+
+func TestChattablesFromStdoutReplyKeyboard(t *testing.T) {
+	keyboard := tgbotapi.NewReplyKeyboard(
+		tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton("a"), tgbotapi.NewKeyboardButton("b")),
+		tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton("c")),
+	)
+	// the client resizes new keyboards, scripts ask for it
+	keyboard.ResizeKeyboard = false
+	oneTime := keyboard
+	oneTime.OneTimeKeyboard = true
+	oneTime.ResizeKeyboard = true
+
+	tests := []struct {
+		name           string
+		output         string
+		removeKeyboard bool
+		want           any
+	}{
+		{name: "keyboard", output: `{"message": "pick", "replyKeyboard": {"buttons": [["a", "b"], ["c"]]}}`, want: keyboard},
+		{name: "one time and resized", output: `{"message": "pick", "replyKeyboard": {"buttons": [["a", "b"], ["c"]], "oneTime": true, "resize": true}}`, want: oneTime},
+		{name: "no rows", output: `{"message": "pick", "replyKeyboard": {"buttons": []}}`},
+		{name: "empty button", output: `{"message": "pick", "replyKeyboard": {"buttons": [["a", ""]]}}`},
+		{name: "removed by the message", output: `{"message": "pick", "removeKeyboard": true}`, want: tgbotapi.NewRemoveKeyboard(false)},
+		{name: "removed by the rule", output: `{"message": "pick"}`, removeKeyboard: true, want: tgbotapi.NewRemoveKeyboard(false)},
+		{name: "keyboard instead of removing", output: `{"message": "pick", "replyKeyboard": {"buttons": [["a", "b"], ["c"]]}}`, removeKeyboard: true, want: keyboard},
+		{name: "kept by default", output: `{"message": "pick"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replies, err := Config{}.chattablesFromStdout(Rule{RemoveKeyboard: tt.removeKeyboard}, 100, tt.output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, ok := replies[0].(tgbotapi.MessageConfig)
+			if len(replies) != 1 || !ok {
+				t.Fatalf("replies = %#v, want one message", replies)
+			}
+			if !reflect.DeepEqual(m.ReplyMarkup, tt.want) {
+				t.Errorf("reply markup = %#v, want %#v", m.ReplyMarkup, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendKeepsKeyboardByDefault(t *testing.T) {
+	tests := []struct {
+		name           string
+		script         string
+		removeKeyboard bool
+		wantMarkup     string
+	}{
+		{name: "text", script: "echo hi"},
+		{name: "json", script: `echo '{"message": "hi"}'`},
+		{name: "failure", script: "exit 1"},
+		{name: "text with removeKeyboard", script: "echo hi", removeKeyboard: true, wantMarkup: `{"remove_keyboard":true}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			rule := shellRule("hi", "/hi", tt.script)
+			rule.RemoveKeyboard = tt.removeKeyboard
+			tc := f.connect(t, New(Config{Rules: []Rule{rule}}), "token")
+
+			message := testMessage("/hi")
+			tc.handleMessage(context.Background(), tgbotapi.Update{Message: message}, message)
+
+			sent := f.sent("token", "sendMessage")
+			if len(sent) != 1 {
+				t.Fatalf("sent %d replies, want 1", len(sent))
+			}
+			if got := sent[0].params.Get("reply_markup"); got != tt.wantMarkup {
+				t.Errorf("reply markup = %q, want %q", got, tt.wantMarkup)
+			}
+		})
+	}
+}
+
+func TestChattablesFromStdout(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []string
+	}{
+		{name: "plain text", output: "hello\nworld\n", want: []string{"hello\nworld\n"}},
+		{name: "single object", output: `{"message": "a"}`, want: []string{"a"}},
+		{name: "array", output: `[{"message": "a"}, {"message": "b"}, {"message": "c"}]`, want: []string{"a", "b", "c"}},
+		{name: "array with surrounding whitespace", output: "\n  [{\"message\": \"a\"}]\n", want: []string{"a"}},
+		{name: "array with an invalid message", output: `[{"message": "a"}, {"message": ""}]`, want: []string{`[{"message": "a"}, {"message": ""}]`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replies, err := Config{}.chattablesFromStdout(Rule{}, 100, tt.output)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, reply := range replies {
+				m, ok := reply.(tgbotapi.MessageConfig)
+				if !ok {
+					t.Fatalf("reply = %T, want a message", reply)
+				}
+				if m.ChatID != 100 {
+					t.Errorf("chat = %d, want 100", m.ChatID)
+				}
+				got = append(got, m.Text)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("texts = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChattablesFromStdoutOutputType(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.pdf")
+	if err := os.WriteFile(path, []byte("%PDF"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		outputType string
+		output     string
+		want       string
+		// wantFile is the path sent as a file, empty for text replies
+		wantFile string
+		wantText string
+	}{
+		{name: "text", outputType: "text", output: path + "\n", want: "tgbotapi.MessageConfig", wantText: path + "\n"},
+		{name: "text that looks like json", outputType: "text", output: `{"message": "a"}`, want: "tgbotapi.MessageConfig", wantText: `{"message": "a"}`},
+		{name: "photo", outputType: "photo", output: path + "\n", want: "tgbotapi.PhotoConfig", wantFile: path},
+		{name: "document", outputType: "document", output: "  " + path + "\n", want: "tgbotapi.DocumentConfig", wantFile: path},
+		{name: "voice", outputType: "voice", output: path, want: "tgbotapi.VoiceConfig", wantFile: path},
+		{name: "not a file", outputType: "document", output: "no such file\n", want: "tgbotapi.MessageConfig", wantText: "no such file\n"},
+		{name: "json", outputType: "json", output: `{"message": "a"}`, want: "tgbotapi.MessageConfig", wantText: "a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replies, err := Config{}.chattablesFromStdout(Rule{OutputType: tt.outputType}, 100, tt.output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(replies) != 1 || fmt.Sprintf("%T", replies[0]) != tt.want {
+				t.Fatalf("replies = %#v, want one %s", replies, tt.want)
+			}
+
+			var file tgbotapi.RequestFileData
+			switch m := replies[0].(type) {
+			case tgbotapi.MessageConfig:
+				if m.Text != tt.wantText {
+					t.Errorf("text = %q, want %q", m.Text, tt.wantText)
+				}
+				return
+			case tgbotapi.DocumentConfig:
+				file = m.File
+			case tgbotapi.PhotoConfig:
+				file = m.File
+			case tgbotapi.VoiceConfig:
+				file = m.File
+			}
+			if file != tgbotapi.FilePath(tt.wantFile) {
+				t.Errorf("file = %#v, want %q", file, tt.wantFile)
+			}
+		})
+	}
+}
+
+func TestSendJSONArrayInOrder(t *testing.T) {
+	f := newFakeTelegram(t)
+	rule := shellRule("multi", "/multi", `echo '[{"message": "first"}, {"message": "second"}, {"message": "third"}]'`)
+	tc := f.connect(t, New(Config{Rules: []Rule{rule}}), "token")
+
+	message := testMessage("/multi")
+	tc.handleMessage(context.Background(), tgbotapi.Update{Message: message}, message)
+
+	var texts []string
+	for _, r := range f.sent("token", "sendMessage") {
+		texts = append(texts, r.params.Get("text"))
+	}
+	if want := []string{"first", "second", "third"}; !reflect.DeepEqual(texts, want) {
+		t.Errorf("sent %q, want %q", texts, want)
+	}
+}
+
+func TestChattablesFromStdoutJSONLookalike(t *testing.T) {
+	tests := []struct {
+		name       string
+		output     string
+		jsonOutput bool
+		outputType string
+		want       string
+		wantErr    bool
+	}{
+		{name: "log line", output: "{level=info} started\n", want: "{level=info} started\n"},
+		{name: "object without a message", output: `{"status": "ok"}`, want: `{"status": "ok"}`},
+		{name: "bracketed text", output: "[2024-01-01] done\n", want: "[2024-01-01] done\n"},
+		{name: "strict jsonOutput", output: "{level=info} started\n", jsonOutput: true, wantErr: true},
+		{name: "strict outputType", output: `{"status": "ok"}`, outputType: "json", wantErr: true},
+		{name: "strict with valid json", output: `{"message": "hi"}`, jsonOutput: true, want: "hi"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := Rule{JSONOutput: tt.jsonOutput, OutputType: tt.outputType}
+			replies, err := Config{}.chattablesFromStdout(rule, 100, tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			m, ok := replies[0].(tgbotapi.MessageConfig)
+			if len(replies) != 1 || !ok {
+				t.Fatalf("replies = %#v, want one message", replies)
+			}
+			if m.Text != tt.want {
+				t.Errorf("text = %q, want %q", m.Text, tt.want)
+			}
+		})
+	}
+}
+
+func TestChattablesFromStdoutEntities(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []tgbotapi.MessageEntity
+	}{
+		{
+			name:   "bold and link",
+			output: `{"message": "deployed see logs", "parseMode": "MarkdownV2", "entities": [{"type": "bold", "offset": 0, "length": 8}, {"type": "text_link", "offset": 13, "length": 4, "url": "https://logs.example"}]}`,
+			want: []tgbotapi.MessageEntity{
+				{Type: "bold", Offset: 0, Length: 8},
+				{Type: "text_link", Offset: 13, Length: 4, URL: "https://logs.example"},
+			},
+		},
+		{
+			// offsets count UTF-16 code units, the emoji takes two
+			name:   "after an emoji",
+			output: `{"message": "🚀 done", "entities": [{"type": "italic", "offset": 3, "length": 4}]}`,
+			want:   []tgbotapi.MessageEntity{{Type: "italic", Offset: 3, Length: 4}},
+		},
+		{name: "out of bounds", output: `{"message": "done", "entities": [{"type": "bold", "offset": 2, "length": 5}]}`},
+		{name: "negative offset", output: `{"message": "done", "entities": [{"type": "bold", "offset": -1, "length": 2}]}`},
+		{name: "no type", output: `{"message": "done", "entities": [{"offset": 0, "length": 2}]}`},
+		{name: "link without url", output: `{"message": "done", "entities": [{"type": "text_link", "offset": 0, "length": 2}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replies, err := Config{DefaultParseMode: "HTML"}.chattablesFromStdout(Rule{}, 100, tt.output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, ok := replies[0].(tgbotapi.MessageConfig)
+			if len(replies) != 1 || !ok {
+				t.Fatalf("replies = %#v, want one message", replies)
+			}
+			if !reflect.DeepEqual(m.Entities, tt.want) {
+				t.Errorf("entities = %+v, want %+v", m.Entities, tt.want)
+			}
+			// entities replace the parse mode, even when they're malformed and dropped
+			if m.ParseMode != "" {
+				t.Errorf("parse mode = %q, want none with entities", m.ParseMode)
+			}
+		})
+	}
+}
+
+func TestChattablesFromStdoutLocation(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   tgbotapi.Chattable
+	}{
+		{name: "location", output: `{"location": {"lat": 41.01, "lon": 28.97}}`, want: tgbotapi.NewLocation(100, 41.01, 28.97)},
+		{
+			name:   "venue",
+			output: `{"venue": {"lat": 41.01, "lon": 28.97, "title": "office", "address": "main street 1"}}`,
+			want:   tgbotapi.NewVenue(100, "office", "main street 1", 41.01, 28.97),
+		},
+		{name: "bounds", output: `{"location": {"lat": -90, "lon": 180}}`, want: tgbotapi.NewLocation(100, -90, 180)},
+		// invalid replies are sent as they are
+		{name: "latitude out of range", output: `{"location": {"lat": 91, "lon": 0}}`, want: tgbotapi.NewMessage(100, `{"location": {"lat": 91, "lon": 0}}`)},
+		{name: "longitude out of range", output: `{"location": {"lat": 0, "lon": -181}}`, want: tgbotapi.NewMessage(100, `{"location": {"lat": 0, "lon": -181}}`)},
+		{
+			name:   "venue without address",
+			output: `{"venue": {"lat": 41.01, "lon": 28.97, "title": "office"}}`,
+			want:   tgbotapi.NewMessage(100, `{"venue": {"lat": 41.01, "lon": 28.97, "title": "office"}}`),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replies, err := Config{}.chattablesFromStdout(Rule{}, 100, tt.output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(replies) != 1 || !reflect.DeepEqual(replies[0], tt.want) {
+				t.Errorf("replies = %#v, want %#v", replies, tt.want)
+			}
+		})
+	}
+}
+
+func TestChattablesFromStdoutInvalidLocationStrict(t *testing.T) {
+	_, err := Config{}.chattablesFromStdout(Rule{JSONOutput: true}, 100, `{"location": {"lat": 91, "lon": 0}}`)
+	if err == nil {
+		t.Error("invalid coordinates weren't rejected")
+	}
+}
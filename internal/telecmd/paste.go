@@ -0,0 +1,63 @@
+package telecmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type PasteUpload struct {
+	URL   string `yaml:"url,omitempty"`
+	Field string `yaml:"field,omitempty"`
+}
+
+func (p PasteUpload) FieldName() string {
+	if p.Field != "" {
+		return p.Field
+	}
+	return "content"
+}
+
+// Upload posts content as a multipart form to the paste service and returns the link it responds with
+func (p PasteUpload) Upload(ctx context.Context, content string) (string, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if err := w.WriteField(p.FieldName(), content); err != nil {
+		return "", fmt.Errorf("failed to write form: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("failed to write form: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, &body)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+
+	client := http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload: %w", err)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, 4096))
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return "", fmt.Errorf("paste service responded with status %d", res.StatusCode)
+	}
+
+	link := strings.TrimSpace(string(b))
+	if link == "" {
+		return "", fmt.Errorf("paste service returned an empty response")
+	}
+	return link, nil
+}
@@ -0,0 +1,72 @@
+package telecmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHandlePasteUpload(t *testing.T) {
+	full := strings.Repeat("line\n", 10)
+
+	tests := []struct {
+		name       string
+		field      string
+		status     int
+		want       string
+		wantUpload bool
+	}{
+		{name: "uploaded", status: http.StatusOK, want: "line\nline\n\n…\n\nfull output: https://paste.example/abc", wantUpload: true},
+		{name: "custom field", field: "text", status: http.StatusOK, want: "line\nline\n\n…\n\nfull output: https://paste.example/abc", wantUpload: true},
+		{name: "upload failed", status: http.StatusInternalServerError, want: "line\nline\n\n…", wantUpload: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var uploaded string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				field := tt.field
+				if field == "" {
+					field = "content"
+				}
+				mu.Lock()
+				uploaded = r.FormValue(field)
+				mu.Unlock()
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte("https://paste.example/abc\n"))
+			}))
+			defer server.Close()
+
+			rule := shellRule("log", "/log", `printf 'line\n%.0s' 1 2 3 4 5 6 7 8 9 10`)
+			rule.MaxOutputLength = 10
+			tc := New(Config{Rules: []Rule{rule}, PasteUpload: &PasteUpload{URL: server.URL, Field: tt.field}})
+
+			output, ok := handle(t, tc, "/log")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if (uploaded == full) != tt.wantUpload {
+				t.Errorf("uploaded %q, want the full output uploaded %v", uploaded, tt.wantUpload)
+			}
+		})
+	}
+}
+
+func TestHandleTruncateWithoutPaste(t *testing.T) {
+	rule := shellRule("log", "/log", `printf 'line\n%.0s' 1 2 3`)
+	rule.MaxOutputLength = 10
+	tc := New(Config{Rules: []Rule{rule}})
+
+	output, _ := handle(t, tc, "/log")
+	if output != "line\nline\n\n…" {
+		t.Errorf("output = %q, want the preview", output)
+	}
+}
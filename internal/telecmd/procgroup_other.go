@@ -0,0 +1,8 @@
+//go:build !unix
+
+package telecmd
+
+import "os/exec"
+
+// setProcessGroup does nothing, only the command itself is killed when it's cancelled
+func setProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,123 @@
+package telecmd
+
+import (
+	"context"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+const (
+	queuePolicyBlock      = "block"
+	queuePolicyDropOldest = "drop-oldest"
+	queuePolicyRejectNew  = "reject-new"
+)
+
+// busyReplyInterval is how long a chat told that the bot is busy isn't told again
+const busyReplyInterval = 30 * time.Second
+
+// enqueue adds the update to the queue, applying the queue policy when it's full
+func (t Telecmd) enqueue(ctx context.Context, queue chan tgbotapi.Update, update tgbotapi.Update) {
+	switch t.config.QueuePolicy {
+	case queuePolicyDropOldest:
+		for {
+			select {
+			case queue <- update:
+				return
+			default:
+			}
+
+			select {
+			case dropped := <-queue:
+				log.Warn().Int("update_id", dropped.UpdateID).Msg("queue is full, dropped oldest update")
+				t.offsets.finish(dropped.UpdateID)
+			default:
+			}
+		}
+	case queuePolicyRejectNew:
+		select {
+		case queue <- update:
+		default:
+			log.Warn().Int("update_id", update.UpdateID).Msg("queue is full, rejected update")
+			t.offsets.finish(update.UpdateID)
+			t.replyBusy(ctx, update)
+		}
+	default:
+		select {
+		case queue <- update:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// replyBusy tells the chat of a rejected update that the bot is busy,
+// only if the update would've run something and the chat wasn't told recently
+func (t Telecmd) replyBusy(ctx context.Context, update tgbotapi.Update) {
+	if t.paused.Load() {
+		return
+	}
+	t = t.current()
+
+	message := update.Message
+	if message == nil {
+		message = update.ChannelPost
+	}
+	if message == nil || message.Chat == nil {
+		return
+	}
+	message = withCaption(message)
+	if t.skipReason(message) != "" || !t.wouldRun(ctx, message) {
+		return
+	}
+	if !t.busy.allow(message.Chat.ID, time.Now()) {
+		return
+	}
+
+	m := tgbotapi.NewMessage(message.Chat.ID, t.config.Message(messageBusy, nil))
+	m.ReplyToMessageID = message.MessageID
+	queued := t.outbox.tryPush(message.Chat.ID, func() {
+		if _, err := t.send(ctx, m); err != nil {
+			log.Error().Err(err).Msg("failed to reply")
+		}
+	})
+	if !queued {
+		log.Warn().Int64("chat_id", message.Chat.ID).Msg("outbox is full, dropped busy reply")
+	}
+}
+
+// wouldRun reports whether the message is a built-in command or matches a rule
+func (t Telecmd) wouldRun(ctx context.Context, message *tgbotapi.Message) bool {
+	if t.config.Builtins.enabled(t.builtinCommand(message)) {
+		return true
+	}
+	_, ok := t.ruleFromMessage(ctx, message)
+	return ok
+}
+
+// busyReplies remembers when chats were last told that the bot is busy
+type busyReplies struct {
+	mu   sync.Mutex
+	last map[int64]time.Time
+}
+
+func newBusyReplies() *busyReplies {
+	return &busyReplies{last: make(map[int64]time.Time)}
+}
+
+// allow reports whether the chat can be told again and records the reply if so
+func (b *busyReplies) allow(chatID int64, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for id, at := range b.last {
+		if now.Sub(at) >= busyReplyInterval {
+			delete(b.last, id)
+		}
+	}
+	if _, ok := b.last[chatID]; ok {
+		return false
+	}
+	b.last[chatID] = now
+	return true
+}
@@ -0,0 +1,120 @@
+package telecmd
+
+import (
+	"context"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnqueueSaturated(t *testing.T) {
+	tests := []struct {
+		policy string
+		// freeSlot makes a worker take an update while enqueue waits
+		freeSlot  bool
+		wantQueue []int
+		wantBusy  bool
+	}{
+		{policy: queuePolicyBlock, wantQueue: []int{1, 2}},
+		{policy: queuePolicyBlock, freeSlot: true, wantQueue: []int{2, 3}},
+		{policy: queuePolicyDropOldest, wantQueue: []int{2, 3}},
+		{policy: queuePolicyRejectNew, wantQueue: []int{1, 2}, wantBusy: true},
+	}
+
+	for _, tt := range tests {
+		name := tt.policy
+		if tt.freeSlot {
+			name += " until a slot is free"
+		}
+		t.Run(name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			tc := f.connect(t, New(Config{QueuePolicy: tt.policy, Rules: []Rule{shellRule("cmd", "/cmd", "true")}}), "token")
+
+			queue := make(chan tgbotapi.Update, 2)
+			for id := 1; id <= 2; id++ {
+				tc.enqueue(context.Background(), queue, tgbotapi.Update{UpdateID: id, Message: testMessage("/cmd")})
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			if tt.freeSlot {
+				go func() {
+					time.Sleep(20 * time.Millisecond)
+					<-queue
+				}()
+			}
+			start := time.Now()
+			tc.enqueue(ctx, queue, tgbotapi.Update{UpdateID: 3, Message: testMessage("/cmd")})
+			if tt.policy == queuePolicyBlock && !tt.freeSlot && time.Since(start) < 100*time.Millisecond {
+				t.Error("block returned before the context was done")
+			}
+
+			close(queue)
+			var got []int
+			for update := range queue {
+				got = append(got, update.UpdateID)
+			}
+			if len(got) != len(tt.wantQueue) || got[0] != tt.wantQueue[0] || got[1] != tt.wantQueue[1] {
+				t.Errorf("queue = %v, want %v", got, tt.wantQueue)
+			}
+
+			if tt.wantBusy {
+				waitFor(t, "busy reply", func() bool { return len(f.sent("token", "sendMessage")) == 1 })
+				reply := f.sent("token", "sendMessage")[0]
+				if reply.params.Get("text") != "too busy right now, try again later" || reply.params.Get("reply_to_message_id") != "1" {
+					t.Errorf("unexpected busy reply %v", reply.params)
+				}
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+			if sent := f.sent("token", "sendMessage"); len(sent) != 0 {
+				t.Errorf("sent %d replies, want none", len(sent))
+			}
+		})
+	}
+}
+
+func TestReplyBusy(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		texts  []string
+		paused bool
+		want   int
+	}{
+		{name: "matching rule", texts: []string{"/cmd"}, want: 1},
+		{name: "once per chat", texts: []string{"/cmd", "/cmd", "/cmd"}, want: 1},
+		{name: "enabled builtin", config: Config{Builtins: Builtins{Whoami: true}}, texts: []string{"/whoami"}, want: 1},
+		{name: "disabled builtin", texts: []string{"/whoami"}},
+		{name: "no matching rule", texts: []string{"hello"}},
+		{name: "blank message", texts: []string{" "}},
+		{name: "filtered chat", config: Config{ChatAllow: "^200$"}, texts: []string{"/cmd"}},
+		{name: "paused", texts: []string{"/cmd"}, paused: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			config := tt.config
+			config.QueuePolicy = queuePolicyRejectNew
+			config.Rules = []Rule{shellRule("cmd", "/cmd", "true")}
+			tc := f.connect(t, New(config), "token")
+			tc.paused.Store(tt.paused)
+
+			// a full queue rejects every update
+			queue := make(chan tgbotapi.Update)
+			for i, text := range tt.texts {
+				message := testMessage(text)
+				if strings.HasPrefix(text, "/") {
+					message = commandMessage(text)
+				}
+				tc.enqueue(context.Background(), queue, tgbotapi.Update{UpdateID: i + 1, Message: message})
+			}
+
+			if sent := f.sent("token", "sendMessage"); len(sent) != tt.want {
+				t.Errorf("sent %d busy replies, want %d", len(sent), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package telecmd
+
+import "os"
+
+func rotateSignals() []os.Signal {
+	return nil
+}
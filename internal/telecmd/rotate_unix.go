@@ -0,0 +1,12 @@
+//go:build unix
+
+package telecmd
+
+import (
+	"os"
+	"syscall"
+)
+
+func rotateSignals() []os.Signal {
+	return []os.Signal{syscall.SIGUSR1}
+}
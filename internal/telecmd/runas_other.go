@@ -0,0 +1,28 @@
+//go:build !unix
+
+package telecmd
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func credentialFor(runAs string) (any, error) {
+	return nil, fmt.Errorf("runAs is not supported on this platform")
+}
+
+func setRunAs(cmd *exec.Cmd, runAs string) error {
+	if runAs == "" {
+		return nil
+	}
+	_, err := credentialFor(runAs)
+	return err
+}
+
+func chownRunAs(path string, runAs string) error {
+	if runAs == "" {
+		return nil
+	}
+	_, err := credentialFor(runAs)
+	return err
+}
@@ -0,0 +1,144 @@
+//go:build unix
+
+package telecmd
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestRunAsOwnsFiles(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing owners needs root")
+	}
+	const runAs = "12345:23456"
+
+	tests := []struct {
+		name string
+		// create returns the path the command uses and removes it
+		create func(t *testing.T, rule Rule) string
+	}{
+		{name: "state dir", create: func(t *testing.T, rule Rule) string {
+			tc := New(Config{Rules: []Rule{rule}, StateDir: t.TempDir()})
+			if _, err := tc.commandFromMessage(context.Background(), tc.config.Rules[0], testMessage("/x")); err != nil {
+				t.Fatal(err)
+			}
+			return tc.config.RuleStateDir(tc.config.Rules[0])
+		}},
+		{name: "created working dir", create: func(t *testing.T, rule Rule) string {
+			rule.WorkingDirectory = filepath.Join(t.TempDir(), "work")
+			rule.CreateWorkingDir = true
+			tc := New(Config{Rules: []Rule{rule}, StateDir: t.TempDir()})
+			if _, err := tc.commandFromMessage(context.Background(), tc.config.Rules[0], testMessage("/x")); err != nil {
+				t.Fatal(err)
+			}
+			return rule.WorkingDirectory
+		}},
+		{name: "downloaded file", create: func(t *testing.T, rule Rule) string {
+			path, err := saveTempFile(strings.NewReader("content"), "upload.txt", rule.RunAs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.Remove(path) })
+			return path
+		}},
+		{name: "script file", create: func(t *testing.T, rule Rule) string {
+			rule.Script = "print('hi')"
+			rule.Interpreter = "python3"
+			_, path, err := scriptCommand(rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.Remove(path) })
+			return path
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := shellRule("x", "/x", "true")
+			rule.RunAs = runAs
+			path := tt.create(t, rule)
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stat := info.Sys().(*syscall.Stat_t)
+			if stat.Uid != 12345 || stat.Gid != 23456 {
+				t.Errorf("owner = %d:%d, want %s", stat.Uid, stat.Gid, runAs)
+			}
+		})
+	}
+}
+
+func TestCreateWorkingDirKeepsExistingOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing owners needs root")
+	}
+
+	dir := t.TempDir()
+	rule := shellRule("x", "/x", "true")
+	rule.RunAs = "12345:23456"
+	rule.WorkingDirectory = dir
+	rule.CreateWorkingDir = true
+	tc := New(Config{Rules: []Rule{rule}, StateDir: t.TempDir()})
+	if _, err := tc.commandFromMessage(context.Background(), tc.config.Rules[0], testMessage("/x")); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat := info.Sys().(*syscall.Stat_t); stat.Uid != 0 {
+		t.Errorf("owner of the existing dir changed to %d", stat.Uid)
+	}
+}
+
+func TestSetRunAs(t *testing.T) {
+	tests := []struct {
+		name    string
+		runAs   string
+		want    *syscall.Credential
+		wantErr bool
+	}{
+		{name: "not set", runAs: ""},
+		{name: "uid and gid", runAs: "1000:1001", want: &syscall.Credential{Uid: 1000, Gid: 1001}},
+		{name: "username", runAs: "root", want: &syscall.Credential{Uid: 0, Gid: 0}},
+		{name: "unknown user", runAs: "telecmd-no-such-user", wantErr: true},
+		{name: "invalid uid", runAs: "me:1001", wantErr: true},
+		{name: "invalid gid", runAs: "1000:us", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command("true")
+			err := setRunAs(cmd, tt.runAs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+
+			var got *syscall.Credential
+			if cmd.SysProcAttr != nil {
+				got = cmd.SysProcAttr.Credential
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("credential = %+v, want %+v", got, tt.want)
+			}
+
+			// unknown users are rejected when the config is loaded
+			rule := shellRule("x", "/x", "true")
+			rule.RunAs = tt.runAs
+			if err := rule.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+//go:build unix
+
+package telecmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// credentialFor resolves a username or uid:gid pair to a credential
+func credentialFor(runAs string) (*syscall.Credential, error) {
+	uid, gid, ok := strings.Cut(runAs, ":")
+	if !ok {
+		u, err := user.Lookup(runAs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find user: %w", err)
+		}
+		uid, gid = u.Uid, u.Gid
+	}
+
+	parsedUID, err := strconv.ParseUint(uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid %q: %w", uid, err)
+	}
+	parsedGID, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid %q: %w", gid, err)
+	}
+
+	return &syscall.Credential{Uid: uint32(parsedUID), Gid: uint32(parsedGID)}, nil
+}
+
+func setRunAs(cmd *exec.Cmd, runAs string) error {
+	if runAs == "" {
+		return nil
+	}
+
+	credential, err := credentialFor(runAs)
+	if err != nil {
+		return err
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = credential
+	return nil
+}
+
+// chownRunAs hands the path over to the user the rule runs as, so the command can use it
+func chownRunAs(path string, runAs string) error {
+	if runAs == "" {
+		return nil
+	}
+
+	credential, err := credentialFor(runAs)
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(path, int(credential.Uid), int(credential.Gid)); err != nil {
+		return fmt.Errorf("failed to change owner: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package telecmd
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// schedule is when a scheduled rule runs, either every interval or daily at a time of day
+type schedule struct {
+	every  time.Duration
+	hour   int
+	minute int
+}
+
+func parseSchedule(s string) (schedule, error) {
+	if every, err := time.ParseDuration(s); err == nil {
+		if every <= 0 {
+			return schedule{}, fmt.Errorf("invalid schedule %q, interval must be positive", s)
+		}
+		return schedule{every: every}, nil
+	}
+
+	at, err := time.Parse("15:04", s)
+	if err != nil {
+		return schedule{}, fmt.Errorf("invalid schedule %q, must be an interval like 1h or a time of day like 02:30", s)
+	}
+	return schedule{hour: at.Hour(), minute: at.Minute()}, nil
+}
+
+// next is the first time after now the schedule fires, times of day are in the location of now
+func (s schedule) next(now time.Time) time.Time {
+	if s.every > 0 {
+		return now.Add(s.every)
+	}
+
+	next := time.Date(now.Year(), now.Month(), now.Day(), s.hour, s.minute, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// runSchedules runs the rules with a schedule in the background until ctx is cancelled.
+// Schedules are read at startup, reloading the config doesn't change them.
+// Outputs are sent with the current client, so they follow token rotations.
+// With several bots, each scheduled rule runs on the first bot that has it.
+func (t Telecmd) runSchedules(ctx context.Context) {
+	for _, rule := range t.config.Rules {
+		if rule.Schedule == "" || t.scheduledElsewhere[rule.Name] {
+			continue
+		}
+		sched, err := parseSchedule(rule.Schedule)
+		if err != nil {
+			log.Error().Err(err).Str("rule", rule.Name).Msg("skipping scheduled rule")
+			continue
+		}
+		go t.runSchedule(ctx, rule, sched)
+	}
+}
+
+func (t Telecmd) runSchedule(ctx context.Context, rule Rule, sched schedule) {
+	for {
+		timer := time.NewTimer(time.Until(sched.next(t.config.Now())))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		t.runScheduled(ctx, rule)
+	}
+}
+
+// runScheduled runs the rule with an empty message and sends its output to the rule's scheduleChatId
+func (t Telecmd) runScheduled(ctx context.Context, rule Rule) {
+	if t.config.InMaintenance(time.Now()) {
+		log.Info().Str("rule", rule.Name).Msg("skipping scheduled rule in maintenance window")
+		return
+	}
+
+	log.Info().Str("rule", rule.Name).Msg("running scheduled rule")
+	message := &tgbotapi.Message{
+		Date: int(time.Now().Unix()),
+		Chat: &tgbotapi.Chat{ID: rule.ScheduleChatID},
+	}
+
+	result := t.runRule(ctx, tgbotapi.Update{Message: message}, rule, message, t.config.RuleTimeout(rule, true))
+	if !result.ok || result.output == "" {
+		return
+	}
+	if result.generated {
+		rule = rule.asText()
+	}
+	output := result.output
+
+	replies, err := t.config.chattablesFromStdout(rule, rule.ScheduleChatID, output)
+	if err != nil {
+		log.Error().Err(err).Msg("cannot parse stdout")
+		return
+	}
+	for _, m := range replies {
+		if rule.ReplyThreadID != 0 {
+			_, err = t.sendToThread(ctx, m, rule.ReplyThreadID)
+		} else {
+			_, err = t.send(ctx, m)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("rule", rule.Name).Msg("failed to send scheduled output")
+			t.stats.recordError(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package telecmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNextInTimezone(t *testing.T) {
+	// 22:30 UTC is 07:30 the next day in Tokyo
+	now := time.Date(2024, 3, 10, 22, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		timezone string
+		schedule string
+		want     time.Time
+	}{
+		{name: "later today in the zone", timezone: "Asia/Tokyo", schedule: "09:00", want: time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{name: "already passed in the zone", timezone: "Asia/Tokyo", schedule: "07:00", want: time.Date(2024, 3, 11, 22, 0, 0, 0, time.UTC)},
+		{name: "utc", timezone: "UTC", schedule: "23:00", want: time.Date(2024, 3, 10, 23, 0, 0, 0, time.UTC)},
+		{name: "intervals ignore the zone", timezone: "Asia/Tokyo", schedule: "1h", want: time.Date(2024, 3, 10, 23, 30, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sched, err := parseSchedule(tt.schedule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := Config{Timezone: tt.timezone}
+
+			got := sched.next(now.In(config.Location()))
+			if !got.Equal(tt.want) {
+				t.Errorf("next = %v, want %v", got.UTC(), tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigValidateTimezone(t *testing.T) {
+	tests := []struct {
+		timezone string
+		wantErr  bool
+	}{
+		{timezone: ""},
+		{timezone: "UTC"},
+		{timezone: "Europe/Istanbul"},
+		{timezone: "Mars/Olympus_Mons", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.timezone, func(t *testing.T) {
+			config := Config{Timezone: tt.timezone, Rules: []Rule{shellRule("x", "/x", "true")}}
+			if err := config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package telecmd
+
+import (
+	"context"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+const (
+	// Telegram allows about one message per second to the same chat and 30 per second overall
+	sendIntervalPerChat = time.Second
+	sendIntervalGlobal  = time.Second / 30
+
+	// replies to different chats are sent in parallel by this many senders
+	outboxSenders = 4
+	// replies waiting for each sender before handlers block
+	outboxCapacity = 64
+)
+
+// sendLimiter paces sending so bursts of replies don't hit Telegram's rate limits.
+// Each send reserves the next free slot of its chat and of the bot, and waits for it.
+type sendLimiter struct {
+	mu       sync.Mutex
+	next     time.Time
+	chatNext map[int64]time.Time
+
+	perChat, global time.Duration
+}
+
+func newSendLimiter() *sendLimiter {
+	return &sendLimiter{
+		chatNext: make(map[int64]time.Time),
+		perChat:  sendIntervalPerChat,
+		global:   sendIntervalGlobal,
+	}
+}
+
+// wait blocks until a message can be sent to the chat or ctx is done, it doesn't wait for a nil limiter
+func (l *sendLimiter) wait(ctx context.Context, chatID int64) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	at := now
+	if l.next.After(at) {
+		at = l.next
+	}
+	if chatNext := l.chatNext[chatID]; chatNext.After(at) {
+		at = chatNext
+	}
+	l.next = at.Add(l.global)
+	l.chatNext[chatID] = at.Add(l.perChat)
+
+	if len(l.chatNext) > 1000 {
+		for id, next := range l.chatNext {
+			if next.Before(now) {
+				delete(l.chatNext, id)
+			}
+		}
+	}
+	l.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// send sends c with the bot once the rate limits allow it, all messages should go through here.
+// It gives up once ctx is done, a request already made may still arrive.
+func (t Telecmd) send(ctx context.Context, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	if chatID, ok := chatOf(c); ok {
+		if err := t.limiter.wait(ctx, chatID); err != nil {
+			return tgbotapi.Message{}, err
+		}
+	}
+	bot := t.client()
+	return withContext(ctx, func() (tgbotapi.Message, error) {
+		return bot.Send(c)
+	})
+}
+
+// withContext runs a request of the bot client, which doesn't take a context, and stops waiting for it once ctx is done.
+// The request keeps running in the background after giving up.
+func withContext[T any](ctx context.Context, request func() (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	if ctx.Done() == nil {
+		return request()
+	}
+
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := request()
+		done <- result{value: value, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+func chatOf(c tgbotapi.Chattable) (int64, bool) {
+	switch v := c.(type) {
+	case tgbotapi.MessageConfig:
+		return v.ChatID, true
+	case tgbotapi.VoiceConfig:
+		return v.ChatID, true
+	case tgbotapi.PhotoConfig:
+		return v.ChatID, true
+	case tgbotapi.DocumentConfig:
+		return v.ChatID, true
+	case tgbotapi.EditMessageTextConfig:
+		return v.ChatID, true
+	case tgbotapi.LocationConfig:
+		return v.ChatID, true
+	case tgbotapi.VenueConfig:
+		return v.ChatID, true
+	}
+	return 0, false
+}
+
+// outbox sends replies in the background, so handlers can run the next command
+// while replies wait for rate limits or slow requests.
+// Replies to the same chat go to the same sender to keep their order.
+type outbox struct {
+	queues []chan func()
+}
+
+func newOutbox() *outbox {
+	o := &outbox{queues: make([]chan func(), outboxSenders)}
+	for i := range o.queues {
+		o.queues[i] = make(chan func(), outboxCapacity)
+	}
+	return o
+}
+
+// run sends queued replies until ctx is cancelled
+func (o *outbox) run(ctx context.Context) {
+	for _, queue := range o.queues {
+		go func(queue chan func()) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case send := <-queue:
+					send()
+				}
+			}
+		}(queue)
+	}
+}
+
+// push queues send for the chat, a nil outbox sends right away
+func (o *outbox) push(ctx context.Context, chatID int64, send func()) {
+	if o == nil {
+		send()
+		return
+	}
+
+	i := chatID % int64(len(o.queues))
+	if i < 0 {
+		i = -i
+	}
+	select {
+	case o.queues[i] <- send:
+	case <-ctx.Done():
+		log.Warn().Err(ctx.Err()).Int64("chat_id", chatID).Msg("dropping reply")
+	}
+}
+
+// tryPush queues send for the chat unless its sender is full, a nil outbox sends right away
+func (o *outbox) tryPush(chatID int64, send func()) bool {
+	if o == nil {
+		send()
+		return true
+	}
+
+	i := chatID % int64(len(o.queues))
+	if i < 0 {
+		i = -i
+	}
+	select {
+	case o.queues[i] <- send:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,308 @@
+package telecmd
+
+import (
+	"context"
+	"errors"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSendPacesBurst(t *testing.T) {
+	tests := []struct {
+		name  string
+		chats []int64
+		// span is the least time between the first and the last send
+		span time.Duration
+		// within is how long the whole burst may take
+		within time.Duration
+	}{
+		{name: "same chat", chats: []int64{1, 1, 1, 1, 1}, span: 160 * time.Millisecond, within: time.Second},
+		{name: "different chats", chats: []int64{1, 2, 3, 4, 5}, span: 40 * time.Millisecond, within: 500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			tc := f.connect(t, New(Config{}), "token")
+			tc.limiter = newSendLimiter()
+			tc.limiter.perChat = 40 * time.Millisecond
+			tc.limiter.global = 10 * time.Millisecond
+
+			start := time.Now()
+			var wg sync.WaitGroup
+			for _, chatID := range tt.chats {
+				chatID := chatID
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := tc.send(context.Background(), tgbotapi.NewMessage(chatID, "hi")); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+			if elapsed := time.Since(start); elapsed > tt.within {
+				t.Errorf("burst took %s, want at most %s", elapsed, tt.within)
+			}
+
+			sent := f.sent("token", "sendMessage")
+			if len(sent) != len(tt.chats) {
+				t.Fatalf("sent %d messages, want %d", len(sent), len(tt.chats))
+			}
+			// allow some jitter of the requests
+			const jitter = 10 * time.Millisecond
+			first, last := sent[0].at, sent[0].at
+			for _, r := range sent {
+				if r.at.Before(first) {
+					first = r.at
+				}
+				if r.at.After(last) {
+					last = r.at
+				}
+			}
+			if span := last.Sub(first); span < tt.span-jitter {
+				t.Errorf("sends were spread over %s, want at least %s", span, tt.span)
+			}
+		})
+	}
+}
+
+func TestSendStopsWaitingWhenCancelled(t *testing.T) {
+	f := newFakeTelegram(t)
+	tc := f.connect(t, New(Config{}), "token")
+	tc.limiter = newSendLimiter()
+	tc.limiter.perChat = time.Hour
+
+	if _, err := tc.send(context.Background(), tgbotapi.NewMessage(1, "first")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := tc.send(ctx, tgbotapi.NewMessage(1, "second"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("send waited %s after the context was done", elapsed)
+	}
+	if sent := f.sent("token", "sendMessage"); len(sent) != 1 {
+		t.Errorf("sent %d messages, want only the first", len(sent))
+	}
+}
+
+func TestSendReplyEditsOrSends(t *testing.T) {
+	tests := []struct {
+		name     string
+		edit     bool
+		threadID int
+		// editable is false when the rule replied with several messages
+		editable bool
+		want     []string
+	}{
+		{name: "reply", editable: true, want: []string{"sendMessage reply", "sendMessage reply"}},
+		{name: "thread", threadID: 7, editable: true, want: []string{"sendMessage thread 7", "sendMessage thread 7"}},
+		{name: "edit in place", edit: true, editable: true, want: []string{"sendMessage reply", "editMessageText 1"}},
+		{name: "edit in place in thread", edit: true, threadID: 7, editable: true, want: []string{"sendMessage thread 7", "editMessageText 1"}},
+		{name: "several replies aren't edited", edit: true, want: []string{"sendMessage reply", "sendMessage reply"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			rule := Rule{Name: "report", EditInPlace: tt.edit, ReplyThreadID: tt.threadID}
+			tc := f.connect(t, New(Config{Rules: []Rule{rule}}), "token")
+			rule = tc.config.Rules[0]
+
+			for i := 0; i < 2; i++ {
+				if err := tc.sendReply(context.Background(), rule, testMessage("/report"), tgbotapi.NewMessage(100, "report"), tt.editable); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var got []string
+			f.mu.Lock()
+			for _, r := range f.requests {
+				switch {
+				case r.method == "editMessageText":
+					got = append(got, r.method+" "+r.params.Get("message_id"))
+				case r.params.Get("message_thread_id") != "":
+					got = append(got, r.method+" thread "+r.params.Get("message_thread_id"))
+				case r.params.Get("reply_to_message_id") == "1":
+					got = append(got, r.method+" reply")
+				default:
+					got = append(got, r.method)
+				}
+			}
+			f.mu.Unlock()
+			if strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+				t.Errorf("requests = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleShowCommand(t *testing.T) {
+	tests := []struct {
+		name        string
+		showCommand bool
+		want        []string
+	}{
+		{name: "shown", showCommand: true, want: []string{"running check…", "out\n"}},
+		{name: "not shown by default", want: []string{"out\n"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			rule := shellRule("check", "/check", "sleep 0.1; echo out")
+			rule.ShowCommand = tt.showCommand
+			tc := f.connect(t, New(Config{Rules: []Rule{rule}}), "token")
+
+			message := testMessage("/check")
+			tc.handleMessage(context.Background(), tgbotapi.Update{Message: message}, message)
+
+			sent := f.sent("token", "sendMessage")
+			var texts []string
+			for _, r := range sent {
+				texts = append(texts, r.params.Get("text"))
+				if r.params.Get("reply_to_message_id") != "1" {
+					t.Errorf("sent %v, want a reply to the message", r.params)
+				}
+			}
+			if !reflect.DeepEqual(texts, tt.want) {
+				t.Fatalf("sent %q, want %q", texts, tt.want)
+			}
+			// the notice isn't held back until the command is done
+			if tt.showCommand && sent[1].at.Sub(sent[0].at) < 50*time.Millisecond {
+				t.Errorf("notice sent %s before the output, want it sent while the command runs", sent[1].at.Sub(sent[0].at))
+			}
+		})
+	}
+}
+
+func TestHandleSilent(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		silent bool
+		method string
+	}{
+		{name: "text", script: "echo hi", silent: true, method: "sendMessage"},
+		{name: "json", script: `echo '{"message": "hi"}'`, silent: true, method: "sendMessage"},
+		{name: "location", script: `echo '{"location": {"lat": 41, "lon": 29}}'`, silent: true, method: "sendLocation"},
+		{name: "failure", script: "exit 1", silent: true, method: "sendMessage"},
+		{name: "not silent by default", script: "echo hi", method: "sendMessage"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			rule := shellRule("quiet", "/quiet", tt.script)
+			rule.Silent = tt.silent
+			tc := f.connect(t, New(Config{Rules: []Rule{rule}}), "token")
+
+			message := testMessage("/quiet")
+			tc.handleMessage(context.Background(), tgbotapi.Update{Message: message}, message)
+
+			sent := f.sent("token", tt.method)
+			if len(sent) != 1 {
+				t.Fatalf("sent %d %s requests, want 1", len(sent), tt.method)
+			}
+			if silent := sent[0].params.Get("disable_notification") == "true"; silent != tt.silent {
+				t.Errorf("silent = %v, want %v", silent, tt.silent)
+			}
+		})
+	}
+}
+
+func TestHandleWarnAfter(t *testing.T) {
+	tests := []struct {
+		name      string
+		script    string
+		warnAfter string
+		want      []string
+	}{
+		{name: "slow", script: "sleep 0.5; echo done", warnAfter: "100ms", want: []string{"still working… (100ms elapsed)", "done\n"}},
+		{name: "fast", script: "echo done", warnAfter: "200ms", want: []string{"done\n"}},
+		{name: "disabled", script: "sleep 0.2; echo done", want: []string{"done\n"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			rule := shellRule("slow", "/slow", tt.script)
+			rule.WarnAfter = tt.warnAfter
+			tc := f.connect(t, New(Config{Rules: []Rule{rule}}), "token")
+
+			message := testMessage("/slow")
+			tc.handleMessage(context.Background(), tgbotapi.Update{Message: message}, message)
+			// a warning would have fired by now if it wasn't stopped with the command
+			time.Sleep(300 * time.Millisecond)
+
+			var texts []string
+			for _, r := range f.sent("token", "sendMessage") {
+				texts = append(texts, r.params.Get("text"))
+			}
+			if !reflect.DeepEqual(texts, tt.want) {
+				t.Errorf("sent %q, want %q", texts, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{d: 1234567 * time.Nanosecond, want: "1ms"},
+		{d: 456789 * time.Microsecond, want: "457ms"},
+		{d: 1234 * time.Millisecond, want: "1.2s"},
+		{d: 83260 * time.Millisecond, want: "1m23.3s"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := formatDuration(tt.d); got != tt.want {
+				t.Errorf("formatDuration(%v) = %q, want %q", tt.d, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleShowDuration(t *testing.T) {
+	tests := []struct {
+		name         string
+		script       string
+		showDuration bool
+		want         string
+	}{
+		{name: "off by default", script: "echo done", want: `^done\n$`},
+		{name: "footer", script: "echo done", showDuration: true, want: `^done\n\n\(took \d+ms\)$`},
+		{name: "on failure", script: "echo bad >&2; exit 1", showDuration: true, want: `^command exited with code=1\n\nbad\n\n\(took \d+ms\)$`},
+		{name: "json output is left as is", script: `echo '{"message": "hi"}'`, showDuration: true, want: `^\{"message": "hi"\}\n$`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := shellRule("slow", "/slow", tt.script)
+			rule.ShowDuration = tt.showDuration
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, "/slow")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if !regexp.MustCompile(tt.want).MatchString(output) {
+				t.Errorf("output = %q, want to match %s", output, tt.want)
+			}
+		})
+	}
+}
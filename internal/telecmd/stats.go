@@ -0,0 +1,84 @@
+package telecmd
+
+import (
+	"fmt"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type stats struct {
+	startedAt   time.Time
+	commandsRun atomic.Int64
+	inFlight    atomic.Int64
+
+	mu          sync.Mutex
+	lastError   string
+	lastErrorAt time.Time
+	// commandsByTag counts commands run by the tags of their rules
+	commandsByTag map[string]int64
+}
+
+func newStats() *stats {
+	return &stats{startedAt: time.Now(), commandsByTag: make(map[string]int64)}
+}
+
+func (s *stats) recordRun(tags []string) {
+	s.commandsRun.Add(1)
+	if len(tags) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tag := range tags {
+		s.commandsByTag[tag]++
+	}
+}
+
+// tagCounts returns a copy of the command counts by tag
+func (s *stats) tagCounts() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]int64, len(s.commandsByTag))
+	for tag, n := range s.commandsByTag {
+		counts[tag] = n
+	}
+	return counts
+}
+
+func (s *stats) recordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err.Error()
+	s.lastErrorAt = time.Now()
+}
+
+func (s *stats) render(ruleCount int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "uptime: %s\n", time.Since(s.startedAt).Round(time.Second))
+	fmt.Fprintf(&sb, "rules: %d\n", ruleCount)
+	fmt.Fprintf(&sb, "commands run: %d\n", s.commandsRun.Load())
+	fmt.Fprintf(&sb, "in flight: %d\n", s.inFlight.Load())
+	if counts := s.tagCounts(); len(counts) > 0 {
+		tags := maps.Keys(counts)
+		slices.Sort(tags)
+		for i, tag := range tags {
+			tags[i] = fmt.Sprintf("%s=%d", tag, counts[tag])
+		}
+		fmt.Fprintf(&sb, "commands by tag: %s\n", strings.Join(tags, ", "))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastError == "" {
+		sb.WriteString("last error: none")
+	} else {
+		fmt.Fprintf(&sb, "last error: %s (%s)", s.lastError, s.lastErrorAt.Format(time.RFC3339))
+	}
+
+	return sb.String()
+}
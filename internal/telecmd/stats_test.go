@@ -0,0 +1,89 @@
+package telecmd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsRender(t *testing.T) {
+	tests := []struct {
+		name  string
+		seed  func(s *stats)
+		rules int
+		want  []string
+	}{
+		{
+			name:  "fresh",
+			rules: 2,
+			want:  []string{"uptime: 1h30m0s", "rules: 2", "commands run: 0", "in flight: 0", "last error: none"},
+		},
+		{
+			name: "seeded",
+			seed: func(s *stats) {
+				s.recordRun([]string{"deploy"})
+				s.recordRun([]string{"deploy", "prod"})
+				s.recordRun(nil)
+				s.inFlight.Add(2)
+				s.recordError(errors.New("command took too long to finish"))
+			},
+			rules: 5,
+			want: []string{
+				"uptime: 1h30m0s",
+				"rules: 5",
+				"commands run: 3",
+				"in flight: 2",
+				"commands by tag: deploy=2, prod=1",
+				"last error: command took too long to finish (",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStats()
+			s.startedAt = time.Now().Add(-90 * time.Minute)
+			if tt.seed != nil {
+				tt.seed(s)
+			}
+
+			lines := strings.Split(s.render(tt.rules), "\n")
+			if len(lines) != len(tt.want) {
+				t.Fatalf("rendered %q, want %d lines", lines, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.HasPrefix(lines[i], want) {
+					t.Errorf("line %d = %q, want prefix %q", i, lines[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestStatusCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		admins  []int64
+		wantOK  bool
+	}{
+		{name: "admin", enabled: true, admins: []int64{42}, wantOK: true},
+		{name: "not an admin", enabled: true, admins: []int64{1}},
+		{name: "disabled", admins: []int64{42}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := New(Config{Builtins: Builtins{Status: tt.enabled}, Admins: tt.admins, Rules: []Rule{shellRule("echo", "/echo", "echo")}})
+
+			reply, ok := tc.builtinReply(commandMessage("/status"))
+			if ok != tt.wantOK {
+				t.Fatalf("replied = %v with %q, want %v", ok, reply, tt.wantOK)
+			}
+			if ok && !strings.Contains(reply, "rules: 1\n") {
+				t.Errorf("reply = %q, want the status", reply)
+			}
+		})
+	}
+}
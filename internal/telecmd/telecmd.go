@@ -1,6 +1,7 @@
 package telecmd
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -12,127 +13,810 @@ import (
 	"io"
 	"os"
 	"os/exec"
-	"regexp"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
+// commandWaitDelay is how long a cancelled command's output is read after it's killed
+const commandWaitDelay = 2 * time.Second
+
 type Telecmd struct {
 	config Config
+	stats  *stats
+	events *eventHub
+	// bot is shared by the copies of telecmd, so they all switch to the new client when the token rotates
+	bot  *atomic.Pointer[tgbotapi.BotAPI]
+	rand *lockedRand
+	// replies are the last replies of rules with editInPlace
+	replies *lastReplies
+	// limiter paces messages sent by the bot
+	limiter *sendLimiter
+	// outbox sends replies in the background, set while polling
+	outbox *outbox
+	// reloaded is the config passed to Reload, if any
+	reloaded *atomic.Pointer[Config]
+	// botName is the name of the bot in Config.Bots this copy runs
+	botName string
+	// scheduledElsewhere are the scheduled rules another bot runs, so they don't run once per bot
+	scheduledElsewhere map[string]bool
+	// paused updates are received but not handled
+	paused *atomic.Bool
+	// loader reads the config again for reloading, if set
+	loader func() (Config, error)
+	// running are the commands in flight, for /cancel
+	running *runningCommands
+	// flights coalesce identical triggers of rules with singleFlight
+	flights *flights
+	// busy limits the busy replies of the reject-new queue policy
+	busy *busyReplies
+	// offsets saves the offset of handled updates to the offset file, set while polling
+	offsets *offsetTracker
+	// threads are the topic ids of received messages, for /whoami
+	threads *messageThreads
+	// newClient creates the bot client for a token, tgbotapi.NewBotAPI unless replaced in tests
+	newClient func(token string) (*tgbotapi.BotAPI, error)
 }
 
 func New(config Config) Telecmd {
-	return Telecmd{config: config}
+	config.Rules = config.OrderedRules()
+
+	return Telecmd{
+		config:   config,
+		stats:    newStats(),
+		rand:     newLockedRand(time.Now().UnixNano()),
+		replies:  newLastReplies(),
+		paused:   &atomic.Bool{},
+		reloaded: &atomic.Pointer[Config]{},
+		running:  newRunningCommands(),
+		flights:  newFlights(),
+		busy:     newBusyReplies(),
+		threads:  newMessageThreads(),
+	}
+}
+
+// Reload replaces the config used for handling new messages.
+// Settings only read at startup, like the token and the event socket, keep their values.
+func (t Telecmd) Reload(config Config) {
+	config.Rules = config.OrderedRules()
+	t.reloaded.Store(&config)
+}
+
+// current returns a copy of telecmd using the last reloaded config
+func (t Telecmd) current() Telecmd {
+	config := t.reloaded.Load()
+	if config == nil {
+		return t
+	}
+
+	reloaded := t
+	reloaded.config = *config
+	if t.botName == "" {
+		return reloaded
+	}
+	for _, bot := range config.Bots {
+		if bot.Name == t.botName {
+			return reloaded.forBot(bot)
+		}
+	}
+	return t
 }
 
 func (t Telecmd) Run(ctx context.Context) error {
-	bot, err := tgbotapi.NewBotAPI(t.config.BotToken)
+	if t.config.EventSocket != "" {
+		hub, err := listenEvents(ctx, t.config.EventSocket)
+		if err != nil {
+			return fmt.Errorf("failed to open event socket: %w", err)
+		}
+		t.events = hub
+	}
+
+	if t.config.AdminAddr != "" {
+		if err := t.serveAdmin(ctx, t.config.AdminAddr); err != nil {
+			return fmt.Errorf("failed to start admin api: %w", err)
+		}
+	}
+
+	if len(t.config.Bots) > 0 {
+		return t.runBots(ctx)
+	}
+	return t.runBot(ctx)
+}
+
+func (t Telecmd) runBot(ctx context.Context) error {
+	bot, err := t.newBotAPI()
 	if err != nil {
-		return fmt.Errorf("failed to create bot: %w", err)
+		return err
 	}
-	bot.Debug = t.config.Debug
+	// each bot polled by this process gets its own client
+	t.bot = &atomic.Pointer[tgbotapi.BotAPI]{}
+	t.bot.Store(bot)
+	t.limiter = newSendLimiter()
+	t.outbox = newOutbox()
+	t.outbox.run(ctx)
+
+	offset := 0
+	if t.config.OffsetFile != "" {
+		if offset, err = readOffset(t.config.OffsetFile); err != nil {
+			return err
+		}
+	}
+
+	t.offsets = newOffsetTracker(t.config.OffsetFile, offset)
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-	u.AllowedUpdates = []string{"message", "callback_query"}
+	u := tgbotapi.NewUpdate(offset)
+	u.Timeout = int(t.config.PollTimeoutDuration().Seconds())
+	u.AllowedUpdates = t.config.UpdateTypes()
 	updatesChan := bot.GetUpdatesChan(u)
 
 	procPool := pool.New().WithMaxGoroutines(4)
 
-	log.Info().Msg("listening")
+	// updates wait in the queue while all workers are busy
+	queue := make(chan tgbotapi.Update, t.config.QueueCapacity())
+	go func(handler Telecmd) {
+		for update := range queue {
+			update := update
+			procPool.Go(func() {
+				defer handler.offsets.finish(update.UpdateID)
+				handler.handleUpdate(ctx, update)
+			})
+		}
+	}(t)
+
+	if t.config.Heartbeat != nil {
+		go t.runHeartbeat(ctx, *t.config.Heartbeat)
+	}
+	t.runSchedules(ctx)
+
+	rotate, stopRotate := t.watchTokenFile(ctx)
+	defer stopRotate()
+
+	log.Info().Str("bot", bot.Self.UserName).Msg("listening")
+
+	receive := func(update tgbotapi.Update) {
+		if update.UpdateID < u.Offset {
+			// the old client received it too after the new one took over
+			return
+		}
+		u.Offset = update.UpdateID + 1
+		t.offsets.receive(update.UpdateID)
+
+		t.enqueue(ctx, queue, update)
+	}
 
+	// updates the previous clients received before they stopped
+	drained := make(chan tgbotapi.Update)
 	for {
 		select {
 		case <-ctx.Done():
+			bot.StopReceivingUpdates()
 			return nil
+		case <-rotate:
+			rotated, err := t.newBotAPI()
+			if err != nil {
+				log.Error().Err(err).Msg("cannot rotate token, keeping the current one")
+				continue
+			}
+			if rotated.Token == bot.Token {
+				continue
+			}
+
+			bot.StopReceivingUpdates()
+			// the old channel is closed once its poller stops, until then it can still deliver updates
+			go drainUpdates(ctx, updatesChan, drained)
+			bot = rotated
+			t.bot.Store(bot)
+			// resume after the last received update with the new client
+			updatesChan = bot.GetUpdatesChan(u)
+			log.Info().Str("bot", bot.Self.UserName).Msg("rotated token")
+		case update := <-drained:
+			receive(update)
 		case update := <-updatesChan:
-			procPool.Go(func() {
-				if update.Message == nil {
-					return
-				}
+			receive(update)
+		}
+	}
+}
 
-				log.Info().
-					Str("user", update.Message.From.FirstName).
-					Str("chat_message", update.Message.Text).
-					Msg("got message")
+// drainUpdates forwards the updates left in a stopped client's channel until it's closed
+func drainUpdates(ctx context.Context, updates tgbotapi.UpdatesChannel, to chan<- tgbotapi.Update) {
+	for update := range updates {
+		select {
+		case to <- update:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
-				rule, ok := t.ruleFromMessage(update.Message)
-				if !ok {
-					log.Debug().Msg("no matching rule")
-					return
-				}
+// client is the bot telecmd sends with, nil when not connected to Telegram
+func (t Telecmd) client() *tgbotapi.BotAPI {
+	if t.bot == nil {
+		return nil
+	}
+	return t.bot.Load()
+}
 
-				log.Debug().Interface("rule", rule).Msg("matched rule")
+func (t Telecmd) handleUpdate(ctx context.Context, update tgbotapi.Update) {
+	if t.paused.Load() {
+		log.Debug().Int("update_id", update.UpdateID).Msg("paused, ignoring update")
+		return
+	}
+	t = t.current()
 
-				timeout := t.config.CommandTimeoutDuration()
-				cmdContext, cancel := context.WithTimeout(ctx, timeout)
-				defer cancel()
+	switch {
+	case update.Message != nil:
+		t.handleMessage(ctx, update, update.Message)
+	case update.ChannelPost != nil:
+		t.handleMessage(ctx, update, update.ChannelPost)
+	case update.CallbackQuery != nil:
+		t.handleCallbackQuery(ctx, update)
+	case update.MyChatMember != nil:
+		t.handleMyChatMember(ctx, update.MyChatMember)
+	}
+}
 
-				cmd, err := commandFromMessage(cmdContext, rule, update.Message)
-				if err != nil {
-					log.Error().Err(err).Msg("cannot parse command")
-					return
-				}
+func (t Telecmd) handleCallbackQuery(ctx context.Context, update tgbotapi.Update) {
+	query := update.CallbackQuery
 
-				output, err := t.runCommand(cmdContext, cmd)
-				if err != nil {
-					log.Debug().Str("command", cmd.Path).Strs("args", cmd.Args).Err(err).Msg("command finished with error")
-					output = err.Error()
-				}
+	log.Info().
+		Str("user", query.From.FirstName).
+		Str("callback_data", query.Data).
+		Msg("got callback query")
 
-				if output == "" {
-					return
-				}
+	if _, err := t.client().Request(tgbotapi.NewCallback(query.ID, "")); err != nil {
+		log.Error().Err(err).Msg("failed to answer callback query")
+	}
 
-				m, err := chattableFromStdout(update.Message.Chat.ID, output)
-				if err != nil {
-					log.Error().Err(err).Msg("cannot parse stdout")
-					return
-				}
-				switch v := m.(type) {
-				case *tgbotapi.MessageConfig:
-					v.ReplyToMessageID = update.Message.MessageID
-				}
+	if query.Message == nil {
+		log.Debug().Msg("callback query without message")
+		return
+	}
 
-				if _, err = bot.Send(m); err != nil {
-					log.Error().Err(err).Msg("failed to reply")
-					return
-				}
-			})
+	// treat the button tap as if the user sent its data as a message
+	message := *query.Message
+	message.From = query.From
+	message.Text = query.Data
+	message.Entities = nil
+
+	t.handleMessage(ctx, update, &message)
+}
+
+// senderName is the name of the user who sent the message, or the chat title for channel posts
+func senderName(message *tgbotapi.Message) string {
+	if message.From != nil {
+		return message.From.FirstName
+	}
+	if message.Chat != nil {
+		return message.Chat.Title
+	}
+	return ""
+}
+
+func (t Telecmd) handleMessage(ctx context.Context, update tgbotapi.Update, message *tgbotapi.Message) {
+	ctx, cancel := t.config.handlerContext(ctx)
+	// the replies are sent in the background, sending them releases the context then
+	queued := false
+	defer func() {
+		if !queued {
+			cancel()
 		}
+	}()
+
+	message = withCaption(message)
+
+	log.Info().
+		Str("user", senderName(message)).
+		Str("chat_message", message.Text).
+		Msg("got message")
+	t.events.publish(messageEvent("message", message))
+
+	if reason := t.skipReason(message); reason != "" {
+		log.Debug().Msg(reason)
+		return
 	}
+
+	if reply, ok := t.builtinReply(message); ok {
+		m := tgbotapi.NewMessage(message.Chat.ID, reply)
+		m.ReplyToMessageID = message.MessageID
+		if _, err := t.send(ctx, m); err != nil {
+			log.Error().Err(err).Msg("failed to reply")
+		}
+		return
+	}
+
+	rule, output, ok := t.Handle(ctx, update, message)
+	if !ok || output == "" {
+		return
+	}
+
+	replies, err := t.config.chattablesFromStdout(rule, message.Chat.ID, output)
+	if err != nil {
+		log.Error().Err(err).Msg("cannot parse stdout")
+		return
+	}
+	if len(rule.TTS) > 0 {
+		replies = speak(ctx, rule, replies, t.config.TTSTimeout(rule))
+	}
+
+	// the worker moves on to the next update while the replies wait to be sent
+	queued = true
+	t.outbox.push(ctx, message.Chat.ID, func() {
+		defer cancel()
+		for _, m := range replies {
+			// a send in flight can't be interrupted, the rest are dropped once handlerTimeout is up
+			if err := ctx.Err(); err != nil {
+				log.Warn().Err(err).Str("rule", rule.Name).Msg("dropping replies, handler timed out")
+				return
+			}
+			if err := t.sendReply(ctx, rule, message, m, len(replies) == 1); err != nil {
+				log.Error().Err(err).Msg("failed to reply")
+				t.stats.recordError(err)
+				return
+			}
+		}
+	})
+}
+
+// withCaption uses the caption of uploads as their text, so they're matched by it
+func withCaption(message *tgbotapi.Message) *tgbotapi.Message {
+	if message.Text != "" || message.Caption == "" {
+		return message
+	}
+	captioned := *message
+	captioned.Text = message.Caption
+	return &captioned
 }
 
-func (t Telecmd) ruleFromMessage(message *tgbotapi.Message) (Rule, bool) {
-	for _, rule := range t.config.Rules {
-		ok, _ := regexp.MatchString(rule.Pattern, message.Text)
-		if ok {
-			return rule, true
+// skipReason tells why the message is ignored before matching any rule, it's empty if it isn't
+func (t Telecmd) skipReason(message *tgbotapi.Message) string {
+	if _, forwarded := forwardedFrom(message); forwarded && t.config.ForwardedMessages == "skip" {
+		return "skipping forwarded message"
+	}
+	// uploads without a caption are still matched
+	if _, hasFile := fileFromMessage(message); !hasFile && strings.TrimSpace(message.Text) == "" && t.config.BlankMessages != "handle" {
+		return "skipping blank message"
+	}
+	if !t.config.ChatAllowed(message.Chat) {
+		return "ignoring message from filtered chat"
+	}
+	return ""
+}
+
+// sendReply sends the reply to the chat, to the topic or in place of the previous reply if the rule says so.
+// Only single replies are editable.
+func (t Telecmd) sendReply(ctx context.Context, rule Rule, message *tgbotapi.Message, m tgbotapi.Chattable, editable bool) error {
+	if rule.EditInPlace && editable {
+		return t.editOrSend(ctx, rule, message, m)
+	}
+	_, err := t.sendNew(ctx, rule, message, m)
+	return err
+}
+
+// sendNew sends the reply to the topic of the rule, or as a reply to the message if the rule has none
+func (t Telecmd) sendNew(ctx context.Context, rule Rule, message *tgbotapi.Message, m tgbotapi.Chattable) (tgbotapi.Message, error) {
+	if rule.ReplyThreadID != 0 {
+		return t.sendToThread(ctx, m, rule.ReplyThreadID)
+	}
+	return t.send(ctx, withReplyTo(m, message.MessageID))
+}
+
+// Handle runs the command of the first rule matching the message and returns its output.
+// It returns false if no rule matched or the command could not be started.
+func (t Telecmd) Handle(ctx context.Context, update tgbotapi.Update, message *tgbotapi.Message) (Rule, string, bool) {
+	if limit := t.config.MaxMessageLength; limit > 0 && utf8.RuneCountInString(message.Text) > limit {
+		log.Warn().Int("limit", limit).Msg("message too long")
+		return Rule{}.asText(), t.config.Message(messageTooLong, map[string]any{"Limit": limit}), true
+	}
+
+	rule, runMessage, isRun, err := t.ruleToRun(message)
+	switch {
+	case isRun && err != nil:
+		return Rule{}.asText(), err.Error(), true
+	case isRun:
+		message = runMessage
+	default:
+		var ok bool
+		if rule, ok = t.ruleFromMessage(ctx, message); !ok {
+			if ctx.Err() != nil {
+				return Rule{}, "", false
+			}
+			log.Debug().Msg("no matching rule")
+			// replying to every message would be spammy in groups
+			if t.config.UnmatchedReply != "" && message.Chat != nil && message.Chat.IsPrivate() {
+				return Rule{}.asText(), t.config.UnmatchedReply, true
+			}
+			return Rule{}, "", false
 		}
 	}
-	return Rule{}, false
+
+	log.Debug().Interface("rule", rule).Msg("matched rule")
+	matched := messageEvent("matched", message)
+	matched.Rule = rule.Name
+	matched.Tags = rule.Tags
+	t.events.publish(matched)
+
+	if !rule.AllowsUser(message.From) {
+		log.Info().Str("rule", rule.Name).Str("user", senderName(message)).Msg("user not allowed to run rule")
+		return rule.asText(), t.config.Message(messageNotAuthorized, nil), true
+	}
+
+	if t.config.InMaintenance(time.Now()) {
+		log.Info().Str("rule", rule.Name).Msg("not running command in maintenance window")
+		return rule.asText(), t.config.Message(messageMaintenance, nil), true
+	}
+
+	result := t.runMatched(ctx, update, rule, message)
+
+	// fallbacks are checked for loops when the config is loaded, this guards against rules that were renamed since
+	tried := map[string]bool{rule.Name: true}
+	// a cancelled command isn't a failure, the user or the shutdown asked for it to stop
+	for result.ok && result.failed && !result.cancelled && rule.FallbackRule != "" {
+		fallback, ok := t.config.RuleByName(rule.FallbackRule)
+		if !ok || tried[fallback.Name] {
+			log.Warn().Str("rule", rule.Name).Str("fallback", rule.FallbackRule).Msg("cannot run fallback rule")
+			break
+		}
+		if !fallback.AllowsUser(message.From) {
+			log.Info().Str("rule", rule.Name).Str("fallback", fallback.Name).Msg("user not allowed to run fallback rule")
+			break
+		}
+		tried[fallback.Name] = true
+
+		log.Info().Str("rule", rule.Name).Str("fallback", fallback.Name).Msg("command failed, running fallback rule")
+		// the fallback gets the same message text
+		fallback.argsOnly = rule.argsOnly
+		rule = fallback
+		result = t.runMatched(ctx, update, rule, message)
+	}
+
+	if result.generated {
+		rule = rule.asText()
+	}
+	return rule, result.output, result.ok
+}
+
+// runMatched runs the rule matching the message, sharing the run with identical messages if the rule has singleFlight
+func (t Telecmd) runMatched(ctx context.Context, update tgbotapi.Update, rule Rule, message *tgbotapi.Message) ruleResult {
+	run := func() ruleResult {
+		return t.runRule(ctx, update, rule, message, t.config.RuleTimeout(rule, false))
+	}
+	if !rule.SingleFlight {
+		return run()
+	}
+
+	key := flightKey{rule: rule.index, text: message.Text}
+	if message.Chat != nil {
+		key.chat = message.Chat.ID
+	}
+	if file, ok := fileFromMessage(message); ok {
+		key.file = file.ID
+	}
+	result, shared := t.flights.do(ctx, key, run)
+	if shared {
+		log.Info().Str("rule", rule.Name).Msg("replying with the output of an identical run")
+	}
+	return result
+}
+
+// ruleResult is the outcome of running a rule
+type ruleResult struct {
+	output string
+	// generated output is a reply of telecmd, like the usage or the failure message, instead of stdout
+	generated bool
+	// failed is true if the command exited with an error or timed out
+	failed bool
+	// cancelled is true if the command was stopped with /cancel or by shutting down
+	cancelled bool
+	ok        bool
 }
 
-func (t Telecmd) runCommand(ctx context.Context, cmd *exec.Cmd) (string, error) {
-	out, err := cmd.Output()
+// runRule runs the rule's command for the message and returns its output.
+// The result isn't ok if the command could not be started.
+func (t Telecmd) runRule(ctx context.Context, update tgbotapi.Update, rule Rule, message *tgbotapi.Message, timeout time.Duration) ruleResult {
+	if args := argumentCount(message.Text, !rule.argsOnly); args < rule.MinArgs {
+		log.Info().Str("rule", rule.Name).Int("args", args).Int("min_args", rule.MinArgs).Msg("not enough arguments")
+		if rule.Usage != "" {
+			return ruleResult{output: rule.Usage, generated: true, ok: true}
+		}
+		return ruleResult{output: t.config.Message(messageNotEnoughArgs, map[string]any{"MinArgs": rule.MinArgs, "Args": args}), generated: true, ok: true}
+	}
+
+	cmdContext, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if message.Chat != nil {
+		done := t.running.add(message.Chat.ID, rule, cancel)
+		defer done()
+	}
+
+	file, hasFile := fileFromMessage(message)
+	if hasFile && len(rule.AllowedFileTypes) > 0 && !file.allowedBy(rule.AllowedFileTypes) {
+		log.Info().Str("rule", rule.Name).Str("file", file.Name).Str("mime_type", file.MimeType).Msg("file type not allowed")
+		return ruleResult{output: t.config.Message(messageFileTypeNotAllowed, file), generated: true, ok: true}
+	}
+
+	var filePath string
+	if hasFile && rule.DownloadFile {
+		path, err := t.downloadFile(cmdContext, file, rule.RunAs)
+		if err != nil {
+			log.Error().Err(err).Msg("cannot download file")
+			return ruleResult{}
+		}
+		defer os.Remove(path)
+		filePath = path
+	}
+
+	if rule.Script != "" {
+		command, scriptPath, err := scriptCommand(rule)
+		if err != nil {
+			log.Error().Err(err).Msg("cannot write script")
+			return ruleResult{}
+		}
+		if scriptPath != "" {
+			defer os.Remove(scriptPath)
+		}
+		rule.Command = command
+	}
+
+	commands := rule.Commands
+	if len(commands) == 0 {
+		commands = [][]string{rule.Command}
+	}
+
+	var cmds []*exec.Cmd
+	for _, command := range commands {
+		step := rule
+		step.Command = command
+		cmd, err := t.commandFromMessage(cmdContext, step, message)
+		var argsErr argsError
+		if errors.As(err, &argsErr) {
+			log.Info().Err(err).Str("rule", rule.Name).Msg("invalid arguments")
+			return ruleResult{output: t.config.Message(messageInvalidArgs, map[string]any{"Error": argsErr.err}), generated: true, ok: true}
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("cannot parse command")
+			return ruleResult{}
+		}
+
+		if err := attachRawUpdate(cmd, rule.PassRawUpdate, update); err != nil {
+			log.Error().Err(err).Msg("cannot attach raw update")
+			return ruleResult{}
+		}
+		if filePath != "" {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("TELEGRAM_FILE_PATH=%s", filePath))
+		}
+		cmds = append(cmds, cmd)
+	}
+
+	if len(rule.Guard) > 0 {
+		if err := t.runHook(cmdContext, rule.Guard, rule, message); err != nil {
+			log.Info().Str("rule", rule.Name).Err(err).Msg("guard rejected command")
+			return ruleResult{output: rule.GuardReply, generated: true, ok: true}
+		}
+	}
+
+	if len(t.config.PreHook) > 0 {
+		if err := t.runHook(cmdContext, t.config.PreHook, rule, message); err != nil {
+			log.Info().Str("rule", rule.Name).Err(err).Msg("pre-hook aborted command")
+			return ruleResult{output: err.Error(), generated: true, ok: true}
+		}
+	}
+
+	if rule.ShowCommand {
+		t.sendRunningNotice(cmdContext, rule, message)
+	}
+
+	stopWarning := func() {}
+	if warnAfter := rule.WarnAfterDuration(); warnAfter > 0 {
+		var warnContext context.Context
+		warnContext, stopWarning = context.WithCancel(cmdContext)
+		go t.warnSlowCommand(warnContext, rule, message, warnAfter)
+	}
+
+	t.stats.inFlight.Add(1)
+	startedAt := time.Now()
+	output, exitCode, err := t.runCommands(cmdContext, rule, cmds)
+	took := time.Since(startedAt)
+	stopWarning()
+	t.stats.inFlight.Add(-1)
+	t.stats.recordRun(rule.Tags)
+	if err != nil {
+		log.Debug().Str("rule", rule.Name).Err(err).Msg("command finished with error")
+		t.stats.recordError(err)
+	}
+
+	result := messageEvent("result", message)
+	result.Rule = rule.Name
+	result.Tags = rule.Tags
+	result.ExitCode = &exitCode
+	if err != nil {
+		result.Error = err.Error()
+	}
+	t.events.publish(result)
+
+	if err != nil && t.config.FailureWebhook != "" {
+		notifyFailure(t.config.FailureWebhook, newFailureNotification(rule, message, exitCode, err))
+	}
+
+	if len(t.config.PostHook) > 0 {
+		hookContext, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		if err := t.runHook(hookContext, t.config.PostHook, rule, message, fmt.Sprintf("TELEGRAM_EXIT_CODE=%d", exitCode)); err != nil {
+			log.Error().Err(err).Msg("post-hook failed")
+		}
+	}
+
+	cancelled := errors.Is(cmdContext.Err(), context.Canceled)
+	switch {
+	case rule.ReplyOn == "success" && err != nil:
+		log.Info().Str("rule", rule.Name).Err(err).Msg("not replying with failure")
+		return ruleResult{failed: true, cancelled: cancelled, ok: true}
+	case rule.ReplyOn == "failure" && err == nil:
+		return ruleResult{ok: true}
+	}
+
+	if rule.DedupeLines && isTextOutput(rule, output) {
+		output = dedupeLines(output)
+	}
+
+	if (rule.HeadLines > 0 || rule.TailLines > 0) && isTextOutput(rule, output) {
+		output = trimLines(output, rule.HeadLines, rule.TailLines)
+	}
+
+	if (rule.OutputPrefix != "" || rule.OutputSuffix != "") && isTextOutput(rule, output) {
+		data := newTemplateContext(rule, message, t.config.Now())
+		data.ExitCode = exitCode
+		output = decorateOutput(ctx, rule, data, output)
+	}
+
+	if rule.MaxOutputLength > 0 && isTextOutput(rule, output) {
+		// not cmdContext, the upload shouldn't fail because the command used up its time
+		output = t.truncateOutput(ctx, output, rule.MaxOutputLength)
+	}
+
+	if rule.ShowDuration && isTextOutput(rule, output) {
+		output = strings.TrimRight(output, "\n") + t.config.Message(messageDuration, map[string]any{"Duration": formatDuration(took)})
+	}
+
+	return ruleResult{output: output, generated: err != nil, failed: err != nil, cancelled: cancelled, ok: true}
+}
+
+// formatDuration rounds d for showing it to users, to milliseconds below a second and to tenths of a second above
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(100 * time.Millisecond).String()
+}
+
+// RunOnce handles a single message text without connecting to Telegram and writes the reply to w
+func (t Telecmd) RunOnce(ctx context.Context, text string, w io.Writer) error {
+	ctx, cancel := t.config.handlerContext(ctx)
+	defer cancel()
+
+	message := &tgbotapi.Message{Text: text}
+	rule, output, ok := t.Handle(ctx, tgbotapi.Update{Message: message}, message)
+	if !ok {
+		return fmt.Errorf("no matching rule")
+	}
+	if output == "" {
+		return nil
+	}
+
+	replies, err := t.config.chattablesFromStdout(rule, 0, output)
+	if err != nil {
+		return fmt.Errorf("cannot parse stdout: %w", err)
+	}
+
+	for _, m := range replies {
+		text := output
+		if v, ok := m.(tgbotapi.MessageConfig); ok {
+			text = v.Text
+		}
+		if _, err := fmt.Fprintln(w, strings.TrimRight(text, "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runCommands runs cmds in order and returns their output, followed by the error of the failing command.
+// It stops at the first failure unless the rule continues on failure, the exit code and error are of the first failure.
+func (t Telecmd) runCommands(ctx context.Context, rule Rule, cmds []*exec.Cmd) (string, int, error) {
+	var output strings.Builder
+	var exitCode int
+	var failed error
+	for i, cmd := range cmds {
+		out, code, err := t.runCommand(ctx, rule, cmd)
+		output.WriteString(out)
+		if err == nil {
+			if failed == nil {
+				exitCode = code
+			}
+			continue
+		}
+
+		output.WriteString(err.Error())
+		if failed == nil {
+			failed, exitCode = err, code
+		}
+		if !rule.ContinueOnFailure {
+			break
+		}
+		if i < len(cmds)-1 && !strings.HasSuffix(err.Error(), "\n") {
+			output.WriteString("\n")
+		}
+	}
+	return output.String(), exitCode, failed
+}
+
+// runCommand runs cmd and returns its stdout and exit code, which is -1 if the command didn't exit by itself
+func (t Telecmd) runCommand(ctx context.Context, rule Rule, cmd *exec.Cmd) (string, int, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if rule.CombineOutput {
+		// interleave both streams in the order they're written
+		cmd.Stderr = &stdout
+	}
+
+	err := cmd.Run()
 	if err != nil {
 		var exitErr *exec.ExitError
 		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
-			return "", fmt.Errorf("command took too long to finish")
+			return "", -1, errors.New(t.config.Message(messageCommandTimeout, nil))
+		} else if errors.Is(ctx.Err(), context.Canceled) {
+			return "", -1, errors.New(t.config.Message(messageCommandCancelled, nil))
 		} else if errors.As(err, &exitErr) {
-			return "", fmt.Errorf("command exited with code=%d\n\n%v", exitErr.ExitCode(), string(exitErr.Stderr))
+			if slices.Contains(rule.SuccessExitCodes, exitErr.ExitCode()) {
+				return stdout.String(), exitErr.ExitCode(), nil
+			}
+			errOutput := stderr.String()
+			if rule.CombineOutput {
+				errOutput = stdout.String()
+			}
+			var stdoutTail string
+			if lines := t.config.StdoutLinesOnFailure(rule); lines > 0 && !rule.CombineOutput {
+				stdoutTail = trimLines(stdout.String(), 0, lines)
+			}
+			return "", exitErr.ExitCode(), errors.New(t.config.Message(messageCommandFailed, map[string]any{
+				"ExitCode": exitErr.ExitCode(),
+				"Stderr":   strings.TrimRight(errOutput, "\n"),
+				"Stdout":   strings.TrimRight(stdoutTail, "\n"),
+			}))
 		}
 	}
 
-	return string(out), nil
+	return stdout.String(), cmd.ProcessState.ExitCode(), nil
 }
 
-func commandFromMessage(ctx context.Context, rule Rule, message *tgbotapi.Message) (*exec.Cmd, error) {
+func (t Telecmd) commandFromMessage(ctx context.Context, rule Rule, message *tgbotapi.Message) (*exec.Cmd, error) {
 	var stdin io.Reader
 	args := slices.Clone(rule.Command)
+	text := message.Text
+	if rule.ExtractEntity != "" {
+		// the whole text is passed if there's no such entity
+		if extracted, ok := firstEntityText(message, rule.ExtractEntity); ok {
+			text = extracted
+		}
+	}
+	text = transformText(rule.Transform, text)
+	words := []string{text}
+	if rule.SplitArgs {
+		split, err := splitArgs(text)
+		if err != nil {
+			return nil, argsError{err: err}
+		}
+		words = split
+	}
 	if rule.UseStdin {
-		stdin = strings.NewReader(message.Text)
+		stdin = strings.NewReader(text)
+	} else if sep := rule.ArgumentSeparator(); sep != "" {
+		args = append(append(args, sep), words...)
 	} else {
-		args = append(args, "--", message.Text)
+		args = append(args, words...)
 	}
 
 	exe := args[0]
@@ -140,41 +824,302 @@ func commandFromMessage(ctx context.Context, rule Rule, message *tgbotapi.Messag
 	log.Debug().Str("command", exe).Strs("args", cmdArgs).Msg("running command")
 
 	cmd := exec.CommandContext(ctx, exe, cmdArgs...)
+	setProcessGroup(cmd)
+	// processes left behind by a killed command may keep its output open
+	cmd.WaitDelay = commandWaitDelay
 	if rule.WorkingDirectory != "" {
-		cmd.Dir = rule.WorkingDirectory
+		dir, err := renderTemplateContext(ctx, rule.WorkingDirectory, newTemplateContext(rule, message, t.config.Now()))
+		if err != nil {
+			return nil, fmt.Errorf("cannot render workingDir: %w", err)
+		}
+		if rule.CreateWorkingDir {
+			_, statErr := os.Stat(dir)
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return nil, fmt.Errorf("cannot create workingDir: %w", err)
+			}
+			// an existing dir keeps its owner
+			if statErr != nil {
+				if err := chownRunAs(dir, rule.RunAs); err != nil {
+					return nil, fmt.Errorf("cannot create workingDir: %w", err)
+				}
+			}
+		}
+		cmd.Dir = dir
+	}
+	if err := setRunAs(cmd, rule.RunAs); err != nil {
+		return nil, fmt.Errorf("cannot run as %q: %w", rule.RunAs, err)
 	}
 	cmd.Stdin = stdin
 	env := os.Environ()
-	env = append(env, rule.Environment...)
-	env = append(env, envsFromUpdate(message)...)
+	if rule.EnvFile != "" {
+		// read on every run so edits apply without a restart
+		fileEnv, err := readEnvFile(rule.EnvFile)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, fileEnv...)
+	}
+	fromEnv, err := envFromRefs(rule.FromEnv)
+	if err != nil {
+		return nil, err
+	}
+	env = append(env, fromEnv...)
+	for _, kv := range rule.Environment {
+		env = append(env, resolveEnvRef(kv))
+	}
+	env = append(env, envsFromRule(rule)...)
+	// created on first use, MkdirAll is fine with concurrent runs creating it
+	stateDir := t.config.RuleStateDir(rule)
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return nil, fmt.Errorf("cannot create state dir: %w", err)
+	}
+	if err := chownRunAs(stateDir, rule.RunAs); err != nil {
+		return nil, fmt.Errorf("cannot create state dir: %w", err)
+	}
+	env = append(env, fmt.Sprintf("TELEGRAM_RULE_STATE_DIR=%s", stateDir))
+	env = append(env, envsFromBot(t.client())...)
+	if message.Date != 0 {
+		env = append(env, fmt.Sprintf("TELEGRAM_MESSAGE_TIME=%s", message.Time().In(t.config.Location()).Format(time.RFC3339)))
+	}
+	env = append(env, envsFromUpdate(message, t.config.SanitizeEnv, t.config.EnvValueLimit())...)
 	cmd.Env = env
+	if rule.ExpandArgs && rule.Script == "" {
+		// only the configured args, variables in the message and scripts are passed as is
+		configured := cmd.Args[1:len(rule.Command)]
+		copy(configured, expandArgs(configured, env))
+	}
+	if rule.Nice != 0 {
+		// the priority applies from the start, children inherit it
+		if err := setNice(cmd, rule.Nice); err != nil {
+			log.Warn().Err(err).Int("nice", rule.Nice).Msg("cannot set command priority")
+		}
+	}
 
 	return cmd, nil
 }
 
-func chattableFromStdout(chatID int64, output string) (tgbotapi.Chattable, error) {
-	if !strings.HasPrefix(strings.TrimSpace(output), "{") {
-		// not json
+func attachRawUpdate(cmd *exec.Cmd, mode string, update tgbotapi.Update) error {
+	if mode == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(update)
+	if err != nil {
+		return fmt.Errorf("failed to serialize update: %w", err)
+	}
+
+	switch mode {
+	case "env":
+		cmd.Env = append(cmd.Env, fmt.Sprintf("TELEGRAM_UPDATE_JSON=%s", b))
+	case "stdin":
+		cmd.Stdin = bytes.NewReader(b)
+	}
+
+	return nil
+}
+
+// sendRunningNotice lets the chat know the command has started, before its output arrives
+func (t Telecmd) sendRunningNotice(ctx context.Context, rule Rule, message *tgbotapi.Message) {
+	if t.client() == nil || message.Chat == nil {
+		return
+	}
+
+	m := tgbotapi.NewMessage(message.Chat.ID, t.config.Message(messageRunning, newTemplateContext(rule, message, t.config.Now())))
+	m.ReplyToMessageID = message.MessageID
+	m.DisableNotification = rule.Silent
+	if _, err := t.send(ctx, m); err != nil {
+		log.Error().Err(err).Msg("failed to send running notice")
+	}
+}
+
+// warnSlowCommand lets the chat know the command is still running once it takes longer than after,
+// unless ctx is cancelled by the command finishing first
+func (t Telecmd) warnSlowCommand(ctx context.Context, rule Rule, message *tgbotapi.Message, after time.Duration) {
+	if t.client() == nil || message.Chat == nil {
+		return
+	}
+
+	timer := time.NewTimer(after)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-timer.C:
+	}
+
+	text := t.config.Message(messageStillWorking, map[string]any{"Rule": rule.Name, "Elapsed": after})
+	m := tgbotapi.NewMessage(message.Chat.ID, text)
+	m.ReplyToMessageID = message.MessageID
+	m.DisableNotification = rule.Silent
+	if _, err := t.send(ctx, m); err != nil {
+		log.Error().Err(err).Msg("failed to send still working notice")
+	}
+}
+
+// decorateOutput wraps output with the rendered prefix and suffix of the rule
+func decorateOutput(ctx context.Context, rule Rule, data templateContext, output string) string {
+	prefix, err := renderTemplateContext(ctx, rule.OutputPrefix, data)
+	if err != nil {
+		log.Error().Err(err).Msg("cannot render output prefix")
+	}
+	suffix, err := renderTemplateContext(ctx, rule.OutputSuffix, data)
+	if err != nil {
+		log.Error().Err(err).Msg("cannot render output suffix")
+	}
+	return prefix + output + suffix
+}
+
+// scriptCommand returns the command running the script of the rule with its interpreter.
+// Shells get the script with -c, other interpreters get the path of a temp file, which the caller must remove.
+// Either way the arguments after the script start at $1.
+func scriptCommand(rule Rule) ([]string, string, error) {
+	interpreter := rule.ScriptInterpreter()
+	name := strings.TrimSuffix(filepath.Base(interpreter), ".exe")
+	if slices.Contains([]string{"sh", "bash", "dash", "zsh", "ksh", "ash"}, name) {
+		return []string{interpreter, "-c", rule.Script, "telecmd"}, "", nil
+	}
+
+	// powershell only runs files with its own extension
+	ext := ""
+	if name == "pwsh" || name == "powershell" {
+		ext = ".ps1"
+	}
+	path, err := writeScript(rule.Script, ext, rule.RunAs)
+	if err != nil {
+		return nil, "", err
+	}
+	return []string{interpreter, path}, path, nil
+}
+
+// writeScript saves the script to an executable temp file owned by the user it runs as
+func writeScript(script string, ext string, runAs string) (string, error) {
+	f, err := os.CreateTemp("", "telecmd-script-*"+ext)
+	if err != nil {
+		return "", fmt.Errorf("failed to create script file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(script); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write script file: %w", err)
+	}
+	if err := f.Chmod(0o700); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to make script executable: %w", err)
+	}
+	if err := chownRunAs(f.Name(), runAs); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to hand over script file: %w", err)
+	}
+
+	return f.Name(), nil
+}
+
+// trimLines keeps the first head and the last tail lines of output, marking how many lines are left out in between
+func trimLines(output string, head int, tail int) string {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	if len(lines) <= head+tail {
+		return output
+	}
+
+	omitted := len(lines) - head - tail
+	var kept []string
+	kept = append(kept, lines[:head]...)
+	kept = append(kept, fmt.Sprintf("… %d lines omitted", omitted))
+	kept = append(kept, lines[len(lines)-tail:]...)
+	return strings.Join(kept, "\n")
+}
+
+// dedupeLines collapses runs of identical lines into one, followed by how many times it was repeated.
+// Blank lines are kept as they are.
+func dedupeLines(output string) string {
+	lines := strings.Split(output, "\n")
+	var kept []string
+	for i := 0; i < len(lines); {
+		n := 1
+		for strings.TrimSpace(lines[i]) != "" && i+n < len(lines) && lines[i+n] == lines[i] {
+			n++
+		}
+		line := lines[i]
+		if n > 1 {
+			line = fmt.Sprintf("%s (x%d)", line, n)
+		}
+		kept = append(kept, line)
+		i += n
+	}
+	return strings.Join(kept, "\n")
+}
+
+// truncateOutput shortens output to a preview of maxLength characters,
+// linking to the full output if a paste service is configured
+func (t Telecmd) truncateOutput(ctx context.Context, output string, maxLength int) string {
+	runes := []rune(output)
+	if len(runes) <= maxLength {
+		return output
+	}
 
-		m := tgbotapi.NewMessage(chatID, output)
-		m.ReplyMarkup = tgbotapi.NewRemoveKeyboard(false)
+	preview := string(runes[:maxLength]) + "\n…"
+	if t.config.PasteUpload == nil {
+		return preview
+	}
+
+	link, err := t.config.PasteUpload.Upload(ctx, output)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to upload full output")
+		return preview
+	}
+
+	return fmt.Sprintf("%s\n\nfull output: %s", preview, link)
+}
 
-		return m, nil
+func envsFromRule(rule Rule) []string {
+	return []string{
+		fmt.Sprintf("TELEGRAM_RULE_NAME=%s", rule.Name),
+		fmt.Sprintf("TELEGRAM_RULE_INDEX=%d", rule.index),
+		fmt.Sprintf("TELEGRAM_RULE_PATTERN=%s", rule.Pattern),
 	}
+}
 
-	var maybeMessage struct {
-		Message string `json:"message"`
+// envsFromBot exports the identity of the bot, as returned by getMe when connecting
+func envsFromBot(bot *tgbotapi.BotAPI) []string {
+	if bot == nil {
+		return nil
 	}
-	if err := json.Unmarshal([]byte(output), &maybeMessage); err == nil {
-		m := tgbotapi.NewMessage(chatID, maybeMessage.Message)
-		m.ReplyMarkup = tgbotapi.NewRemoveKeyboard(false)
-		return m, nil
+	return []string{
+		fmt.Sprintf("TELEGRAM_BOT_ID=%d", bot.Self.ID),
+		fmt.Sprintf("TELEGRAM_BOT_USERNAME=%s", bot.Self.UserName),
 	}
+}
 
-	return nil, fmt.Errorf("unknown output format")
+// argumentCount is the number of whitespace separated words in text, not counting the first one if it's the command
+func argumentCount(text string, withCommand bool) int {
+	fields := strings.Fields(text)
+	if withCommand && len(fields) > 0 {
+		return len(fields) - 1
+	}
+	return len(fields)
 }
 
-func envsFromUpdate(message *tgbotapi.Message) []string {
+// forwardedFrom is the ID of the user or chat a forwarded message originally came from,
+// or the sender's name if they hide their account
+func forwardedFrom(message *tgbotapi.Message) (string, bool) {
+	switch {
+	case message.ForwardFrom != nil:
+		return fmt.Sprintf("%d", message.ForwardFrom.ID), true
+	case message.ForwardFromChat != nil:
+		return fmt.Sprintf("%d", message.ForwardFromChat.ID), true
+	case message.ForwardSenderName != "":
+		return message.ForwardSenderName, true
+	case message.ForwardDate != 0:
+		return "", true
+	}
+	return "", false
+}
+
+// envsFromUpdate exports details of the message.
+// NUL bytes are always removed from the values, with sanitize other control characters are too and newlines become spaces.
+// Values longer than maxLength bytes are truncated, unless maxLength is negative.
+func envsFromUpdate(message *tgbotapi.Message, sanitize bool, maxLength int) []string {
 	if message == nil {
 		return nil
 	}
@@ -197,5 +1142,53 @@ func envsFromUpdate(message *tgbotapi.Message) []string {
 		)
 	}
 
+	if from, ok := forwardedFrom(message); ok {
+		envs = append(envs, fmt.Sprintf("TELEGRAM_FORWARDED_FROM=%s", from))
+	}
+
+	if file, ok := fileFromMessage(message); ok {
+		envs = append(
+			envs,
+			fmt.Sprintf("TELEGRAM_FILE_ID=%s", file.ID),
+			fmt.Sprintf("TELEGRAM_FILE_NAME=%s", file.Name),
+			fmt.Sprintf("TELEGRAM_FILE_MIME_TYPE=%s", file.MimeType),
+		)
+	}
+
+	var mentionedIDs, mentionedUsernames []string
+	for _, entity := range message.Entities {
+		switch entity.Type {
+		case "mention":
+			mentionedUsernames = append(mentionedUsernames, strings.TrimPrefix(entityText(message.Text, entity), "@"))
+		case "text_mention":
+			if entity.User == nil {
+				continue
+			}
+			mentionedIDs = append(mentionedIDs, fmt.Sprintf("%d", entity.User.ID))
+			if entity.User.UserName != "" {
+				mentionedUsernames = append(mentionedUsernames, entity.User.UserName)
+			}
+		}
+	}
+	if len(mentionedIDs) > 0 {
+		envs = append(envs, fmt.Sprintf("TELEGRAM_MENTIONED_USER_ID=%s", strings.Join(mentionedIDs, "\n")))
+	}
+	if len(mentionedUsernames) > 0 {
+		envs = append(envs, fmt.Sprintf("TELEGRAM_MENTIONED_USERNAME=%s", strings.Join(mentionedUsernames, "\n")))
+	}
+
+	for i, kv := range envs {
+		envs[i] = truncateEnv(sanitizeEnv(kv, sanitize), maxLength)
+	}
 	return envs
 }
+
+// entityText extracts the text of an entity, whose offset and length are given in UTF-16 code units
+func entityText(text string, entity tgbotapi.MessageEntity) string {
+	encoded := utf16.Encode([]rune(text))
+	start, end := entity.Offset, entity.Offset+entity.Length
+	if start < 0 || end > len(encoded) || start > end {
+		return ""
+	}
+	return string(utf16.Decode(encoded[start:end]))
+}
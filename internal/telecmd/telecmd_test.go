@@ -0,0 +1,714 @@
+package telecmd
+
+import (
+	"context"
+	"encoding/json"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"golang.org/x/exp/slices"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleSuccessExitCodes(t *testing.T) {
+	tests := []struct {
+		name         string
+		script       string
+		successCodes []int
+		want         string
+	}{
+		{name: "exit 0", script: "echo out", want: "out\n"},
+		{name: "exit 1 fails by default", script: "echo out; exit 1", want: "command exited with code=1"},
+		{name: "exit 1 accepted", script: "echo out; exit 1", successCodes: []int{1}, want: "out\n"},
+		{name: "other codes still fail", script: "echo out; exit 2", successCodes: []int{1}, want: "command exited with code=2"},
+		{name: "stderr of accepted code is dropped", script: "echo out; echo err >&2; exit 3", successCodes: []int{1, 3}, want: "out\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := shellRule("check", "/check", tt.script)
+			rule.SuccessExitCodes = tt.successCodes
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, "/check")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if !strings.HasPrefix(output, tt.want) {
+				t.Errorf("output = %q, want prefix %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleAcceptedExitCodeSkipsFallback(t *testing.T) {
+	rule := shellRule("check", "/check", "echo primary; exit 1")
+	rule.SuccessExitCodes = []int{1}
+	rule.FallbackRule = "fallback"
+	fallback := shellRule("fallback", "^$", "echo fallback")
+	tc := New(Config{Rules: []Rule{rule, fallback}})
+
+	output, _ := handle(t, tc, "/check")
+	if output != "primary\n" {
+		t.Errorf("output = %q, want the primary rule's output", output)
+	}
+}
+
+func TestHandleMinArgs(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: "/deploy", want: "expected at least 1 arguments, got 0"},
+		{text: "/deploy prod", want: "ran\n"},
+		// /run passes only the text after the rule name
+		{text: "/run deploy prod", want: "ran\n"},
+		{text: "/run deploy", want: "expected at least 1 arguments, got 0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			rule := shellRule("deploy", "/deploy.*", "echo ran")
+			rule.MinArgs = 1
+			tc := New(Config{Rules: []Rule{rule}, Builtins: Builtins{Run: true}, Admins: []int64{42}})
+
+			message := testMessage(tt.text)
+			command, _, _ := strings.Cut(tt.text, " ")
+			message.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(command)}}
+			_, output, ok := tc.Handle(context.Background(), tgbotapi.Update{Message: message}, message)
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleMinArgsUsage(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		minArgs int
+		usage   string
+		want    string
+	}{
+		{name: "too few with usage", text: "/deploy prod", minArgs: 2, usage: "usage: /deploy <env> <region>", want: "usage: /deploy <env> <region>"},
+		{name: "too few without usage", text: "/deploy prod", minArgs: 2, want: "expected at least 2 arguments, got 1"},
+		{name: "sufficient", text: "/deploy prod eu", minArgs: 2, usage: "usage: /deploy <env> <region>", want: "ran\n"},
+		{name: "extra whitespace isn't an argument", text: "/deploy   prod  ", minArgs: 2, want: "expected at least 2 arguments, got 1"},
+		{name: "no minimum", text: "/deploy", want: "ran\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := shellRule("deploy", "/deploy.*", "echo ran")
+			rule.MinArgs = tt.minArgs
+			rule.Usage = tt.usage
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, tt.text)
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleScriptArgs(t *testing.T) {
+	tests := []struct {
+		name      string
+		splitArgs bool
+		separator *string
+		want      string
+	}{
+		{name: "message as $1", want: "/args a b|"},
+		{name: "words with splitArgs", splitArgs: true, want: "/args|a|b|"},
+		{name: "explicit separator", separator: ptr("--"), want: "--|/args a b|"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := Rule{Name: "args", Pattern: "/args.*", Script: `printf '%s|' "$@"`, SplitArgs: tt.splitArgs, ArgSeparator: tt.separator}
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, "/args a b")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleScriptArgsInterpreter(t *testing.T) {
+	tests := []struct {
+		name        string
+		interpreter string
+		script      string
+		splitArgs   bool
+		want        string
+	}{
+		{name: "python", interpreter: "python3", script: `import sys; print("|".join(sys.argv[1:]) + "|", end="")`, want: "/args a b|"},
+		{name: "python with splitArgs", interpreter: "python3", script: `import sys; print("|".join(sys.argv[1:]) + "|", end="")`, splitArgs: true, want: "/args|a|b|"},
+		// env runs the script file itself, by its shebang
+		{name: "env", interpreter: "env", script: "#!/bin/sh\nprintf '%s|' \"$@\"", splitArgs: true, want: "/args|a|b|"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := exec.LookPath(tt.interpreter); err != nil {
+				t.Skipf("%s is not installed", tt.interpreter)
+			}
+			rule := Rule{Name: "args", Pattern: "/args.*", Script: tt.script, Interpreter: tt.interpreter, SplitArgs: tt.splitArgs}
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, "/args a b")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestHandleFallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		timeout string
+		cancel  bool
+		want    string
+	}{
+		{name: "success", script: "echo primary", want: "primary\n"},
+		{name: "nonzero exit", script: "exit 1", want: "backup\n"},
+		{name: "timeout", script: "exec sleep 5", timeout: "100ms", want: "backup\n"},
+		{name: "cancelled", script: "exec sleep 5", cancel: true, want: "command was cancelled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := shellRule("primary", "/check", tt.script)
+			primary.Timeout = tt.timeout
+			primary.FallbackRule = "backup"
+			tc := New(Config{Rules: []Rule{primary, shellRule("backup", "^$", "echo backup")}})
+
+			if tt.cancel {
+				// like /cancel once the command is running
+				go func() {
+					for {
+						if cancelled, _ := tc.running.cancel(100, func(Rule) bool { return true }); cancelled > 0 {
+							return
+						}
+						time.Sleep(10 * time.Millisecond)
+					}
+				}()
+			}
+
+			start := time.Now()
+			output, ok := handle(t, tc, "/check")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if !strings.HasPrefix(output, tt.want) {
+				t.Errorf("output = %q, want prefix %q", output, tt.want)
+			}
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("handling took %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestHandleScript(t *testing.T) {
+	tests := []struct {
+		name        string
+		interpreter string
+		script      string
+		want        string
+	}{
+		{name: "default shell", script: "greeting=hello\necho \"$greeting\"\necho \"$1\"", want: "hello\n/script\n"},
+		{name: "bash", interpreter: "bash", script: "for word in a b; do\n  echo \"$word\"\ndone", want: "a\nb\n"},
+		{name: "python", interpreter: "python3", script: "import sys\nfor arg in sys.argv[1:]:\n    print(arg)", want: "/script\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.interpreter != "" {
+				if _, err := exec.LookPath(tt.interpreter); err != nil {
+					t.Skipf("%s is not installed", tt.interpreter)
+				}
+			}
+			// the script files are written here
+			tmp := t.TempDir()
+			t.Setenv("TMPDIR", tmp)
+			rule := Rule{Name: "script", Pattern: "/script", Script: tt.script, Interpreter: tt.interpreter}
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, "/script")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+			if entries, _ := os.ReadDir(tmp); len(entries) > 0 {
+				t.Errorf("script file %s wasn't removed", entries[0].Name())
+			}
+		})
+	}
+}
+
+func TestHandlePassRawUpdate(t *testing.T) {
+	tests := []struct {
+		mode   string
+		script string
+	}{
+		{mode: "env", script: `printf '%s' "$TELEGRAM_UPDATE_JSON"`},
+		{mode: "stdin", script: "cat"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			rule := shellRule("raw", "/raw", tt.script)
+			rule.PassRawUpdate = tt.mode
+			tc := New(Config{Rules: []Rule{rule}})
+
+			message := testMessage("/raw")
+			update := tgbotapi.Update{UpdateID: 7, Message: message}
+			_, output, ok := tc.Handle(context.Background(), update, message)
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+
+			var got tgbotapi.Update
+			if err := json.Unmarshal([]byte(output), &got); err != nil {
+				t.Fatalf("output %q isn't JSON: %v", output, err)
+			}
+			if got.UpdateID != update.UpdateID || got.Message == nil || got.Message.Text != message.Text || got.Message.From.ID != message.From.ID {
+				t.Errorf("update = %+v, want %+v", got, update)
+			}
+		})
+	}
+}
+
+func TestHandleReplyOn(t *testing.T) {
+	tests := []struct {
+		name    string
+		replyOn string
+		script  string
+		want    string
+	}{
+		{name: "default on success", script: "echo ok", want: "ok\n"},
+		{name: "default on failure", script: "exit 1", want: "command exited with code=1"},
+		{name: "always on failure", replyOn: "always", script: "exit 1", want: "command exited with code=1"},
+		{name: "success on success", replyOn: "success", script: "echo ok", want: "ok\n"},
+		{name: "success on failure", replyOn: "success", script: "echo ok; exit 1", want: ""},
+		{name: "failure on success", replyOn: "failure", script: "echo ok", want: ""},
+		{name: "failure on failure", replyOn: "failure", script: "exit 1", want: "command exited with code=1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := shellRule("check", "/check", tt.script)
+			rule.ReplyOn = tt.replyOn
+			if err := rule.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, "/check")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleOutputPrefixSuffix(t *testing.T) {
+	tests := []struct {
+		name      string
+		script    string
+		prefix    string
+		suffix    string
+		maxLength int
+		want      string
+	}{
+		{name: "prefix", script: "echo out", prefix: "== {{.Rule}} ==\n", want: "== report ==\nout\n"},
+		{name: "suffix", script: "echo out", suffix: "-- {{.Username}}", want: "out\n-- tester"},
+		{name: "both", script: "echo out", prefix: "[{{.ChatID}}] ", suffix: "(exit {{.ExitCode}})", want: "[100] out\n(exit 0)"},
+		{name: "failure", script: "exit 2", prefix: "{{.Rule}}: ", suffix: " ({{.ExitCode}})", want: "report: command exited with code=2 (2)"},
+		{name: "invalid template is left out", script: "echo out", prefix: "{{.Oops", suffix: "!", want: "out\n!"},
+		// truncation applies after decorating
+		{name: "truncated", script: "echo output", prefix: "> ", maxLength: 5, want: "> out\n…"},
+		{name: "json output isn't decorated", script: `echo '{"message": "hi"}'`, prefix: "> ", want: `{"message": "hi"}` + "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := shellRule("report", "/report", tt.script)
+			rule.OutputPrefix = tt.prefix
+			rule.OutputSuffix = tt.suffix
+			rule.MaxOutputLength = tt.maxLength
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, "/report")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleCombineOutput(t *testing.T) {
+	const alternating = "echo out1; echo err1 >&2; echo out2; echo err2 >&2"
+
+	tests := []struct {
+		name    string
+		script  string
+		combine bool
+		want    string
+	}{
+		{name: "interleaved", script: alternating, combine: true, want: "out1\nerr1\nout2\nerr2\n"},
+		{name: "stdout only by default", script: alternating, want: "out1\nout2\n"},
+		{name: "interleaved on failure", script: alternating + "; exit 1", combine: true, want: "command exited with code=1\n\nout1\nerr1\nout2\nerr2"},
+		{name: "stderr on failure by default", script: alternating + "; exit 1", want: "command exited with code=1\n\nerr1\nerr2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := shellRule("debug", "/debug", tt.script)
+			rule.CombineOutput = tt.combine
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, "/debug")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleChannelPost(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		wantReply string
+	}{
+		{name: "matched", text: "/echo news", wantReply: "/echo news\n"},
+		{name: "not matched", text: "news"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			// channel posts have no sender
+			rule := shellRule("echo", "/echo.*", `echo "$1"; [ -z "$TELEGRAM_FROM_USER_ID" ]`)
+			tc := f.connect(t, New(Config{Rules: []Rule{rule}, AllowedUpdates: []string{"channel_post"}}), "token")
+
+			post := &tgbotapi.Message{MessageID: 3, Date: int(time.Now().Unix()), Text: tt.text, Chat: &tgbotapi.Chat{ID: -1001, Type: "channel", Title: "news"}}
+			tc.handleUpdate(context.Background(), tgbotapi.Update{UpdateID: 1, ChannelPost: post})
+
+			sent := f.sent("token", "sendMessage")
+			if tt.wantReply == "" {
+				if len(sent) != 0 {
+					t.Errorf("sent %d replies, want none", len(sent))
+				}
+				return
+			}
+			if len(sent) != 1 {
+				t.Fatalf("sent %d replies, want 1", len(sent))
+			}
+			params := sent[0].params
+			if params.Get("chat_id") != "-1001" || params.Get("text") != tt.wantReply || params.Get("reply_to_message_id") != "3" {
+				t.Errorf("sent %v, want %q to the channel post", params, tt.wantReply)
+			}
+		})
+	}
+}
+
+func TestConfigUpdateTypes(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		want    []string
+		wantErr bool
+	}{
+		{name: "default", want: []string{"message", "callback_query"}},
+		{name: "channel posts only", config: Config{AllowedUpdates: []string{"channel_post"}}, want: []string{"channel_post"}},
+		{name: "with onJoin", config: Config{AllowedUpdates: []string{"channel_post"}, OnJoin: &OnJoin{}}, want: []string{"channel_post", "my_chat_member"}},
+		{name: "unsupported", config: Config{AllowedUpdates: []string{"edited_message"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Rules = []Rule{shellRule("echo", "/echo", "echo")}
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := tt.config.UpdateTypes(); !slices.Equal(got, tt.want) {
+				t.Errorf("UpdateTypes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleCommands(t *testing.T) {
+	step := func(script string) []string {
+		return []string{"sh", "-c", script}
+	}
+
+	tests := []struct {
+		name              string
+		commands          [][]string
+		continueOnFailure bool
+		want              string
+	}{
+		{name: "all succeed", commands: [][]string{step("echo one"), step("echo two"), step("echo three")}, want: "one\ntwo\nthree\n"},
+		{name: "stops on failure", commands: [][]string{step("echo one"), step("echo bad >&2; exit 2"), step("echo three")}, want: "one\ncommand exited with code=2\n\nbad"},
+		{
+			name:              "continues on failure",
+			commands:          [][]string{step("echo one"), step("exit 2"), step("echo three")},
+			continueOnFailure: true,
+			want:              "one\ncommand exited with code=2\nthree\n",
+		},
+		{
+			name:              "first failure is reported",
+			commands:          [][]string{step("exit 2"), step("exit 3"), step("echo three")},
+			continueOnFailure: true,
+			want:              "command exited with code=2\ncommand exited with code=3\nthree\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := Rule{Name: "steps", Pattern: "/steps", Commands: tt.commands, ContinueOnFailure: tt.continueOnFailure, ArgSeparator: new(string)}
+			if err := rule.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, "/steps")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleHeadTailLines(t *testing.T) {
+	const script = "for i in 1 2 3 4 5 6; do echo line$i; done"
+
+	tests := []struct {
+		name string
+		head int
+		tail int
+		want string
+	}{
+		{name: "untrimmed", want: "line1\nline2\nline3\nline4\nline5\nline6\n"},
+		{name: "head", head: 2, want: "line1\nline2\n… 4 lines omitted"},
+		{name: "tail", tail: 2, want: "… 4 lines omitted\nline5\nline6"},
+		{name: "head and tail", head: 1, tail: 2, want: "line1\n… 3 lines omitted\nline5\nline6"},
+		{name: "short enough", head: 3, tail: 3, want: "line1\nline2\nline3\nline4\nline5\nline6\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := shellRule("log", "/log", script)
+			rule.HeadLines = tt.head
+			rule.TailLines = tt.tail
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, "/log")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleFailureWithoutStderr(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{name: "no output", script: "exit 3", want: "command exited with code=3"},
+		{name: "only stdout", script: "echo out; exit 3", want: "command exited with code=3"},
+		{name: "only newlines on stderr", script: "printf '\\n\\n' >&2; exit 3", want: "command exited with code=3"},
+		{name: "with stderr", script: "echo bad >&2; exit 3", want: "command exited with code=3\n\nbad"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := New(Config{Rules: []Rule{shellRule("fail", "/fail", tt.script)}})
+
+			output, ok := handle(t, tc, "/fail")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleFailureStdoutLines(t *testing.T) {
+	const script = "echo step1; echo step2; echo 'error: disk full'; echo bad >&2; exit 1"
+
+	tests := []struct {
+		name        string
+		configLines int
+		ruleLines   int
+		combine     bool
+		want        string
+	}{
+		{name: "stdout isn't included by default", want: "command exited with code=1\n\nbad"},
+		{name: "last lines from the config", configLines: 1, want: "command exited with code=1\n\nbad\n\n… 2 lines omitted\nerror: disk full"},
+		{name: "rule overrides the config", configLines: 1, ruleLines: 2, want: "command exited with code=1\n\nbad\n\n… 1 lines omitted\nstep2\nerror: disk full"},
+		{name: "more lines than written", ruleLines: 10, want: "command exited with code=1\n\nbad\n\nstep1\nstep2\nerror: disk full"},
+		// the combined output already holds stdout
+		{name: "combined output", ruleLines: 1, combine: true, want: "command exited with code=1\n\nstep1\nstep2\nerror: disk full\nbad"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := shellRule("fail", "/fail", script)
+			rule.FailureStdoutLines = tt.ruleLines
+			rule.CombineOutput = tt.combine
+			tc := New(Config{Rules: []Rule{rule}, FailureStdoutLines: tt.configLines})
+
+			output, ok := handle(t, tc, "/fail")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestDedupeLines(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   string
+	}{
+		{name: "no repeats", output: "a\nb\nc\n", want: "a\nb\nc\n"},
+		{name: "repeated lines", output: "retrying\nretrying\nretrying\ndone\n", want: "retrying (x3)\ndone\n"},
+		{name: "only consecutive lines", output: "a\na\nb\na\n", want: "a (x2)\nb\na\n"},
+		{name: "blank lines are kept", output: "a\n\n\n\nb", want: "a\n\n\n\nb"},
+		{name: "whitespace isn't ignored", output: "a\na \na", want: "a\na \na"},
+		{name: "empty", output: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dedupeLines(tt.output); got != tt.want {
+				t.Errorf("dedupeLines() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleDedupeLines(t *testing.T) {
+	const script = "for i in 1 2 3 4 5; do echo waiting; done; echo ready"
+
+	tests := []struct {
+		name      string
+		dedupe    bool
+		headLines int
+		want      string
+	}{
+		{name: "off by default", want: "waiting\nwaiting\nwaiting\nwaiting\nwaiting\nready\n"},
+		{name: "collapsed", dedupe: true, want: "waiting (x5)\nready\n"},
+		// collapsed before the output is trimmed
+		{name: "before head lines", dedupe: true, headLines: 2, want: "waiting (x5)\nready\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := shellRule("wait", "/wait", script)
+			rule.DedupeLines = tt.dedupe
+			rule.HeadLines = tt.headLines
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, "/wait")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleExitCodeInTemplates(t *testing.T) {
+	const prefix = "{{if eq .ExitCode 0}}✅{{else}}❌{{end}} "
+
+	tests := []struct {
+		name         string
+		script       string
+		successCodes []int
+		timeout      string
+		want         string
+	}{
+		{name: "success", script: "echo ok", want: "✅ ok\n"},
+		{name: "failure", script: "echo bad >&2; exit 3", want: "❌ command exited with code=3\n\nbad"},
+		{name: "accepted exit code", script: "echo partial; exit 1", successCodes: []int{1}, want: "❌ partial\n"},
+		{name: "timeout", script: "sleep 5", timeout: "50ms", want: "❌ command took too long to finish"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := shellRule("check", "/check", tt.script)
+			rule.OutputPrefix = prefix
+			rule.SuccessExitCodes = tt.successCodes
+			rule.Timeout = tt.timeout
+			tc := New(Config{Rules: []Rule{rule}})
+
+			output, ok := handle(t, tc, "/check")
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
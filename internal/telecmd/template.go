@@ -0,0 +1,69 @@
+package telecmd
+
+import (
+	"context"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateContext is the data available to rule templates
+type templateContext struct {
+	Rule     string
+	ChatID   int64
+	UserID   int64
+	Username string
+	Text     string
+	Time     time.Time
+	// ExitCode is the exit code of the command when decorating its output, -1 if it timed out
+	ExitCode int
+}
+
+func newTemplateContext(rule Rule, message *tgbotapi.Message, now time.Time) templateContext {
+	c := templateContext{Rule: rule.Name, Text: message.Text, Time: now}
+	if message.Chat != nil {
+		c.ChatID = message.Chat.ID
+	}
+	if message.From != nil {
+		c.UserID = message.From.ID
+		c.Username = message.From.UserName
+	}
+	return c
+}
+
+func renderTemplate(text string, data any) (string, error) {
+	return renderTemplateContext(context.Background(), text, data)
+}
+
+// renderTemplateContext renders the template, stopping early once ctx is cancelled
+func renderTemplateContext(ctx context.Context, text string, data any) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	tmpl, err := template.New("").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	if err := tmpl.Execute(contextWriter{ctx: ctx, w: &sb}, data); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// contextWriter fails writes after ctx is cancelled, which aborts template execution
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c contextWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
@@ -0,0 +1,114 @@
+package telecmd
+
+import (
+	"bytes"
+	"encoding/json"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// threadCacheSize is how many received messages in topics are remembered
+const threadCacheSize = 1000
+
+type threadKey struct {
+	chatID    int64
+	messageID int
+}
+
+// messageThreads remembers the topic ids of received messages,
+// the messages of this version of the bot API client have no field for them
+type messageThreads struct {
+	mu  sync.Mutex
+	ids map[threadKey]int
+	// order is the keys from the oldest, to forget them first
+	order []threadKey
+}
+
+func newMessageThreads() *messageThreads {
+	return &messageThreads{ids: make(map[threadKey]int)}
+}
+
+func (m *messageThreads) add(chatID int64, messageID int, threadID int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := threadKey{chatID: chatID, messageID: messageID}
+	if _, ok := m.ids[key]; !ok {
+		m.order = append(m.order, key)
+	}
+	m.ids[key] = threadID
+	for len(m.order) > threadCacheSize {
+		delete(m.ids, m.order[0])
+		m.order = m.order[1:]
+	}
+}
+
+// get returns the topic id of the message, false if it's not in a topic or was forgotten
+func (m *messageThreads) get(chatID int64, messageID int) (int, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.ids[threadKey{chatID: chatID, messageID: messageID}]
+	return id, ok
+}
+
+// threadedMessage is the part of a message the topic is read from
+type threadedMessage struct {
+	MessageID int `json:"message_id"`
+	Chat      struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	MessageThreadID int `json:"message_thread_id"`
+}
+
+// record reads the topic ids of the messages in a getUpdates response
+func (m *messageThreads) record(body []byte) {
+	var res struct {
+		Result []struct {
+			Message       *threadedMessage `json:"message"`
+			ChannelPost   *threadedMessage `json:"channel_post"`
+			CallbackQuery *struct {
+				Message *threadedMessage `json:"message"`
+			} `json:"callback_query"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return
+	}
+
+	for _, update := range res.Result {
+		messages := []*threadedMessage{update.Message, update.ChannelPost}
+		if update.CallbackQuery != nil {
+			messages = append(messages, update.CallbackQuery.Message)
+		}
+		for _, message := range messages {
+			if message != nil && message.MessageThreadID != 0 {
+				m.add(message.Chat.ID, message.MessageID, message.MessageThreadID)
+			}
+		}
+	}
+}
+
+// threadRecorder is the HTTP client of the bot, it passes the responses of getUpdates by messageThreads
+type threadRecorder struct {
+	client  tgbotapi.HTTPClient
+	threads *messageThreads
+}
+
+func (r threadRecorder) Do(req *http.Request) (*http.Response, error) {
+	res, err := r.client.Do(req)
+	if err != nil || !strings.HasSuffix(req.URL.Path, "/getUpdates") {
+		return res, err
+	}
+
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	r.threads.record(body)
+	return res, nil
+}
@@ -0,0 +1,121 @@
+package telecmd
+
+import (
+	"context"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// stubClient answers every request with the body
+type stubClient string
+
+func (s stubClient) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(string(s)))}, nil
+}
+
+func TestThreadRecorder(t *testing.T) {
+	const body = `{"ok":true,"result":[
+		{"update_id":1,"message":{"message_id":10,"chat":{"id":100},"message_thread_id":7,"text":"/whoami"}},
+		{"update_id":2,"message":{"message_id":11,"chat":{"id":100},"text":"/whoami"}},
+		{"update_id":3,"channel_post":{"message_id":12,"chat":{"id":200},"message_thread_id":8}},
+		{"update_id":4,"callback_query":{"id":"q","message":{"message_id":13,"chat":{"id":100},"message_thread_id":9}}}
+	]}`
+
+	tests := []struct {
+		name      string
+		method    string
+		chatID    int64
+		messageID int
+		want      int
+		wantOK    bool
+	}{
+		{name: "message in topic", method: "getUpdates", chatID: 100, messageID: 10, want: 7, wantOK: true},
+		{name: "message outside topics", method: "getUpdates", chatID: 100, messageID: 11},
+		{name: "channel post", method: "getUpdates", chatID: 200, messageID: 12, want: 8, wantOK: true},
+		{name: "callback query", method: "getUpdates", chatID: 100, messageID: 13, want: 9, wantOK: true},
+		{name: "other chat", method: "getUpdates", chatID: 300, messageID: 10},
+		{name: "other methods aren't read", method: "sendMessage", chatID: 100, messageID: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			threads := newMessageThreads()
+			client := threadRecorder{client: stubClient(body), threads: threads}
+
+			req, _ := http.NewRequest(http.MethodPost, "https://api.example.com/bottoken/"+tt.method, nil)
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the bot client still reads the whole response
+			if b, _ := io.ReadAll(res.Body); string(b) != body {
+				t.Errorf("body = %q, want the original response", b)
+			}
+
+			got, ok := threads.get(tt.chatID, tt.messageID)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("thread = %d, %v, want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestMessageThreadsForgetsOldest(t *testing.T) {
+	threads := newMessageThreads()
+	for id := 1; id <= threadCacheSize+1; id++ {
+		threads.add(100, id, 7)
+	}
+	if _, ok := threads.get(100, 1); ok {
+		t.Error("the oldest message is still remembered")
+	}
+	if _, ok := threads.get(100, threadCacheSize+1); !ok {
+		t.Error("the newest message was forgotten")
+	}
+	if len(threads.ids) != threadCacheSize || len(threads.order) != threadCacheSize {
+		t.Errorf("remembered %d messages, want %d", len(threads.ids), threadCacheSize)
+	}
+}
+
+func TestWhoamiThread(t *testing.T) {
+	tests := []struct {
+		name     string
+		threadID int
+		want     string
+	}{
+		{name: "in topic", threadID: 7, want: "chat id: 100\nchat type: private\nuser id: 42\nusername: tester\nthread id: 7"},
+		{name: "outside topics", want: "chat id: 100\nchat type: private\nuser id: 42\nusername: tester"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeTelegram(t)
+			tc := New(Config{BotToken: "token", Rules: []Rule{shellRule("echo", "/echo", "echo")}, Builtins: Builtins{Whoami: true}})
+			tc.newClient = f.newClient
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- tc.Run(ctx)
+			}()
+			t.Cleanup(func() {
+				cancel()
+				<-done
+			})
+
+			update := tgbotapi.Update{UpdateID: 1, Message: commandMessage("/whoami")}
+			if tt.threadID != 0 {
+				f.pushInThread("token", update, tt.threadID)
+			} else {
+				f.push("token", update)
+			}
+
+			waitFor(t, "whoami reply", func() bool { return len(f.sent("token", "sendMessage")) > 0 })
+			if got := f.sent("token", "sendMessage")[0].params.Get("text"); got != tt.want {
+				t.Errorf("reply = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
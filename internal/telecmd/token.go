@@ -0,0 +1,107 @@
+package telecmd
+
+import (
+	"context"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// tokenFilePollInterval is how often the token file is checked for changes
+var tokenFilePollInterval = 10 * time.Second
+
+// botToken is the token read from the token file if configured, or the one passed in the config
+func (t Telecmd) botToken() (string, error) {
+	if t.config.TokenFile == "" {
+		return t.config.BotToken, nil
+	}
+
+	b, err := os.ReadFile(t.config.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token file: %w", err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("token file is empty")
+	}
+	return token, nil
+}
+
+func (t Telecmd) newBotAPI() (*tgbotapi.BotAPI, error) {
+	token, err := t.botToken()
+	if err != nil {
+		return nil, err
+	}
+
+	newClient := t.newClient
+	if newClient == nil {
+		newClient = tgbotapi.NewBotAPI
+	}
+	bot, err := newClient(token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bot: %w", err)
+	}
+	bot.Debug = t.config.Debug
+	if t.threads != nil {
+		bot.Client = threadRecorder{client: bot.Client, threads: t.threads}
+	}
+	return bot, nil
+}
+
+// watchTokenFile signals when the token file changes or the process receives SIGUSR1 (unix only),
+// so the bot client can be recreated with the new token
+func (t Telecmd) watchTokenFile(ctx context.Context) (<-chan struct{}, func()) {
+	rotate := make(chan struct{}, 1)
+	if t.config.TokenFile == "" {
+		return rotate, func() {}
+	}
+
+	notify := func() {
+		select {
+		case rotate <- struct{}{}:
+		default:
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	if sigs := rotateSignals(); len(sigs) > 0 {
+		signal.Notify(signals, sigs...)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(tokenFilePollInterval)
+		defer ticker.Stop()
+
+		modTime := fileModTime(t.config.TokenFile)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+				notify()
+			case <-ticker.C:
+				if current := fileModTime(t.config.TokenFile); !current.Equal(modTime) {
+					modTime = current
+					notify()
+				}
+			}
+		}
+	}()
+
+	return rotate, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,166 @@
+package telecmd
+
+import (
+	"context"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRunRotatesToken(t *testing.T) {
+	tokenFilePollInterval = 20 * time.Millisecond
+	t.Cleanup(func() { tokenFilePollInterval = 10 * time.Second })
+
+	f := newFakeTelegram(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("old\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tc := New(Config{
+		TokenFile: tokenFile,
+		Rules:     []Rule{shellRule("echo", "/echo.*", `echo "got $1"`)},
+		Heartbeat: &Heartbeat{ChatID: 7, Interval: "20ms"},
+	})
+	tc.newClient = f.newClient
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- tc.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	repliesTo := func(token string, chatID int64) int {
+		count := 0
+		for _, r := range f.sent(token, "sendMessage") {
+			if r.params.Get("chat_id") == strconv.FormatInt(chatID, 10) {
+				count++
+			}
+		}
+		return count
+	}
+
+	f.push("old", tgbotapi.Update{UpdateID: 1, Message: testMessage("/echo 1")})
+	waitFor(t, "reply with the old token", func() bool { return repliesTo("old", 100) == 1 })
+
+	if err := os.WriteFile(tokenFile, []byte("new\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(tokenFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "heartbeat with the new token", func() bool { return repliesTo("new", 7) > 0 })
+	heartbeatsBefore := repliesTo("old", 7)
+
+	f.push("new", tgbotapi.Update{UpdateID: 2, Message: testMessage("/echo 2")})
+	waitFor(t, "reply with the new token", func() bool { return repliesTo("new", 100) == 1 })
+
+	time.Sleep(60 * time.Millisecond)
+	if got := repliesTo("old", 7); got != heartbeatsBefore {
+		t.Errorf("heartbeat kept sending with the old token, %d heartbeats after rotating", got-heartbeatsBefore)
+	}
+	if got := repliesTo("old", 100); got != 1 {
+		t.Errorf("replies with the old token = %d, want 1", got)
+	}
+}
+
+func TestDrainUpdates(t *testing.T) {
+	tests := []struct {
+		name     string
+		buffered []int
+		// reader is false when nothing receives from the new channel
+		reader bool
+		cancel bool
+		want   []int
+	}{
+		{name: "empty", reader: true},
+		{name: "forwards buffered updates", buffered: []int{1, 2, 3}, reader: true, want: []int{1, 2, 3}},
+		{name: "stops when cancelled", buffered: []int{1, 2}, cancel: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updates := make(chan tgbotapi.Update, len(tt.buffered))
+			for _, id := range tt.buffered {
+				updates <- tgbotapi.Update{UpdateID: id}
+			}
+			close(updates)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+
+			to := make(chan tgbotapi.Update)
+			finished := make(chan struct{})
+			go func() {
+				drainUpdates(ctx, updates, to)
+				close(finished)
+			}()
+
+			var got []int
+			for tt.reader && len(got) < len(tt.want) {
+				got = append(got, (<-to).UpdateID)
+			}
+			select {
+			case <-finished:
+			case <-time.After(time.Second):
+				t.Fatal("drainUpdates didn't return")
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("forwarded %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("forwarded %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBotToken(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		config  Config
+		want    string
+		wantErr bool
+	}{
+		{name: "config token", config: Config{BotToken: "abc"}, want: "abc"},
+		{name: "token file wins", config: Config{BotToken: "abc", TokenFile: write("token", "def\n")}, want: "def"},
+		{name: "empty token file", config: Config{TokenFile: write("empty", "\n")}, wantErr: true},
+		{name: "missing token file", config: Config{TokenFile: filepath.Join(dir, "missing")}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := New(tt.config).botToken()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("token = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package telecmd
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Transform replaces matches of a regex in the message before it's passed to the command
+type Transform struct {
+	Pattern string `yaml:"pattern,omitempty"`
+	Replace string `yaml:"replace,omitempty"`
+}
+
+func (tr Transform) Validate() error {
+	if _, err := regexp.Compile(tr.Pattern); err != nil {
+		return fmt.Errorf("invalid pattern: %w", err)
+	}
+	return nil
+}
+
+// transformText applies the transforms of the rule in order, the replacement can refer to groups with $1 or ${name}
+func transformText(transforms []Transform, text string) string {
+	for _, tr := range transforms {
+		re, err := regexp.Compile(tr.Pattern)
+		if err != nil {
+			continue
+		}
+		text = re.ReplaceAllString(text, tr.Replace)
+	}
+	return text
+}
@@ -0,0 +1,41 @@
+package telecmd
+
+import "testing"
+
+func TestHandleTransform(t *testing.T) {
+	stripCommand := Transform{Pattern: `^/\S+\s*`}
+	collapseSpaces := Transform{Pattern: `\s+`, Replace: " "}
+	lowercase := Transform{Pattern: `(?i)PROD`, Replace: "prod"}
+
+	tests := []struct {
+		name       string
+		text       string
+		transforms []Transform
+		useStdin   bool
+		want       string
+	}{
+		{name: "none", text: "/deploy  PROD   eu", want: "/deploy  PROD   eu"},
+		{name: "strip the command", text: "/deploy prod", transforms: []Transform{stripCommand}, want: "prod"},
+		{name: "chained", text: "/deploy  PROD \t eu", transforms: []Transform{stripCommand, collapseSpaces, lowercase}, want: "prod eu"},
+		{name: "groups", text: "/deploy prod eu", transforms: []Transform{{Pattern: `^/deploy (\w+) (\w+)$`, Replace: "${2}-$1"}}, want: "eu-prod"},
+		{name: "stdin", text: "/deploy prod", transforms: []Transform{stripCommand}, useStdin: true, want: "prod"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := shellRule("deploy", "^/deploy", `if [ -n "$1" ]; then printf %s "$1"; else cat; fi`)
+			rule.Transform = tt.transforms
+			rule.UseStdin = tt.useStdin
+			tc := New(Config{Rules: []Rule{rule}})
+
+			// rules are matched against the original text
+			output, ok := handle(t, tc, tt.text)
+			if !ok {
+				t.Fatal("rule didn't run")
+			}
+			if output != tt.want {
+				t.Errorf("output = %q, want %q", output, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package telecmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// speak turns text replies into voice messages with the TTS command of the rule,
+// which reads the text from stdin and writes the audio, ideally OGG/Opus, to stdout.
+// Replies that can't be converted in time are sent as they are.
+func speak(ctx context.Context, rule Rule, replies []tgbotapi.Chattable, timeout time.Duration) []tgbotapi.Chattable {
+	spoken := make([]tgbotapi.Chattable, len(replies))
+	for i, c := range replies {
+		spoken[i] = c
+
+		m, ok := c.(tgbotapi.MessageConfig)
+		if !ok {
+			continue
+		}
+		audio, err := runTTS(ctx, rule.TTS, m.Text, timeout)
+		if err != nil {
+			log.Error().Err(err).Str("rule", rule.Name).Msg("cannot convert reply to voice, sending text")
+			continue
+		}
+
+		voice := tgbotapi.NewVoice(m.ChatID, tgbotapi.FileBytes{Name: "reply.ogg", Bytes: audio})
+		voice.DisableNotification = m.DisableNotification
+		spoken[i] = voice
+	}
+	return spoken
+}
+
+func runTTS(ctx context.Context, command []string, text string, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	setProcessGroup(cmd)
+	cmd.WaitDelay = commandWaitDelay
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("tts timed out after %s", timeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, fmt.Errorf("tts failed: %w", err)
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("tts produced no audio")
+	}
+	return stdout.Bytes(), nil
+}
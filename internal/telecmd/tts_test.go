@@ -0,0 +1,45 @@
+package telecmd
+
+import (
+	"context"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"testing"
+	"time"
+)
+
+func TestSpeak(t *testing.T) {
+	tests := []struct {
+		name      string
+		tts       []string
+		wantVoice bool
+	}{
+		{name: "converted", tts: []string{"cat"}, wantVoice: true},
+		{name: "failed", tts: []string{"sh", "-c", "echo broken >&2; exit 1"}},
+		{name: "no audio", tts: []string{"true"}},
+		// the shell's child keeps stdout open after the shell is killed
+		{name: "timed out", tts: []string{"sh", "-c", "sleep 5; cat"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := Rule{Name: "say", TTS: tt.tts}
+			replies := []tgbotapi.Chattable{tgbotapi.NewMessage(100, "hello")}
+
+			start := time.Now()
+			spoken := speak(context.Background(), rule, replies, 200*time.Millisecond)
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("speaking took %s", elapsed)
+			}
+
+			voice, isVoice := spoken[0].(tgbotapi.VoiceConfig)
+			if isVoice != tt.wantVoice {
+				t.Fatalf("reply = %T, want voice %v", spoken[0], tt.wantVoice)
+			}
+			if isVoice {
+				if audio := string(voice.File.(tgbotapi.FileBytes).Bytes); audio != "hello" {
+					t.Errorf("audio = %q, want the tts output", audio)
+				}
+			}
+		})
+	}
+}
@@ -1,9 +1,20 @@
 package telecmd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"golang.org/x/exp/slices"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 )
 
@@ -29,30 +40,469 @@ func (d *Duration) UnmarshalJSON(b []byte) error {
 }
 
 type Rule struct {
-	Name             string   `yaml:"name"`
-	Pattern          string   `yaml:"pattern"`
-	WorkingDirectory string   `yaml:"workingDir"`
-	UseStdin         bool     `yaml:"useStdin"`
-	Environment      []string `yaml:"env"`
-	Command          []string `yaml:"command"`
+	Name               string      `yaml:"name,omitempty"`
+	Tags               []string    `yaml:"tags,omitempty"`
+	Users              []int64     `yaml:"users,omitempty"`
+	Pattern            string      `yaml:"pattern,omitempty"`
+	Patterns           []string    `yaml:"patterns,omitempty"`
+	AllowEmptyMatch    bool        `yaml:"allowEmptyMatch,omitempty"`
+	AnchorPattern      *bool       `yaml:"anchorPattern,omitempty"`
+	ExcludePattern     string      `yaml:"excludePattern,omitempty"`
+	IsReplyToBot       bool        `yaml:"isReplyToBot,omitempty"`
+	MinArgs            int         `yaml:"minArgs,omitempty"`
+	Usage              string      `yaml:"usage,omitempty"`
+	Weight             int         `yaml:"weight,omitempty"`
+	Priority           int         `yaml:"priority,omitempty"`
+	Timeout            string      `yaml:"timeout,omitempty"`
+	Schedule           string      `yaml:"schedule,omitempty"`
+	ScheduleChatID     int64       `yaml:"scheduleChatId,omitempty"`
+	ScheduleTimeout    string      `yaml:"scheduleTimeout,omitempty"`
+	WorkingDirectory   string      `yaml:"workingDir,omitempty"`
+	CreateWorkingDir   bool        `yaml:"createWorkingDir,omitempty"`
+	RunAs              string      `yaml:"runAs,omitempty"`
+	Nice               int         `yaml:"nice,omitempty"`
+	UseStdin           bool        `yaml:"useStdin,omitempty"`
+	ArgSeparator       *string     `yaml:"argSeparator,omitempty"`
+	SplitArgs          bool        `yaml:"splitArgs,omitempty"`
+	ExtractEntity      string      `yaml:"extractEntity,omitempty"`
+	Transform          []Transform `yaml:"transform,omitempty"`
+	PassRawUpdate      string      `yaml:"passRawUpdate,omitempty"`
+	DownloadFile       bool        `yaml:"downloadFile,omitempty"`
+	AllowedFileTypes   []string    `yaml:"allowedFileTypes,omitempty"`
+	Environment        []string    `yaml:"env,omitempty"`
+	FromEnv            []string    `yaml:"fromEnv,omitempty"`
+	EnvFile            string      `yaml:"envFile,omitempty"`
+	Command            []string    `yaml:"command,omitempty"`
+	ExpandArgs         bool        `yaml:"expandArgs,omitempty"`
+	Commands           [][]string  `yaml:"commands,omitempty"`
+	ContinueOnFailure  bool        `yaml:"continueOnFailure,omitempty"`
+	FallbackRule       string      `yaml:"fallbackRule,omitempty"`
+	SingleFlight       bool        `yaml:"singleFlight,omitempty"`
+	Script             string      `yaml:"script,omitempty"`
+	Interpreter        string      `yaml:"interpreter,omitempty"`
+	SuccessExitCodes   []int       `yaml:"successExitCodes,omitempty"`
+	FailureStdoutLines int         `yaml:"failureStdoutLines,omitempty"`
+	Guard              []string    `yaml:"guard,omitempty"`
+	GuardReply         string      `yaml:"guardReply,omitempty"`
+	RemoveKeyboard     bool        `yaml:"removeKeyboard,omitempty"`
+	OutputType         string      `yaml:"outputType,omitempty"`
+	OutputFileName     string      `yaml:"outputFileName,omitempty"`
+	ParseMode          string      `yaml:"parseMode,omitempty"`
+	JSONOutput         bool        `yaml:"jsonOutput,omitempty"`
+	CombineOutput      bool        `yaml:"combineOutput,omitempty"`
+	MaxOutputLength    int         `yaml:"maxOutputLength,omitempty"`
+	DedupeLines        bool        `yaml:"dedupeLines,omitempty"`
+	HeadLines          int         `yaml:"headLines,omitempty"`
+	TailLines          int         `yaml:"tailLines,omitempty"`
+	OutputPrefix       string      `yaml:"outputPrefix,omitempty"`
+	OutputSuffix       string      `yaml:"outputSuffix,omitempty"`
+	ReplyOn            string      `yaml:"replyOn,omitempty"`
+	ShowCommand        bool        `yaml:"showCommand,omitempty"`
+	ShowDuration       bool        `yaml:"showDuration,omitempty"`
+	WarnAfter          string      `yaml:"warnAfter,omitempty"`
+	Silent             bool        `yaml:"silent,omitempty"`
+	ReplyThreadID      int         `yaml:"replyThreadId,omitempty"`
+	EditInPlace        bool        `yaml:"editInPlace,omitempty"`
+	TTS                []string    `yaml:"tts,omitempty"`
+	TTSTimeout         string      `yaml:"ttsTimeout,omitempty"`
+
+	// index is the position of the rule in the config
+	index int
+	// argsOnly is set when the message text is only the arguments, without a command, like with /run
+	argsOnly bool
+}
+
+// Index is the position of the rule in the config, set for rules returned by Config.OrderedRules
+func (r Rule) Index() int {
+	return r.index
+}
+
+// ArgumentSeparator returns what's passed before the message text, which is "--" unless configured
+func (r Rule) ArgumentSeparator() string {
+	if r.ArgSeparator != nil {
+		return *r.ArgSeparator
+	}
+	// the arguments of a script start at $1, a separator would take its place
+	if r.Script != "" {
+		return ""
+	}
+	return "--"
+}
+
+// RuleWeight is the weight of the rule when picking a random one among matching rules, 1 by default
+func (r Rule) RuleWeight() int {
+	if r.Weight > 0 {
+		return r.Weight
+	}
+	return 1
+}
+
+// ScheduleOnly rules have a schedule but no pattern, they never match messages
+func (r Rule) ScheduleOnly() bool {
+	return r.Schedule != "" && r.Pattern == "" && len(r.Patterns) == 0
+}
+
+// AllowsUser reports whether the user can trigger the rule, anyone can if the rule has no users
+func (r Rule) AllowsUser(user *tgbotapi.User) bool {
+	if len(r.Users) == 0 {
+		return true
+	}
+	return user != nil && slices.Contains(r.Users, user.ID)
+}
+
+// PatternList is the patterns the rule matches messages with, either its patterns or its single pattern
+func (r Rule) PatternList() []string {
+	if len(r.Patterns) > 0 {
+		return r.Patterns
+	}
+	return []string{r.Pattern}
+}
+
+// asText is the rule for replying with telecmd's own messages, like the usage or failures,
+// which are plain text whatever the rule's output type and parse mode
+func (r Rule) asText() Rule {
+	r.OutputType = "text"
+	r.ParseMode = "none"
+	r.JSONOutput = false
+	r.OutputFileName = ""
+	return r
+}
+
+// WarnAfterDuration is how long the command runs before the chat is told it's still working, 0 if disabled
+func (r Rule) WarnAfterDuration() time.Duration {
+	warnAfter, _ := time.ParseDuration(r.WarnAfter)
+	return warnAfter
+}
+
+func (r Rule) ScriptInterpreter() string {
+	if r.Interpreter != "" {
+		return r.Interpreter
+	}
+	return "/bin/sh"
 }
 
 func (r Rule) Validate() error {
-	_, err := regexp.Compile(r.Pattern)
-	if err != nil {
-		return fmt.Errorf("invalid regex: %w", err)
+	if r.Pattern != "" && len(r.Patterns) > 0 {
+		return fmt.Errorf("only one of pattern and patterns can be used")
+	}
+	for _, pattern := range r.PatternList() {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid regex: %w", err)
+		}
+		// a pattern matching the empty string matches every message, which is rarely intended
+		if !r.AllowEmptyMatch && !r.ScheduleOnly() && re.MatchString("") && re.MatchString("\x00") {
+			return fmt.Errorf("pattern %q matches every message, set allowEmptyMatch if that's intended", pattern)
+		}
 	}
-	if len(r.Command) == 0 {
+	if _, err := regexp.Compile(r.ExcludePattern); err != nil {
+		return fmt.Errorf("invalid exclude regex: %w", err)
+	}
+	for _, tag := range r.Tags {
+		if strings.TrimSpace(tag) == "" {
+			return fmt.Errorf("tags cannot be empty")
+		}
+	}
+	for _, ref := range r.FromEnv {
+		name, source, renamed := strings.Cut(ref, "=")
+		if !envNamePattern.MatchString(name) || (renamed && !envNamePattern.MatchString(source)) {
+			return fmt.Errorf("invalid fromEnv %q, must be NAME or NAME=SOURCE", ref)
+		}
+	}
+	for name, timeout := range map[string]string{"timeout": r.Timeout, "scheduleTimeout": r.ScheduleTimeout, "ttsTimeout": r.TTSTimeout} {
+		if timeout == "" {
+			continue
+		}
+		if parsed, err := time.ParseDuration(timeout); err != nil || parsed <= 0 {
+			return fmt.Errorf("invalid %s %q", name, timeout)
+		}
+	}
+	if r.Schedule != "" {
+		if _, err := parseSchedule(r.Schedule); err != nil {
+			return err
+		}
+		if r.ScheduleChatID == 0 {
+			return fmt.Errorf("scheduleChatId is required with schedule")
+		}
+	} else if r.ScheduleTimeout != "" {
+		return fmt.Errorf("scheduleTimeout requires schedule")
+	}
+	if r.TTSTimeout != "" && len(r.TTS) == 0 {
+		return fmt.Errorf("ttsTimeout requires tts")
+	}
+	sources := 0
+	for _, set := range []bool{len(r.Command) > 0, r.Script != "", len(r.Commands) > 0} {
+		if set {
+			sources++
+		}
+	}
+	if sources == 0 {
 		return fmt.Errorf("invalid command")
 	}
+	if sources > 1 {
+		return fmt.Errorf("only one of command, commands and script can be used")
+	}
+	if r.Script != "" {
+		if _, err := exec.LookPath(r.ScriptInterpreter()); err != nil {
+			return fmt.Errorf("invalid interpreter: %w", err)
+		}
+		// the script would be expanded too, replacing its own variables
+		if r.ExpandArgs {
+			return fmt.Errorf("expandArgs cannot be used with script")
+		}
+	}
+	for i, command := range r.Commands {
+		if len(command) == 0 {
+			return fmt.Errorf("command %d is empty", i)
+		}
+	}
+	for i, tr := range r.Transform {
+		if err := tr.Validate(); err != nil {
+			return fmt.Errorf("invalid transform %d: %w", i, err)
+		}
+	}
+	if _, err := template.New("").Parse(r.WorkingDirectory); err != nil {
+		return fmt.Errorf("invalid workingDir: %w", err)
+	}
+	if _, err := template.New("").Parse(r.OutputPrefix); err != nil {
+		return fmt.Errorf("invalid outputPrefix: %w", err)
+	}
+	if _, err := template.New("").Parse(r.OutputSuffix); err != nil {
+		return fmt.Errorf("invalid outputSuffix: %w", err)
+	}
+	if r.RunAs != "" {
+		if _, err := credentialFor(r.RunAs); err != nil {
+			return fmt.Errorf("invalid runAs: %w", err)
+		}
+	}
+	if r.WarnAfter != "" {
+		if warnAfter, err := time.ParseDuration(r.WarnAfter); err != nil || warnAfter <= 0 {
+			return fmt.Errorf("invalid warnAfter %q", r.WarnAfter)
+		}
+	}
+	if r.FailureStdoutLines < 0 {
+		return fmt.Errorf("failureStdoutLines cannot be negative")
+	}
+	if r.HeadLines < 0 || r.TailLines < 0 {
+		return fmt.Errorf("headLines and tailLines cannot be negative")
+	}
+	if r.MinArgs < 0 {
+		return fmt.Errorf("minArgs cannot be negative")
+	}
+	if r.Weight < 0 {
+		return fmt.Errorf("weight cannot be negative")
+	}
+	if r.Nice < -20 || r.Nice > 19 {
+		return fmt.Errorf("invalid nice %d, must be between -20 and 19", r.Nice)
+	}
+	switch r.ReplyOn {
+	case "", "always", "success", "failure":
+	default:
+		return fmt.Errorf("invalid replyOn %q, must be always, success or failure", r.ReplyOn)
+	}
+	switch r.OutputType {
+	case "", "text", "photo", "document", "voice", "json":
+	default:
+		return fmt.Errorf("invalid outputType %q, must be text, photo, document, voice or json", r.OutputType)
+	}
+	if r.ParseMode != "" && r.ParseMode != "none" && !slices.Contains(parseModes, r.ParseMode) {
+		return fmt.Errorf("invalid parseMode %q, must be HTML, Markdown, MarkdownV2 or none", r.ParseMode)
+	}
+	if r.OutputFileName != "" && !slices.Contains([]string{"photo", "document", "voice"}, r.OutputType) {
+		return fmt.Errorf("outputFileName can only be used with outputType photo, document or voice")
+	}
+	if r.JSONOutput && r.OutputType != "" && r.OutputType != "json" {
+		return fmt.Errorf("jsonOutput cannot be used with outputType %s", r.OutputType)
+	}
+	if r.ExtractEntity != "" && !slices.Contains(extractableEntities, r.ExtractEntity) {
+		return fmt.Errorf("invalid extractEntity %q, must be pre or code", r.ExtractEntity)
+	}
+	if r.SplitArgs && r.UseStdin {
+		return fmt.Errorf("splitArgs cannot be used with useStdin")
+	}
+	switch r.PassRawUpdate {
+	case "", "env":
+	case "stdin":
+		if r.UseStdin {
+			return fmt.Errorf("passRawUpdate=stdin cannot be used with useStdin")
+		}
+	default:
+		return fmt.Errorf("invalid passRawUpdate %q, must be env or stdin", r.PassRawUpdate)
+	}
 	return nil
 }
 
+type Builtins struct {
+	Status  bool `yaml:"status,omitempty"`
+	Version bool `yaml:"version,omitempty"`
+	Run     bool `yaml:"run,omitempty"`
+	Cancel  bool `yaml:"cancel,omitempty"`
+	Whoami  bool `yaml:"whoami,omitempty"`
+}
+
 type Config struct {
-	BotToken       string
-	Debug          bool
-	Rules          []Rule `yaml:"rules"`
-	CommandTimeout string `yaml:"commandTimeout"`
+	// BotToken and Debug come from flags, not the config file
+	BotToken           string              `yaml:"-"`
+	TokenFile          string              `yaml:"tokenFile,omitempty"`
+	Debug              bool                `yaml:"-"`
+	Rules              []Rule              `yaml:"rules,omitempty"`
+	CommandTimeout     string              `yaml:"commandTimeout,omitempty"`
+	HandlerTimeout     string              `yaml:"handlerTimeout,omitempty"`
+	Messages           map[string]string   `yaml:"messages,omitempty"`
+	Admins             []int64             `yaml:"admins,omitempty"`
+	Builtins           Builtins            `yaml:"builtins,omitempty"`
+	PasteUpload        *PasteUpload        `yaml:"pasteUpload,omitempty"`
+	AnchorPatterns     bool                `yaml:"anchorPatterns,omitempty"`
+	PreHook            []string            `yaml:"preHook,omitempty"`
+	PostHook           []string            `yaml:"postHook,omitempty"`
+	EventSocket        string              `yaml:"eventSocket,omitempty"`
+	FailureWebhook     string              `yaml:"failureWebhook,omitempty"`
+	PollTimeout        string              `yaml:"pollTimeout,omitempty"`
+	OffsetFile         string              `yaml:"offsetFile,omitempty"`
+	StateDir           string              `yaml:"stateDir,omitempty"`
+	AllowedUpdates     []string            `yaml:"allowedUpdates,omitempty"`
+	MatchMode          string              `yaml:"matchMode,omitempty"`
+	MatchTimeout       string              `yaml:"matchTimeout,omitempty"`
+	FailureStdoutLines int                 `yaml:"failureStdoutLines,omitempty"`
+	DefaultParseMode   string              `yaml:"defaultParseMode,omitempty"`
+	Heartbeat          *Heartbeat          `yaml:"heartbeat,omitempty"`
+	OnJoin             *OnJoin             `yaml:"onJoin,omitempty"`
+	QueueSize          int                 `yaml:"queueSize,omitempty"`
+	QueuePolicy        string              `yaml:"queuePolicy,omitempty"`
+	Bots               []BotConfig         `yaml:"bots,omitempty"`
+	MaxMessageLength   int                 `yaml:"maxMessageLength,omitempty"`
+	ForwardedMessages  string              `yaml:"forwardedMessages,omitempty"`
+	BlankMessages      string              `yaml:"blankMessages,omitempty"`
+	UnmatchedReply     string              `yaml:"unmatchedReply,omitempty"`
+	SanitizeEnv        bool                `yaml:"sanitizeEnv,omitempty"`
+	MaxEnvValueLength  int                 `yaml:"maxEnvValueLength,omitempty"`
+	AdminAddr          string              `yaml:"adminAddr,omitempty"`
+	AdminToken         string              `yaml:"adminToken,omitempty"`
+	ChatAllow          string              `yaml:"chatAllow,omitempty"`
+	ChatBlock          string              `yaml:"chatBlock,omitempty"`
+	MaintenanceWindows []MaintenanceWindow `yaml:"maintenanceWindows,omitempty"`
+	Timezone           string              `yaml:"timezone,omitempty"`
+}
+
+var unsafePathChars = regexp.MustCompile(`[^\w.-]+`)
+
+// RuleStateDir is the directory the rule's command can keep state in, a subdirectory of stateDir named after the rule.
+// stateDir defaults to telecmd/state in the user's cache directory.
+func (c Config) RuleStateDir(rule Rule) string {
+	base := c.StateDir
+	if base == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			cacheDir = os.TempDir()
+		}
+		base = filepath.Join(cacheDir, "telecmd", "state")
+	}
+
+	name := strings.Trim(unsafePathChars.ReplaceAllString(rule.Name, "_"), ".")
+	if name == "" {
+		name = fmt.Sprintf("rule-%d", rule.index)
+	}
+	return filepath.Join(base, name)
+}
+
+// EnvValueLimit is the maximum length of TELEGRAM_* env values in bytes, 32KiB by default and unlimited if negative
+func (c Config) EnvValueLimit() int {
+	if c.MaxEnvValueLength != 0 {
+		return c.MaxEnvValueLength
+	}
+	return 32 * 1024
+}
+
+func (c Config) QueueCapacity() int {
+	if c.QueueSize > 0 {
+		return c.QueueSize
+	}
+	return 100
+}
+
+var supportedUpdates = []string{
+	tgbotapi.UpdateTypeMessage,
+	tgbotapi.UpdateTypeCallbackQuery,
+	tgbotapi.UpdateTypeChannelPost,
+	tgbotapi.UpdateTypeMyChatMember,
+}
+
+// UpdateTypes are the updates to ask Telegram for, onJoin needs my_chat_member so it's always included with it
+func (c Config) UpdateTypes() []string {
+	updateTypes := []string{tgbotapi.UpdateTypeMessage, tgbotapi.UpdateTypeCallbackQuery}
+	if len(c.AllowedUpdates) > 0 {
+		updateTypes = slices.Clone(c.AllowedUpdates)
+	}
+	if c.OnJoin != nil && !slices.Contains(updateTypes, tgbotapi.UpdateTypeMyChatMember) {
+		updateTypes = append(updateTypes, tgbotapi.UpdateTypeMyChatMember)
+	}
+	return updateTypes
+}
+
+// OrderedRules returns the rules in the order they're evaluated, by descending priority,
+// then by their position in the config, which follows the file names when loaded from a directory
+func (c Config) OrderedRules() []Rule {
+	rules := slices.Clone(c.Rules)
+	for i := range rules {
+		rules[i].index = i
+	}
+	slices.SortStableFunc(rules, func(a, b Rule) bool {
+		return a.Priority > b.Priority
+	})
+	return rules
+}
+
+// RulePattern returns the pattern of the rule, anchored to match the whole message if configured.
+// The patterns of rules with several are joined into one alternation.
+func (c Config) RulePattern(rule Rule) string {
+	patterns := rule.PatternList()
+	if len(patterns) == 1 {
+		return c.anchorPattern(rule, patterns[0])
+	}
+
+	alternatives := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		alternatives[i] = "(?:" + c.anchorPattern(rule, pattern) + ")"
+	}
+	return strings.Join(alternatives, "|")
+}
+
+func (c Config) anchorPattern(rule Rule, pattern string) string {
+	anchor := c.AnchorPatterns
+	if rule.AnchorPattern != nil {
+		anchor = *rule.AnchorPattern
+	}
+	if anchor {
+		return "^(?:" + pattern + ")$"
+	}
+	return pattern
+}
+
+// ChatAllowed reports whether messages from the chat are handled at all.
+// Patterns are matched against the chat ID and the chat's username, the block pattern wins over the allow pattern.
+func (c Config) ChatAllowed(chat *tgbotapi.Chat) bool {
+	if c.ChatAllow == "" && c.ChatBlock == "" {
+		return true
+	}
+	if chat == nil {
+		return c.ChatAllow == ""
+	}
+
+	matches := func(pattern string) bool {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return false
+		}
+		return re.MatchString(strconv.FormatInt(chat.ID, 10)) || (chat.UserName != "" && re.MatchString(chat.UserName))
+	}
+	if c.ChatBlock != "" && matches(c.ChatBlock) {
+		return false
+	}
+	return c.ChatAllow == "" || matches(c.ChatAllow)
+}
+
+func (c Config) IsAdmin(user *tgbotapi.User) bool {
+	return user != nil && slices.Contains(c.Admins, user.ID)
 }
 
 func (c Config) CommandTimeoutDuration() time.Duration {
@@ -63,14 +513,341 @@ func (c Config) CommandTimeoutDuration() time.Duration {
 	return timeout
 }
 
+// HandlerTimeoutDuration bounds handling a message from matching to sending the replies, it's unlimited if zero
+func (c Config) HandlerTimeoutDuration() time.Duration {
+	timeout, _ := time.ParseDuration(c.HandlerTimeout)
+	return timeout
+}
+
+// handlerContext is the context handling a message runs in, bounded by handlerTimeout if set
+func (c Config) handlerContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout := c.HandlerTimeoutDuration(); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// RuleByName finds the rule with the name
+func (c Config) RuleByName(name string) (Rule, bool) {
+	for _, rule := range c.Rules {
+		if rule.Name == name {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// RuleTimeout is how long the rule's command can run.
+// Scheduled runs use the rule's scheduleTimeout, then its timeout, then commandTimeout.
+func (c Config) RuleTimeout(rule Rule, scheduled bool) time.Duration {
+	if scheduled {
+		if timeout, err := time.ParseDuration(rule.ScheduleTimeout); err == nil {
+			return timeout
+		}
+	}
+	if timeout, err := time.ParseDuration(rule.Timeout); err == nil {
+		return timeout
+	}
+	return c.CommandTimeoutDuration()
+}
+
+// TTSTimeout bounds converting each reply of the rule to voice, ttsTimeout if set, otherwise like the command
+func (c Config) TTSTimeout(rule Rule) time.Duration {
+	if timeout, err := time.ParseDuration(rule.TTSTimeout); err == nil {
+		return timeout
+	}
+	return c.RuleTimeout(rule, false)
+}
+
+var parseModes = []string{tgbotapi.ModeHTML, tgbotapi.ModeMarkdown, tgbotapi.ModeMarkdownV2}
+
+// locations caches loaded timezones, LoadLocation reads the zone file every time
+var locations sync.Map
+
+// Location is the configured timezone for schedules, maintenance windows and timestamps, local time by default
+func (c Config) Location() *time.Location {
+	if c.Timezone == "" {
+		return time.Local
+	}
+	if loc, ok := locations.Load(c.Timezone); ok {
+		return loc.(*time.Location)
+	}
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	locations.Store(c.Timezone, loc)
+	return loc
+}
+
+// Now is the current time in the configured timezone
+func (c Config) Now() time.Time {
+	return time.Now().In(c.Location())
+}
+
+// RuleParseMode is the parse mode of the rule's text replies, defaultParseMode unless the rule sets one.
+// "none" turns off the default for the rule.
+func (c Config) RuleParseMode(rule Rule) string {
+	switch rule.ParseMode {
+	case "":
+		return c.DefaultParseMode
+	case "none":
+		return ""
+	}
+	return rule.ParseMode
+}
+
+// StdoutLinesOnFailure is how many of the last lines of stdout are included in the reply when the rule's command fails
+func (c Config) StdoutLinesOnFailure(rule Rule) int {
+	if rule.FailureStdoutLines > 0 {
+		return rule.FailureStdoutLines
+	}
+	return c.FailureStdoutLines
+}
+
+// MatchTimeoutDuration is how long matching a rule's pattern can take before the rule is skipped, 0 for no limit
+func (c Config) MatchTimeoutDuration() time.Duration {
+	timeout, _ := time.ParseDuration(c.MatchTimeout)
+	return timeout
+}
+
+func (c Config) PollTimeoutDuration() time.Duration {
+	timeout := time.Minute
+	if parsed, err := time.ParseDuration(c.PollTimeout); err == nil {
+		timeout = parsed
+	}
+	return timeout
+}
+
+// Effective returns a copy of the config with the defaults of timeouts, messages and the update queue filled in
+func (c Config) Effective() Config {
+	c.CommandTimeout = c.CommandTimeoutDuration().String()
+	c.PollTimeout = c.PollTimeoutDuration().String()
+	c.AllowedUpdates = c.UpdateTypes()
+	c.QueueSize = c.QueueCapacity()
+	if c.QueuePolicy == "" {
+		c.QueuePolicy = queuePolicyBlock
+	}
+
+	messages := make(map[string]string, len(defaultMessages))
+	for key, text := range defaultMessages {
+		messages[key] = text
+	}
+	for key, text := range c.Messages {
+		messages[key] = text
+	}
+	c.Messages = messages
+
+	rules := make([]Rule, len(c.Rules))
+	for i, rule := range c.Rules {
+		rule.Timeout = c.RuleTimeout(rule, false).String()
+		if rule.Schedule != "" {
+			rule.ScheduleTimeout = c.RuleTimeout(rule, true).String()
+		}
+		if len(rule.TTS) > 0 {
+			rule.TTSTimeout = c.TTSTimeout(rule).String()
+		}
+		rules[i] = rule
+	}
+	c.Rules = rules
+
+	return c
+}
+
+// Masked returns a copy of the config with bot tokens and secret-looking env values masked
+func (c Config) Masked() Config {
+	c.BotToken = maskSecret(c.BotToken)
+	c.AdminToken = maskSecret(c.AdminToken)
+	c.FailureWebhook = maskURL(c.FailureWebhook)
+	if c.PasteUpload != nil {
+		paste := *c.PasteUpload
+		paste.URL = maskURL(paste.URL)
+		c.PasteUpload = &paste
+	}
+
+	bots := make([]BotConfig, len(c.Bots))
+	for i, bot := range c.Bots {
+		bot.Token = maskSecret(bot.Token)
+		bots[i] = bot
+	}
+	c.Bots = bots
+
+	rules := make([]Rule, len(c.Rules))
+	for i, rule := range c.Rules {
+		env := make([]string, len(rule.Environment))
+		for j, kv := range rule.Environment {
+			key, value, _ := strings.Cut(kv, "=")
+			if _, isRef := envRef(value); looksSecret(key) && !isRef {
+				value = maskSecret(value)
+			}
+			env[j] = key + "=" + value
+		}
+		rule.Environment = env
+		rules[i] = rule
+	}
+	c.Rules = rules
+
+	return c
+}
+
+func looksSecret(key string) bool {
+	key = strings.ToUpper(key)
+	for _, s := range []string{"TOKEN", "SECRET", "PASSWORD", "KEY"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskURL keeps the scheme and host of the url, its credentials, path and query often carry tokens
+func maskURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return maskSecret(raw)
+	}
+
+	masked := u.Scheme + "://"
+	if u.User != nil {
+		masked += "****@"
+	}
+	masked += u.Host
+	if u.Path != "" || u.RawQuery != "" {
+		masked += "/****"
+	}
+	return masked
+}
+
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if len(secret) <= 8 {
+		return "****"
+	}
+	return secret[:4] + "****"
+}
+
 func (c Config) Validate() error {
 	if len(c.Rules) == 0 {
 		return fmt.Errorf("rule list cannot be empty")
 	}
+	names := make(map[string]int)
 	for i, rule := range c.Rules {
 		if err := rule.Validate(); err != nil {
 			return fmt.Errorf("invalid rule %d: %w", i, err)
 		}
+		if rule.Name == "" {
+			continue
+		}
+		if j, ok := names[rule.Name]; ok {
+			return fmt.Errorf("rules %d and %d have the same name %q", j, i, rule.Name)
+		}
+		names[rule.Name] = i
+	}
+	for i, rule := range c.Rules {
+		seen := map[string]bool{rule.Name: true}
+		for next := rule.FallbackRule; next != ""; {
+			j, ok := names[next]
+			if !ok {
+				return fmt.Errorf("invalid rule %d: unknown fallbackRule %q", i, next)
+			}
+			if seen[next] {
+				return fmt.Errorf("invalid rule %d: fallbackRule loops back to %q", i, next)
+			}
+			seen[next] = true
+			next = c.Rules[j].FallbackRule
+		}
+	}
+	botNames := make(map[string]bool)
+	for i, bot := range c.Bots {
+		if err := bot.Validate(c.Rules); err != nil {
+			return fmt.Errorf("invalid bot %d: %w", i, err)
+		}
+		if botNames[bot.Name] {
+			return fmt.Errorf("duplicate bot name %q", bot.Name)
+		}
+		botNames[bot.Name] = true
+	}
+	if c.MaxMessageLength < 0 {
+		return fmt.Errorf("maxMessageLength cannot be negative")
+	}
+	if _, err := regexp.Compile(c.ChatAllow); err != nil {
+		return fmt.Errorf("invalid chatAllow: %w", err)
+	}
+	if _, err := regexp.Compile(c.ChatBlock); err != nil {
+		return fmt.Errorf("invalid chatBlock: %w", err)
+	}
+	switch c.QueuePolicy {
+	case "", queuePolicyBlock, queuePolicyDropOldest, queuePolicyRejectNew:
+	default:
+		return fmt.Errorf("invalid queuePolicy %q, must be block, drop-oldest or reject-new", c.QueuePolicy)
+	}
+	if c.DefaultParseMode != "" && !slices.Contains(parseModes, c.DefaultParseMode) {
+		return fmt.Errorf("invalid defaultParseMode %q, must be HTML, Markdown or MarkdownV2", c.DefaultParseMode)
+	}
+	switch c.BlankMessages {
+	case "", "handle", "skip":
+	default:
+		return fmt.Errorf("invalid blankMessages %q, must be handle or skip", c.BlankMessages)
+	}
+	switch c.ForwardedMessages {
+	case "", "handle", "skip":
+	default:
+		return fmt.Errorf("invalid forwardedMessages %q, must be handle or skip", c.ForwardedMessages)
+	}
+	if c.FailureStdoutLines < 0 {
+		return fmt.Errorf("failureStdoutLines cannot be negative")
+	}
+	if c.HandlerTimeout != "" {
+		if timeout, err := time.ParseDuration(c.HandlerTimeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid handlerTimeout %q", c.HandlerTimeout)
+		}
+	}
+	if c.MatchTimeout != "" {
+		if _, err := time.ParseDuration(c.MatchTimeout); err != nil {
+			return fmt.Errorf("invalid matchTimeout %q", c.MatchTimeout)
+		}
+	}
+	switch c.MatchMode {
+	case "", "first", "random":
+	default:
+		return fmt.Errorf("invalid matchMode %q, must be first or random", c.MatchMode)
+	}
+	for _, updateType := range c.AllowedUpdates {
+		if !slices.Contains(supportedUpdates, updateType) {
+			return fmt.Errorf("unsupported update type %q", updateType)
+		}
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q: %w", c.Timezone, err)
+	}
+	for i, w := range c.MaintenanceWindows {
+		if err := w.Validate(); err != nil {
+			return fmt.Errorf("invalid maintenance window %d: %w", i, err)
+		}
+	}
+	if c.Heartbeat != nil {
+		if err := c.Heartbeat.Validate(); err != nil {
+			return fmt.Errorf("invalid heartbeat: %w", err)
+		}
+	}
+	if c.OnJoin != nil {
+		if err := c.OnJoin.Validate(); err != nil {
+			return fmt.Errorf("invalid onJoin: %w", err)
+		}
+	}
+	if c.AdminAddr != "" && c.AdminToken == "" {
+		return fmt.Errorf("adminToken is required with adminAddr")
+	}
+	if c.PasteUpload != nil && c.PasteUpload.URL == "" {
+		return fmt.Errorf("pasteUpload url cannot be empty")
+	}
+	if err := validateMessages(c.Messages); err != nil {
+		return fmt.Errorf("invalid messages: %w", err)
 	}
 	return nil
 }
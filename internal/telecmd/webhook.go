@@ -0,0 +1,69 @@
+package telecmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"time"
+)
+
+type failureNotification struct {
+	Rule     string `json:"rule"`
+	Error    string `json:"error"`
+	ExitCode int    `json:"exitCode"`
+	ChatID   int64  `json:"chatId,omitempty"`
+	UserID   int64  `json:"userId,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+func newFailureNotification(rule Rule, message *tgbotapi.Message, exitCode int, err error) failureNotification {
+	n := failureNotification{Rule: rule.Name, Error: err.Error(), ExitCode: exitCode}
+	if message.Chat != nil {
+		n.ChatID = message.Chat.ID
+	}
+	if message.From != nil {
+		n.UserID = message.From.ID
+		n.Username = message.From.UserName
+	}
+	return n
+}
+
+// notifyFailure posts the notification to the webhook in the background
+func notifyFailure(url string, n failureNotification) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := postJSON(ctx, url, n); err != nil {
+			log.Error().Err(err).Msg("failed to notify failure webhook")
+		}
+	}()
+}
+
+func postJSON(ctx context.Context, url string, payload any) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to serialize payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+	return nil
+}
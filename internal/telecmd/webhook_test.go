@@ -0,0 +1,69 @@
+package telecmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandleFailureWebhook(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   *failureNotification
+	}{
+		{name: "success", script: "echo ok"},
+		{
+			name:   "failure",
+			script: "echo broken >&2; exit 2",
+			want:   &failureNotification{Rule: "check", Error: "command exited with code=2\n\nbroken", ExitCode: 2, ChatID: 100, UserID: 42, Username: "tester"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			posted := make(chan failureNotification, 1)
+			// slow to respond, replies don't wait for it
+			release := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var n failureNotification
+				if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+					t.Errorf("cannot decode payload: %v", err)
+				}
+				if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+					t.Errorf("content type = %q, want application/json", ct)
+				}
+				posted <- n
+				<-release
+			}))
+			defer server.Close()
+			defer close(release)
+
+			tc := New(Config{Rules: []Rule{shellRule("check", "/check", tt.script)}, FailureWebhook: server.URL})
+
+			start := time.Now()
+			if _, ok := handle(t, tc, "/check"); !ok {
+				t.Fatal("rule didn't run")
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("handling took %s", elapsed)
+			}
+
+			select {
+			case n := <-posted:
+				if tt.want == nil {
+					t.Fatalf("posted %+v, want nothing", n)
+				}
+				if n != *tt.want {
+					t.Errorf("payload = %+v, want %+v", n, *tt.want)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tt.want != nil {
+					t.Fatal("nothing posted")
+				}
+			}
+		})
+	}
+}